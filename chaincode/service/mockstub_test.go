@@ -0,0 +1,225 @@
+package main
+
+import (
+	"errors"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/inklabsfoundation/inkchain/core/chaincode/shim"
+	pb "github.com/inklabsfoundation/inkchain/protos/peer"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// mockStub runs the chaincode against an in-memory ledger.
+// The writes of a transaction are only committed when it succeeds,
+// and they are not visible to the transaction itself, as on a peer.
+type mockStub struct {
+	shim.ChaincodeStubInterface
+	cc       *serviceChaincode
+	state    map[string][]byte
+	balances map[string]*big.Int
+	now      int64
+	txNum    int
+
+	// current transaction
+	function  string
+	args      []string
+	sender    string
+	txID      string
+	writes    map[string][]byte
+	deletes   map[string]bool
+	transfers map[string]*big.Int
+	eventName string // the event set by the transaction, if any
+	event     []byte
+}
+
+// newMockStub instantiates the chaincode by "sender" with the Init args
+func newMockStub(t *testing.T, sender string, args ...string) *mockStub {
+	stub := &mockStub{
+		cc:       new(serviceChaincode),
+		state:    make(map[string][]byte),
+		balances: make(map[string]*big.Int),
+		now:      1500000000,
+	}
+	stub.begin(sender, "init", args)
+	res := stub.cc.Init(stub)
+	if res.Status != shim.OK {
+		t.Fatalf("Init failed: %s", res.Message)
+	}
+	stub.commit()
+	return stub
+}
+
+func (stub *mockStub) begin(sender string, function string, args []string) {
+	stub.txNum++
+	stub.now++
+	stub.function = function
+	stub.args = args
+	stub.sender = sender
+	stub.txID = "tx" + strconv.Itoa(stub.txNum)
+	stub.writes = make(map[string][]byte)
+	stub.deletes = make(map[string]bool)
+	stub.transfers = make(map[string]*big.Int)
+	stub.eventName, stub.event = "", nil
+}
+
+func (stub *mockStub) commit() {
+	for key := range stub.deletes {
+		delete(stub.state, key)
+	}
+	for key, value := range stub.writes {
+		stub.state[key] = value
+	}
+	for account, amount := range stub.transfers {
+		stub.balances[account] = new(big.Int).Add(stub.balance(account), amount)
+	}
+}
+
+// invoke runs one transaction sent by sender
+func (stub *mockStub) invoke(sender string, function string, args ...string) pb.Response {
+	stub.begin(sender, function, args)
+	res := stub.cc.Invoke(stub)
+	if res.Status == shim.OK {
+		stub.commit()
+	}
+	return res
+}
+
+// mustInvoke runs one transaction that is expected to succeed
+func (stub *mockStub) mustInvoke(t *testing.T, sender string, function string, args ...string) []byte {
+	t.Helper()
+	res := stub.invoke(sender, function, args...)
+	if res.Status != shim.OK {
+		t.Fatalf("%s%v failed: %s", function, args, res.Message)
+	}
+	return res.Payload
+}
+
+func (stub *mockStub) balance(account string) *big.Int {
+	if balance, ok := stub.balances[account]; ok {
+		return balance
+	}
+	return big.NewInt(0)
+}
+
+func (stub *mockStub) GetFunctionAndParameters() (string, []string) {
+	return stub.function, stub.args
+}
+
+func (stub *mockStub) GetTxID() string {
+	return stub.txID
+}
+
+func (stub *mockStub) GetTxTimestamp() (*timestamp.Timestamp, error) {
+	return &timestamp.Timestamp{Seconds: stub.now}, nil
+}
+
+func (stub *mockStub) GetSender() (string, error) {
+	return stub.sender, nil
+}
+
+func (stub *mockStub) SetEvent(name string, payload []byte) error {
+	stub.eventName, stub.event = name, payload
+	return nil
+}
+
+func (stub *mockStub) GetState(key string) ([]byte, error) {
+	return stub.state[key], nil
+}
+
+func (stub *mockStub) PutState(key string, value []byte) error {
+	delete(stub.deletes, key)
+	stub.writes[key] = value
+	return nil
+}
+
+func (stub *mockStub) DelState(key string) error {
+	delete(stub.writes, key)
+	stub.deletes[key] = true
+	return nil
+}
+
+func (stub *mockStub) Transfer(to string, balanceType string, amount *big.Int) error {
+	if amount.Sign() < 0 {
+		return errors.New("negative amount")
+	}
+	from := stub.sender
+	left := new(big.Int).Add(stub.balance(from), stub.pendingTransfer(from))
+	if left.Cmp(amount) < 0 {
+		return errors.New("insufficient balance")
+	}
+	stub.transfers[from] = new(big.Int).Sub(stub.pendingTransfer(from), amount)
+	stub.transfers[to] = new(big.Int).Add(stub.pendingTransfer(to), amount)
+	return nil
+}
+
+func (stub *mockStub) pendingTransfer(account string) *big.Int {
+	if amount, ok := stub.transfers[account]; ok {
+		return amount
+	}
+	return big.NewInt(0)
+}
+
+func (stub *mockStub) CreateCompositeKey(objectType string, attributes []string) (string, error) {
+	key := "\x00" + objectType + "\x00"
+	for _, attribute := range attributes {
+		key += attribute + "\x00"
+	}
+	return key, nil
+}
+
+func (stub *mockStub) SplitCompositeKey(compositeKey string) (string, []string, error) {
+	parts := strings.Split(strings.TrimPrefix(compositeKey, "\x00"), "\x00")
+	if len(parts) < 2 {
+		return "", nil, errors.New("not a composite key: " + compositeKey)
+	}
+	return parts[0], parts[1 : len(parts)-1], nil
+}
+
+func (stub *mockStub) GetStateByRange(startKey, endKey string) (shim.StateQueryIteratorInterface, error) {
+	return stub.scan(func(key string) bool {
+		return !strings.HasPrefix(key, "\x00") && key >= startKey && (endKey == "" || key < endKey)
+	}), nil
+}
+
+func (stub *mockStub) GetStateByPartialCompositeKey(objectType string, attributes []string) (shim.StateQueryIteratorInterface, error) {
+	prefix, _ := stub.CreateCompositeKey(objectType, attributes)
+	return stub.scan(func(key string) bool {
+		return strings.HasPrefix(key, prefix)
+	}), nil
+}
+
+func (stub *mockStub) scan(match func(key string) bool) *mockIterator {
+	var keys []string
+	for key := range stub.state {
+		if match(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	it := &mockIterator{}
+	for _, key := range keys {
+		it.kvs = append(it.kvs, &shim.KV{Key: key, Value: stub.state[key]})
+	}
+	return it
+}
+
+type mockIterator struct {
+	kvs []*shim.KV
+}
+
+func (it *mockIterator) HasNext() bool {
+	return len(it.kvs) > 0
+}
+
+func (it *mockIterator) Next() (*shim.KV, error) {
+	kv := it.kvs[0]
+	it.kvs = it.kvs[1:]
+	return kv, nil
+}
+
+func (it *mockIterator) Close() error {
+	return nil
+}
@@ -1,12 +1,19 @@
 package main
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"github.com/inklabsfoundation/inkchain/core/chaincode/shim"
 	pb "github.com/inklabsfoundation/inkchain/protos/peer"
 	"math"
 	"math/big"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -14,7 +21,7 @@ import (
 
 // Incentive-related const
 const (
-	IncentiveMashupInvoke = "10"
+	IncentiveMashupInvoke = "10" // default composition fee of a service
 	FeeBalanceType        = "TOKENS"
 	L                     = 2
 	R                     = 1
@@ -25,6 +32,40 @@ const (
 	S_Created   = "created"
 	S_Available = "available"
 	S_Invalid   = "invalid"
+	S_Retired   = "retired"  // withdrawn by its developer for good
+	S_Degraded  = "degraded" // a mashup whose components are not all available
+)
+
+// Definitions of a service's refund policy for unused call times
+const (
+	R_None     = "none"     // no refund
+	R_Full     = "full"     // full refund of the unused calls' fee
+	R_ProRated = "prorated" // refund of a percentage of the unused calls' fee
+	R_Windowed = "windowed" // full refund of the call times bought within a period before the refund
+)
+
+// Name of the event emitted when a status change propagates to dependent mashups
+const ServiceStatusEvent = "serviceStatus"
+
+// Definitions of a service's license, checked when the service is composed into a mashup
+const (
+	L_Proprietary = "proprietary" // can not be composed by other developers
+	L_Attribution = "attribution" // can only be composed into free mashups, crediting the developer
+	L_Commercial  = "commercial"  // can be composed into any mashup
+	L_Royalty     = "royalty"     // can only be composed into priced mashups
+)
+
+// Definitions of a service's visibility
+const (
+	V_Public    = "public"    // listed, anyone can call or compose it
+	V_Unlisted  = "unlisted"  // not listed, anyone knowing its name can call or compose it
+	V_AllowList = "allowlist" // not listed, only allow-listed users or organizations can call or compose it
+)
+
+// Kinds of allow-list entries
+const (
+	AllowUser         = "user"
+	AllowOrganization = "org"
 )
 
 // Prefixes for user and service separately
@@ -34,11 +75,92 @@ const (
 	ServiceCallTimesPrefix = "CALL_TIMES_"
 	BuyRecordPrefix        = "BUY_"
 	ReduceRecordPrefix     = "REDUCE_"
+	RefundRecordPrefix     = "REFUND_"
+	ResourcePrefix         = "RES_"
+	ServiceAliasPrefix     = "ALIAS_" // flat name of a migrated service -> its namespaced name
+
+	AdminAccountKey = "ADMIN_ACCOUNT" // account allowed to run migrations and appoint arbitrators
+)
+
+// Quota windows, in seconds
+const (
+	QuotaHour = 60 * 60
+	QuotaDay  = 24 * QuotaHour
+)
+
+// A mashup's component can be given as "service:N", N being how many times
+// one mashup call calls the component
+const MultiplicitySeparator = ":"
+
+// Mashups can compose other mashups, up to MaxMashupDepth levels
+const MaxMashupDepth = 8
+
+// A mashup's price can be given as "auto", it's then the cost of its components' calls
+const AutoPrice = "auto"
+
+// Bundle options of callService on a mashup, whose name the component call times are bought in
+const (
+	BundleDeveloper = "developer" // the mashup's developer
+	BundleBuyer     = "buyer"     // the buyer of the mashup's call times
+)
+
+// Operations of editMashup
+const (
+	EditAdd     = "add"     // add components, or more calls to existing ones
+	EditRemove  = "remove"  // remove components
+	EditReplace = "replace" // replace the whole composition
+)
+
+// Statuses of a call time transfer
+const (
+	T_Pending   = "pending"   // waiting for the developer's approval
+	T_Completed = "completed" // the call times are moved to the recipient
+	T_Rejected  = "rejected"  // the call times are given back to the sender
+	T_Expired   = "expired"   // the call times expired waiting for approval
+)
+
+// Statuses of a dispute
+const (
+	D_Open     = "open"     // waiting for an arbitrator
+	D_Upheld   = "upheld"   // the reduced call times are restored to the caller
+	D_Rejected = "rejected" // the reduction stands
 )
 
+// A caller can dispute a reduction within DisputeWindow seconds
+const DisputeWindow = 7 * QuotaDay
+
+// Statuses of a sell order
+const (
+	O_Open      = "open"      // call times are left for sale
+	O_Filled    = "filled"    // all the call times are sold
+	O_Cancelled = "cancelled" // the call times left are given back
+	O_Expired   = "expired"   // the call times left for sale expired
+)
+
+// Services are named "developer/service", so that every developer has their own namespace
+const NamespaceSeparator = "/"
+
 const (
-	UserServicesKey = "userServicesKey" //composite key for user service composite
-	CallTimeKey     = "callTimeKey"     //composite key for call time composite
+	UserServicesKey    = "userServicesKey"    //composite key for user service composite
+	CallTimeKey        = "callTimeKey"        //composite key for call time composite
+	BuyerResourceKey   = "buyerResourceKey"   //composite key for resources encrypted for a buyer
+	QuotaUsageKey      = "quotaUsageKey"      //composite key for a caller's usage of a service's quota
+	PayoutKey          = "payoutKey"          //composite key for payouts received by a user
+	DependencyKey      = "dependencyKey"      //composite key for the mashups that compose a service
+	MashupHistoryKey   = "mashupHistoryKey"   //composite key for the composition changes of a mashup
+	UserPurchaseKey    = "userPurchaseKey"    //composite key for the buy records of a user
+	ServicePurchaseKey = "servicePurchaseKey" //composite key for the buy records of a service
+	UserConsumeKey     = "userConsumeKey"     //composite key for the reduce records of a caller
+	ServiceConsumeKey  = "serviceConsumeKey"  //composite key for the reduce records of a service
+	RequestKey         = "requestKey"         //composite key for the client requests processed of a sender
+	ArbitratorKey      = "arbitratorKey"      //composite key for the users who resolve disputes
+	DisputeKey         = "disputeKey"         //composite key for the disputes of reduce records
+	RefundDueKey       = "refundDueKey"       //composite key for the refunds a user owes
+	TransferKey        = "transferKey"        //composite key for the call time transfers waiting for approval
+	TransferLogKey     = "transferLogKey"     //composite key for the call time transfers of a user
+	SellOrderKey       = "sellOrderKey"       //composite key for the orders selling call times of a service
+	ResaleTradeKey     = "resaleTradeKey"     //composite key for the call times resold of a service
+	UsageSettlementKey = "usageSettlementKey" //composite key for the usage receipts settled of a caller
 )
 
 // Invoke functions definition
@@ -52,18 +174,84 @@ const (
 	RegisterService     = "registerService"
 	InvalidateService   = "invalidateService" // mark whether the service is validated
 	PublishService      = "publishService"    // publish a created service
+	RetireService       = "retireService"     // withdraw a service for good
 	CreateMashup        = "createMashup"      // utilize services to create a new mashup
+	EditMashup          = "editMashup"        // add, remove or replace the services a mashup utilizes
+	ForkMashup          = "forkMashup"        // create a new mashup from the composition of an existing one
+	SetForkRoyalty      = "setForkRoyalty"    // set the share of forks' revenue paid to a mashup's developer
+	QueryMashupHistory  = "queryMashupHistory"
+	SetCompositionFee   = "setCompositionFee" // set the fee paid by mashups composing a service
+	QuoteMashup         = "quoteMashup"       // get the fees of composing services before creating a mashup
 	QueryService        = "queryService"
 	EditService         = "editService"
 	QueryServiceByUser  = "queryServiceByUser"
 	QueryServiceByRange = "queryServiceByRange"
 	CallService         = "callService"
 	ReduceCallTime      = "reduceCallTime"
+	ReduceCallTimes     = "reduceCallTimes"   // reduce the call times of many callers at once
+	QueryPurchases      = "queryPurchases"    // query the buy records by user, service and time
+	QueryConsumptions   = "queryConsumptions" // query the reduce records by caller, service and time
+	IndexHistory        = "indexHistory"      // index the buy and reduce records saved before they were indexed
+	MigrateTimes        = "migrateTimes"      // convert the times of records saved before to RFC 3339
 	GetCallTimes        = "getCallTimes"
 	GetCallTime         = "getCallTime"
+	SetServiceLicense   = "setServiceLicense"  // change the license of a service
+	MigrateServiceName  = "migrateServiceName" // move a service with a flat name into its developer's namespace
+	SetServiceQuota     = "setServiceQuota"    // limit how many calls a caller can consume per hour/day
+	GetQuota            = "getQuota"           // get a caller's remaining quota of a service
+	SetRevenueShare     = "setRevenueShare"    // share a mashup's payments with its components' developers
+	QueryDependents     = "queryDependents"    // query the mashups that compose a service
+	QueryMashupTree     = "queryMashupTree"    // query the transitive dependencies of a mashup
+	GetPayouts          = "getPayouts"         // get the payouts received by a user
+
+	// Service resource-related invoke
+	SetEncryptionKey   = "setEncryptionKey"   // publish the sender's key that resources are encrypted with
+	SetBuyerResource   = "setBuyerResource"   // store a service's resource encrypted for one buyer
+	GetServiceResource = "getServiceResource" // get a service's resource, for the developer and buyers only
+	MigrateResources   = "migrateResources"   // move the resources of services registered before out of their public records
+
+	// Service visibility-related invoke
+	SetServiceVisibility   = "setServiceVisibility"
+	AddServiceAllowList    = "addServiceAllowList"
+	RemoveServiceAllowList = "removeServiceAllowList"
 
 	// User-related reward invoke
 	RewardService = "rewardService"
+
+	// Refund-related invoke
+	SetRefundPolicy = "setRefundPolicy" // set how unused call times of a service are refunded
+	RequestRefund   = "requestRefund"   // get the fee of unused call times back
+	PayRefunds      = "payRefunds"      // pay the refunds the sender owes
+	QueryRefundDues = "queryRefundDues" // query the refunds a user owes
+
+	// Call time lot-related invoke
+	SetCallTimeValidity = "setCallTimeValidity" // set how long purchased call times of a service stay valid
+	ExpireCallTimes     = "expireCallTimes"     // remove the out-of-date call times
+
+	// Call time transfer-related invoke
+	SetTransferApproval     = "setTransferApproval"     // require the developer to approve transfers of a service's call times
+	TransferCallTimes       = "transferCallTimes"       // move call times of a service to another user
+	ApproveCallTimeTransfer = "approveCallTimeTransfer" // approve or reject a transfer waiting for approval
+	QueryCallTimeTransfers  = "queryCallTimeTransfers"  // query the call time transfers of a user
+
+	// Call time resale-related invoke
+	SetResaleRoyalty = "setResaleRoyalty" // set the percentage of resales paid to the developer
+	CreateSellOrder  = "createSellOrder"  // offer call times of a service for sale
+	CancelSellOrder  = "cancelSellOrder"  // withdraw the call times left of a sell order
+	BuyResale        = "buyResale"        // buy call times from the cheapest sell orders
+	QuerySellOrders  = "querySellOrders"  // query the open sell orders of a service
+
+	// Usage receipt-related invoke
+	SetUsageKey        = "setUsageKey"        // publish the sender's key that usage receipts are signed with
+	SettleUsage        = "settleUsage"        // reduce the calls of a caller by its latest signed usage receipt
+	GetUsageSettlement = "getUsageSettlement" // get the latest usage receipt settled of a caller
+
+	// Dispute-related invoke
+	AddArbitrator    = "addArbitrator"    // allow a user to resolve disputes
+	RemoveArbitrator = "removeArbitrator" // disallow a user to resolve disputes
+	OpenDispute      = "openDispute"      // contest a reduction of the sender's call times
+	ResolveDispute   = "resolveDispute"   // uphold or reject a dispute
+	QueryDisputes    = "queryDisputes"    // query the disputes of a service
 )
 
 // Chaincode for DSES (Decentralized Service Eco-System)
@@ -78,6 +266,15 @@ type user struct {
 	// There is a one-to-one correspondence between "Name" and "Address"
 	// The Address records the user's profit from creating valuable services or mashups.
 
+	// Organization the user belongs to, used by services' allow-lists
+	Organization string `json:"organization"`
+
+	// Public key published by the user, developers encrypt their services' resources with it
+	EncryptionKey string `json:"encryptionKey"`
+
+	// Public key the user signs usage receipts with, a hex encoded uncompressed P-256 point
+	UsageKey string `json:"usageKey"`
+
 	Contribution float64 `json:"contribution"`
 	// "Contribution" evaluates the user's contribution to the service ecosystem.
 	// TODO: add handler about "Contribution"
@@ -96,23 +293,81 @@ type service struct {
 	Type        string   `json:"type"`
 	Developer   string   `json:"developer"` // record the user that developed this service
 	Description string   `json:"description"`
-	Resource    string   `json:"resource"` //service address
+	Resource    string   `json:"resource"` //service address encrypted by the developer, only stored under ResourcePrefix
 	Price       *big.Int `json:"price"`
 
+	// PlainResource marks a resource stored unencrypted, by a developer without an encryption key
+	// or before resources were encrypted. Buyers get it as it is instead of a copy encrypted for them.
+	PlainResource bool `json:"plainResource,omitempty"`
+
+	// License restricts how the service can be composed into mashups:
+	// proprietary/attribution/commercial/royalty
+	License string `json:"license"`
+
+	// Fee paid to the developer for every call a mashup makes to the service per mashup call,
+	// IncentiveMashupInvoke FeeBalanceType when not set
+	CompositionFee     *big.Int `json:"compositionFee,omitempty"`
+	CompositionFeeType string   `json:"compositionFeeType,omitempty"`
+
+	// RefundPolicy defines how unused call times are refunded: none/full/prorated/windowed,
+	// RefundPercent is the percentage refunded by "prorated",
+	// RefundWindow the seconds after a purchase "windowed" refunds its call times within.
+	RefundPolicy  string `json:"refundPolicy"`
+	RefundPercent int64  `json:"refundPercent"`
+	RefundWindow  int64  `json:"refundWindow"`
+
+	// ValidityPeriod is the seconds purchased call times stay valid, 0 means they never expire
+	ValidityPeriod int64 `json:"validityPeriod"`
+
+	// TransferApproval requires the developer to approve every transfer of the service's call times
+	TransferApproval bool `json:"transferApproval"`
+
+	// ResaleRoyalty is the percentage of every resale of the service's call times paid to the developer
+	ResaleRoyalty int64 `json:"resaleRoyalty"`
+
+	// Per-caller quotas enforced by reduceCallTime, 0 means unlimited
+	QuotaPerHour int64 `json:"quotaPerHour"`
+	QuotaPerDay  int64 `json:"quotaPerDay"`
+
+	// Visibility records who can find and use the service:
+	// public/unlisted/allowlist
+	// AllowUsers and AllowOrgs are only checked when the visibility is "allowlist".
+	Visibility string   `json:"visibility"`
+	AllowUsers []string `json:"allowUsers"`
+	AllowOrgs  []string `json:"allowOrgs"`
+
 	CreatedTime string `json:"createdTime"`
 	UpdatedTime string `json:"updatedTime"`
 
 	// Status records the status of a service:
-	// created/available/invalid
+	// created/available/invalid/retired, or degraded for a mashup
+	// whose components are not all available
 	Status string `json:"status"`
 
 	// Whether the service is a mashup or not.
 	IsMashup bool `json:"isMashup"`
 
-	// if the service is a mashup, "Composited" records the services that it invokes;
-	// if the service is not a mashup, "Composited" records the co-occurrence documents of the service
+	// if the service is a mashup, "Composited" records the services that it invokes,
+	// and how many times one mashup call invokes each of them;
+	// if the service is not a mashup, "Composited" records the co-occurrence documents of the service,
+	// i.e. how many mashups compose it together with each other service
 	Composition map[string]int `json:"composition"`
 
+	// For a mashup, ComponentCost is the price of the component calls made by one mashup call,
+	// at the time the mashup was composed
+	ComponentCost *big.Int `json:"componentCost,omitempty"`
+
+	// For a mashup, ComponentShare is the percentage of every payment shared with its
+	// components' developers, split by the components' weights in RevenueShare.
+	// A component without weight in RevenueShare is weighted by its count in Composition.
+	ComponentShare int64            `json:"componentShare"`
+	RevenueShare   map[string]int64 `json:"revenueShare"`
+
+	// For a mashup, ForkRoyalty is the percentage of every payment for its forks paid to its developer.
+	// A fork records the mashup it was forked from, and the royalty it pays as set at the time of the fork.
+	ForkRoyalty int64  `json:"forkRoyalty"`
+	ForkedFrom  string `json:"forkedFrom,omitempty"`
+
 	// Benefit of "Composited":
 	// 1. Automatically create service co-occurrence documents and store it into the ledger
 	// 2. Promote the security and integrality of service data
@@ -126,18 +381,204 @@ type serviceCallTime struct {
 	UserAddress string   `json:"user_address"` // user address
 	CallTimes   *big.Int `json:"call_times"`   // call times
 	Total       *big.Int `json:"total"`        // total fee
+	Paid        *big.Int `json:"paid"`         // fee paid for the call times left
+	BoughtAt    int64    `json:"bought_at"`    // unix time of the last purchase
+
+	// Lots are the call times left of every purchase, CallTimes and Paid add them up
+	Lots []callTimeLot `json:"lots,omitempty"`
 
 	CreateTime string `json:"create_time"` //create time
 	UpdateTime string `json:"update_time"` //last reduce time
 }
 
+// callTimeLot records the call times bought by one purchase and the fee paid for them
+type callTimeLot struct {
+	TxID      string   `json:"tx_id"`      // purchase transaction
+	CallTimes *big.Int `json:"call_times"` // call times left
+	Paid      *big.Int `json:"paid"`       // fee paid for the call times left
+	BoughtAt  int64    `json:"bought_at"`  // unix time of the purchase
+	ExpiresAt int64    `json:"expires_at"` // unix time the call times expire, 0 if never
+
+	// Terms split the lot's fee as they were when it was bought, nil for lots bought before they were recorded
+	Terms *revenueTerms `json:"terms,omitempty"`
+}
+
+// revenueTerms records how the payments for a service are split: the royalty paid to the developer
+// of the mashup a fork was forked from, and the percentage of a mashup's payments shared with its
+// components' developers by weight.
+type revenueTerms struct {
+	ForkDeveloper  string           `json:"fork_developer,omitempty"`
+	ForkRoyalty    int64            `json:"fork_royalty,omitempty"`
+	ComponentShare int64            `json:"component_share,omitempty"`
+	Weights        map[string]int64 `json:"weights,omitempty"` // weight of every component developer
+}
+
+// callTimeTransfer records call times moved from one user to another
+type callTimeTransfer struct {
+	ID          string        `json:"id"` // transaction the transfer is requested in
+	ServiceName string        `json:"service_name"`
+	From        string        `json:"from"`
+	To          string        `json:"to"`
+	CallTimes   *big.Int      `json:"call_times"`
+	Paid        *big.Int      `json:"paid"` // fee paid for the call times moved
+	Lots        []callTimeLot `json:"lots"`
+	Status      string        `json:"status"`
+	CreateTime  string        `json:"create_time"`
+	UpdateTime  string        `json:"update_time"`
+}
+
+// sellOrder offers call times of a service for sale at a price per call,
+// the call times are taken out of the seller's until sold or cancelled
+type sellOrder struct {
+	ID          string        `json:"id"` // transaction the order is created in
+	ServiceName string        `json:"service_name"`
+	Seller      string        `json:"seller"`
+	CallTimes   *big.Int      `json:"call_times"` // call times left for sale
+	UnitPrice   *big.Int      `json:"unit_price"`
+	Lots        []callTimeLot `json:"lots"`
+	Status      string        `json:"status"`
+	CreateTime  string        `json:"create_time"`
+	UpdateTime  string        `json:"update_time"`
+}
+
+// resaleTrade records call times bought from a sell order
+type resaleTrade struct {
+	OrderID     string   `json:"order_id"`
+	ServiceName string   `json:"service_name"`
+	Seller      string   `json:"seller"`
+	Buyer       string   `json:"buyer"`
+	CallTimes   *big.Int `json:"call_times"`
+	UnitPrice   *big.Int `json:"unit_price"`
+	Total       *big.Int `json:"total"`   // paid by the buyer
+	Royalty     *big.Int `json:"royalty"` // part of the total paid to the developer
+	CreateTime  string   `json:"create_time"`
+}
+
+// usageSettlement records the latest usage receipt of a caller settled by the developer,
+// a receipt counts the calls made since the first one
+type usageSettlement struct {
+	ServiceName string   `json:"service_name"`
+	UserName    string   `json:"user_name"`
+	Cumulative  *big.Int `json:"cumulative"` // calls counted by the receipt
+	Nonce       uint64   `json:"nonce"`
+	UpdateTime  string   `json:"update_time"`
+}
+
+// ecdsaSignature is the ASN.1 structure of an ECDSA signature
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// expiredCallTimes records the call times of a user expired by expireCallTimes
+type expiredCallTimes struct {
+	ServiceName string   `json:"service_name"`
+	UserName    string   `json:"user_name"`
+	CallTimes   *big.Int `json:"call_times"` // call times expired
+	Paid        *big.Int `json:"paid"`       // fee paid for them
+}
+
+// quotaUsage records how many calls a caller consumed in the current hour and day windows
+type quotaUsage struct {
+	ServiceName string `json:"service_name"`
+	UserName    string `json:"user_name"`
+	HourStart   int64  `json:"hour_start"` // unix time the hour window starts
+	HourCalls   int64  `json:"hour_calls"`
+	DayStart    int64  `json:"day_start"` // unix time the day window starts
+	DayCalls    int64  `json:"day_calls"`
+}
+
+// quotaStatus is returned by getQuota
+type quotaStatus struct {
+	ServiceName   string `json:"service_name"`
+	UserName      string `json:"user_name"`
+	QuotaPerHour  int64  `json:"quota_per_hour"`
+	QuotaPerDay   int64  `json:"quota_per_day"`
+	UsedThisHour  int64  `json:"used_this_hour"`
+	UsedToday     int64  `json:"used_today"`
+	RemainingHour int64  `json:"remaining_hour"` // -1 means unlimited
+	RemainingDay  int64  `json:"remaining_day"`  // -1 means unlimited
+}
+
+// payoutRecord records the part of a payment for a service that was paid to a user
+type payoutRecord struct {
+	ServiceName string   `json:"service_name"`
+	Payer       string   `json:"payer"`
+	Recipient   string   `json:"recipient"`
+	Amount      *big.Int `json:"amount"`
+	CreateTime  string   `json:"create_time"`
+}
+
+// dependency records that a mashup calls a service "Multiplicity" times per call
+type dependency struct {
+	ServiceName  string `json:"service_name"`
+	MashupName   string `json:"mashup_name"`
+	Multiplicity int    `json:"multiplicity"`
+}
+
+// mashupNode is a service in a mashup's resolved dependency tree
+type mashupNode struct {
+	Name         string        `json:"name"`
+	Developer    string        `json:"developer"`
+	Status       string        `json:"status"`
+	IsMashup     bool          `json:"isMashup"`
+	Multiplicity int           `json:"multiplicity"` // calls per call of the parent
+	TotalCalls   int           `json:"totalCalls"`   // calls per call of the root
+	Children     []*mashupNode `json:"children,omitempty"`
+}
+
+// mashupTree is returned by queryMashupTree
+type mashupTree struct {
+	Root *mashupNode `json:"root"`
+	// Services records every service in the tree, with its calls per call of the root
+	Services map[string]int `json:"services"`
+	Depth    int            `json:"depth"`
+}
+
+// statusEvent is the payload of ServiceStatusEvent
+type statusEvent struct {
+	ServiceName string   `json:"service_name"`
+	Status      string   `json:"status"`
+	Degraded    []string `json:"degraded"` // mashups degraded by the change
+	Restored    []string `json:"restored"` // mashups available again after the change
+}
+
+// compositionChange records a change made by editMashup to a mashup's composition
+type compositionChange struct {
+	MashupName string         `json:"mashup_name"`
+	Operation  string         `json:"operation"`
+	Old        map[string]int `json:"old"`
+	New        map[string]int `json:"new"`
+	Added      []string       `json:"added"`
+	Removed    []string       `json:"removed"`
+	UpdateTime string         `json:"update_time"`
+}
+
+// compositionFee is the fee a mashup pays for composing one service
+type compositionFee struct {
+	ServiceName string   `json:"service_name"`
+	Developer   string   `json:"developer"`
+	FeeType     string   `json:"fee_type"`
+	Fee         *big.Int `json:"fee"`   // fee per call
+	Calls       int      `json:"calls"` // calls per mashup call
+	Amount      *big.Int `json:"amount"`
+}
+
+// mashupQuote is returned by quoteMashup
+type mashupQuote struct {
+	Fees          []compositionFee    `json:"fees"`
+	Total         map[string]*big.Int `json:"total"` // total fees by token type
+	ComponentCost *big.Int            `json:"component_cost"`
+}
+
 type buyRecord struct {
 	ServiceCallTimeKey string   `json:"service_call_time_key"`
 	ServiceName        string   `json:"service_name"`
 	UserName           string   `json:"user_name"`
+	TxID               string   `json:"tx_id,omitempty"` // purchase transaction
 	CallTime           *big.Int `json:"call_time"`
 	Total              *big.Int `json:"total"`
 	CreateTime         string   `json:"create_time"`
+	Resale             bool     `json:"resale,omitempty"` // bought from other users
 }
 
 type reduceRecord struct {
@@ -146,6 +587,79 @@ type reduceRecord struct {
 	UserName           string   `json:"user_name"`
 	ReduceTime         *big.Int `json:"reduce_time"`
 	CreateTime         string   `json:"create_time"`
+	Paid               *big.Int `json:"paid"`               // fee paid for the reduced calls
+	Caller             string   `json:"caller"`             // user whose call times are reduced
+	TxID               string   `json:"tx_id"`              // transaction of the reduction
+	Reversed           bool     `json:"reversed,omitempty"` // restored to the caller by a dispute
+}
+
+// dispute records a caller contesting a reduce record
+type dispute struct {
+	ID            string   `json:"id"` // transaction the dispute is opened in
+	ServiceName   string   `json:"service_name"`
+	Caller        string   `json:"caller"`
+	Developer     string   `json:"developer"`
+	ReduceKey     string   `json:"reduce_key"`
+	ReduceSeconds int64    `json:"reduce_seconds"` // unix time of the reduction
+	CallTimes     *big.Int `json:"call_times"`     // call times reduced
+	Paid          *big.Int `json:"paid"`           // fee paid for them
+	Reason        string   `json:"reason"`
+	Status        string   `json:"status"`
+	Arbitrator    string   `json:"arbitrator"`
+	Ruling        string   `json:"ruling"`
+	CreateTime    string   `json:"create_time"`
+	UpdateTime    string   `json:"update_time"`
+}
+
+// historyPage is a page of buy or reduce records, Bookmark is given to get the next page,
+// it is empty on the last page
+type historyPage struct {
+	Records  []json.RawMessage `json:"records"`
+	Bookmark string            `json:"bookmark"`
+}
+
+// reduceEntry is an entry of reduceCallTimes
+type reduceEntry struct {
+	ServiceName string   `json:"service"`
+	Caller      string   `json:"caller"`
+	Count       *big.Int `json:"count"`
+}
+
+// processedRequest records the result of a client request, so that a retry
+// of the request gets the result instead of processing it again
+type processedRequest struct {
+	Function   string          `json:"function"`
+	Args       []string        `json:"args"`
+	Result     json.RawMessage `json:"result"`
+	CreateTime string          `json:"create_time"`
+}
+
+type refundRecord struct {
+	ServiceName        string   `json:"service_name"`
+	ServiceCallTimeKey string   `json:"service_call_time_key"`
+	UserName           string   `json:"user_name"`
+	TxID               string   `json:"tx_id"` // transaction of the refund
+	CallTime           *big.Int `json:"call_time"`
+	Refund             *big.Int `json:"refund"`    // fee refunded to the user
+	Forfeited          *big.Int `json:"forfeited"` // fee kept by the users it was paid to
+	Policy             string   `json:"policy"`
+	CreateTime         string   `json:"create_time"`
+
+	// Due is the part of the refund owed by every user the fee was paid to, see refundDue
+	Due map[string]*big.Int `json:"due,omitempty"`
+}
+
+// refundDue records a refund a user owes to a buyer. The fee of call times is paid
+// to the developers at purchase and the chaincode holds no funds, so a refund is
+// owed by the users the fee was paid to. It is paid out of the next payments to
+// them for call times (see transferToUsers), or by the user with payRefunds.
+type refundDue struct {
+	ID         string   `json:"id"` // transaction of the refund
+	Debtor     string   `json:"debtor"`
+	Buyer      string   `json:"buyer"`
+	Amount     *big.Int `json:"amount"` // left to pay
+	CreateTime string   `json:"create_time"`
+	UpdateTime string   `json:"update_time"`
 }
 
 // ===================================================================================
@@ -160,8 +674,33 @@ func main() {
 
 // Init initializes chaincode
 // ==================================================================================
+// The account instantiating the chaincode administers it, unless another
+// account is given as args[0]. It's kept on upgrade.
+// ==================================================================================
 func (t *serviceChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 	fmt.Println("assetChaincode Init.")
+	_, args := stub.GetFunctionAndParameters()
+
+	accountAsBytes, err := stub.GetState(AdminAccountKey)
+	if err != nil {
+		return shim.Error("Fail to get the admin account: " + err.Error())
+	} else if accountAsBytes != nil {
+		return shim.Success([]byte("Init success."))
+	}
+	account := ""
+	if len(args) > 0 {
+		account = strings.TrimSpace(args[0])
+	}
+	if len(account) == 0 {
+		account, err = stub.GetSender()
+		if err != nil {
+			return shim.Error("Fail to get the sender's address.")
+		}
+	}
+	err = stub.PutState(AdminAccountKey, []byte(account))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 	return shim.Success([]byte("Init success."))
 }
 
@@ -175,10 +714,12 @@ func (t *serviceChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response
 	// ********************************************************
 	// PART 1: User-related invokes
 	case RegisterUser:
-		if len(args) != 2 {
-			return shim.Error("Incorrect number of arguments. Expecting 2.")
+		if len(args) != 2 && len(args) != 3 {
+			return shim.Error("Incorrect number of arguments. Expecting 2 or 3.")
 		}
 		// args[0]: user name
+		// args[1]: user introduction
+		// args[2]: user organization (optional)
 		return t.registerUser(stub, args)
 
 	case RemoveUser:
@@ -198,15 +739,16 @@ func (t *serviceChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response
 	// ********************************************************
 	// PART 2: service-related invokes
 	case RegisterService:
-		if len(args) != 6 {
-			return shim.Error("Incorrect number of arguments. Expecting 5.")
+		if len(args) != 6 && len(args) != 7 {
+			return shim.Error("Incorrect number of arguments. Expecting 6 or 7.")
 		}
 		// args[0]: service name
 		// args[1]: service type
 		// args[2]: service description
 		// args[3]: developer's name
-		// args[4]: service path
+		// args[4]: service path, encrypted with the developer's encryption key, or plain if they have none
 		// args[5]: service price
+		// args[6]: service license (optional, commercial by default)
 		return t.registerService(stub, args)
 
 	case InvalidateService:
@@ -216,6 +758,13 @@ func (t *serviceChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response
 		// args[0]: service name
 		return t.invalidateService(stub, args)
 
+	case RetireService:
+		if len(args) != 1 {
+			return shim.Error("Incorrect number of arguments. Expecting 1.")
+		}
+		// args[0]: service name
+		return t.retireService(stub, args)
+
 	case PublishService:
 		if len(args) != 1 {
 			return shim.Error("Incorrect number of arguments. Expecting 1.")
@@ -237,20 +786,184 @@ func (t *serviceChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response
 		// args[0]: service name
 		// args[1]: service type
 		// args[2]: service description
-		// args[3]: service path
+		// args[3]: service path, encrypted with the developer's encryption key, or plain if they have none
 		// args[4]: service price
 		return t.editService(stub, args)
 
 	case CreateMashup:
-		if len(args) < 5 {
-			return shim.Error("Incorrect number of arguments. Expecting 5 at least.")
+		if len(args) < 7 {
+			return shim.Error("Incorrect number of arguments. Expecting 7 at least.")
 		}
 		// args[0]: mashup name
 		// args[1]: mashup type
 		// args[2]: mashup description
-		// args[3]: mashup price
-		// args[4...]: invoked service list
-		return t.createMashup(stub, args)
+		// args[3]: developer's name
+		// args[4]: mashup price, or "auto"
+		// args[5]: mashup license
+		// args[6...]: invoked service list, as "service" or "service:N"
+		return t.createMashup(stub, args, nil)
+
+	case ForkMashup:
+		if len(args) != 7 {
+			return shim.Error("Incorrect number of arguments. Expecting 7.")
+		}
+		// args[0]: original mashup name
+		// args[1]: new mashup name
+		// args[2]: mashup type
+		// args[3]: mashup description
+		// args[4]: developer's name
+		// args[5]: mashup price, or "auto"
+		// args[6]: mashup license
+		return t.forkMashup(stub, args)
+
+	case SetForkRoyalty:
+		if len(args) != 2 {
+			return shim.Error("Incorrect number of arguments. Expecting 2.")
+		}
+		// args[0]: mashup name
+		// args[1]: percentage of forks' payments paid to the mashup's developer
+		return t.setForkRoyalty(stub, args)
+
+	case SetServiceLicense:
+		if len(args) != 2 {
+			return shim.Error("Incorrect number of arguments. Expecting 2.")
+		}
+		// args[0]: service name
+		// args[1]: service license
+		return t.setServiceLicense(stub, args)
+
+	case MigrateServiceName:
+		if len(args) != 1 {
+			return shim.Error("Incorrect number of arguments. Expecting 1.")
+		}
+		// args[0]: flat service name
+		return t.migrateServiceName(stub, args)
+
+	case SetServiceQuota:
+		if len(args) != 3 {
+			return shim.Error("Incorrect number of arguments. Expecting 3.")
+		}
+		// args[0]: service name
+		// args[1]: calls per hour per caller, 0 for unlimited
+		// args[2]: calls per day per caller, 0 for unlimited
+		return t.setServiceQuota(stub, args)
+
+	case GetQuota:
+		if len(args) != 2 {
+			return shim.Error("Incorrect number of arguments. Expecting 2.")
+		}
+		// args[0]: service name
+		// args[1]: caller name
+		return t.getQuota(stub, args)
+
+	case SetRevenueShare:
+		if len(args) < 2 {
+			return shim.Error("Incorrect number of arguments. Expecting 2 at least.")
+		}
+		// args[0]: mashup name
+		// args[1]: percentage of payments shared with the components' developers
+		// args[2...]: component weights, as "component=weight"
+		return t.setRevenueShare(stub, args)
+
+	case GetPayouts:
+		if len(args) != 1 && len(args) != 2 {
+			return shim.Error("Incorrect number of arguments. Expecting 1 or 2.")
+		}
+		// args[0]: recipient's name
+		// args[1]: service name (optional)
+		return t.getPayouts(stub, args)
+
+	case QueryDependents:
+		if len(args) != 1 {
+			return shim.Error("Incorrect number of arguments. Expecting 1.")
+		}
+		// args[0]: service name
+		return t.queryDependents(stub, args)
+
+	case QueryMashupTree:
+		if len(args) != 1 {
+			return shim.Error("Incorrect number of arguments. Expecting 1.")
+		}
+		// args[0]: mashup name
+		return t.queryMashupTree(stub, args)
+
+	case SetServiceVisibility:
+		if len(args) != 2 {
+			return shim.Error("Incorrect number of arguments. Expecting 2.")
+		}
+		// args[0]: service name
+		// args[1]: service visibility
+		return t.setServiceVisibility(stub, args)
+
+	case AddServiceAllowList, RemoveServiceAllowList:
+		if len(args) < 3 {
+			return shim.Error("Incorrect number of arguments. Expecting 3 at least.")
+		}
+		// args[0]: service name
+		// args[1]: entry kind, "user" or "org"
+		// args[2...]: user or organization names
+		return t.updateServiceAllowList(stub, args, function == AddServiceAllowList)
+
+	case SetEncryptionKey:
+		if len(args) != 1 {
+			return shim.Error("Incorrect number of arguments. Expecting 1.")
+		}
+		// args[0]: public key
+		return t.setEncryptionKey(stub, args)
+
+	case SetBuyerResource:
+		if len(args) != 3 {
+			return shim.Error("Incorrect number of arguments. Expecting 3.")
+		}
+		// args[0]: service name
+		// args[1]: buyer's name
+		// args[2]: resource encrypted with the buyer's key
+		return t.setBuyerResource(stub, args)
+
+	case GetServiceResource:
+		if len(args) != 1 {
+			return shim.Error("Incorrect number of arguments. Expecting 1.")
+		}
+		// args[0]: service name
+		return t.getServiceResource(stub, args)
+
+	case MigrateResources:
+		if len(args) != 0 {
+			return shim.Error("Incorrect number of arguments. Expecting 0.")
+		}
+		return t.migrateResources(stub, args)
+
+	case EditMashup:
+		if len(args) < 3 {
+			return shim.Error("Incorrect number of arguments. Expecting 3 at least.")
+		}
+		// args[0]: mashup name
+		// args[1]: operation, "add", "remove" or "replace"
+		// args[2...]: invoked service list, as "service" or "service:N"
+		return t.editMashup(stub, args)
+
+	case QueryMashupHistory:
+		if len(args) != 1 {
+			return shim.Error("Incorrect number of arguments. Expecting 1.")
+		}
+		// args[0]: mashup name
+		return t.queryMashupHistory(stub, args)
+
+	case SetCompositionFee:
+		if len(args) != 2 && len(args) != 3 {
+			return shim.Error("Incorrect number of arguments. Expecting 2 or 3.")
+		}
+		// args[0]: service name
+		// args[1]: fee per call, 0 for free
+		// args[2]: fee token type (optional, TOKENS by default)
+		return t.setCompositionFee(stub, args)
+
+	case QuoteMashup:
+		if len(args) < 1 {
+			return shim.Error("Incorrect number of arguments. Expecting 1 at least.")
+		}
+		// args[0...]: invoked service list, as "service" or "service:N"
+		return t.quoteMashup(stub, args)
 
 	case QueryServiceByRange:
 		if len(args) != 2 {
@@ -279,11 +992,15 @@ func (t *serviceChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response
 		return t.queryServiceByUser(stub, args)
 
 	case CallService:
-		if len(args) != 2 {
-			return shim.Error("Incorrect number of arguments. Expecting 2.")
+		if len(args) < 2 || len(args) > 4 {
+			return shim.Error("Incorrect number of arguments. Expecting 2 to 4.")
 		}
 		// args[0]: service name
 		// args[1]: call times
+		// args[2]: for a mashup, also buy the call times of the services it composes down to
+		//          the leaves, in the name of the "developer" or the "buyer"; the mashup
+		//          is then charged its price less its components' cost (optional)
+		// args[3]: client request id, a retry with the same id is not bought again (optional)
 		return t.callService(stub, args)
 
 	case GetCallTime:
@@ -301,56 +1018,293 @@ func (t *serviceChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response
 		return t.getCallTimes(stub, args)
 
 	case ReduceCallTime:
-		if len(args) != 3 {
-			return shim.Error("Incorrect number of arguments. Expecting 3.")
+		if len(args) != 3 && len(args) != 4 {
+			return shim.Error("Incorrect number of arguments. Expecting 3 or 4.")
 		}
 		//args[0]: service name
 		//args[1]: caller name
 		//args[2]: reduce times
+		//args[3]: client request id, a retry with the same id is not reduced again (optional)
 		return t.reduceCallTime(stub, args)
-	}
 
-	return shim.Error("Invalid invoke function.")
-}
+	case ReduceCallTimes:
+		if len(args) != 1 && len(args) != 2 {
+			return shim.Error("Incorrect number of arguments. Expecting 1 or 2.")
+		}
+		//args[0]: JSON list of {"service", "caller", "count"}
+		//args[1]: client request id, a retry with the same id is not reduced again (optional)
+		return t.reduceCallTimes(stub, args)
 
-// Invoke func about user
-// ==================================================================================
+	case QueryPurchases, QueryConsumptions:
+		if len(args) < 2 || len(args) > 6 {
+			return shim.Error("Incorrect number of arguments. Expecting 2 to 6.")
+		}
+		//args[0]: user name, "" for all users
+		//args[1]: service name, "" for all services, one of user and service is required
+		//args[2]: from unix time (optional)
+		//args[3]: to unix time (optional)
+		//args[4]: page size (optional, 100 by default)
+		//args[5]: bookmark returned by the previous page (optional)
+		if function == QueryPurchases {
+			return t.queryHistory(stub, args, UserPurchaseKey, ServicePurchaseKey)
+		}
+		return t.queryHistory(stub, args, UserConsumeKey, ServiceConsumeKey)
 
-// ==================================
-// registerUser: Register a new user
-// ==================================
-func (t *serviceChaincode) registerUser(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	var new_name string
-	var new_intro string
-	var new_add string
-	var err error
+	case IndexHistory:
+		if len(args) != 0 {
+			return shim.Error("Incorrect number of arguments. Expecting 0.")
+		}
+		return t.indexHistory(stub, args)
 
-	new_name = args[0]
-	new_intro = args[1]
+	case MigrateTimes:
+		//args[0...]: key prefixes or composite key types of the records to migrate, all if none
+		return t.migrateTimes(stub, args)
 
-	// Get the user's address automatically through INKchian's GetSender() interface
-	new_add, err = stub.GetSender()
-	if err != nil {
-		return shim.Error("Fail to get the sender's address.")
-	}
+	// ********************************************************
+	// PART 4: refund-related invokes
+	case SetRefundPolicy:
+		if len(args) != 2 && len(args) != 3 {
+			return shim.Error("Incorrect number of arguments. Expecting 2 or 3.")
+		}
+		//args[0]: service name
+		//args[1]: refund policy, "none", "full", "prorated" or "windowed"
+		//args[2]: refunded percentage for "prorated", window in seconds for "windowed"
+		return t.setRefundPolicy(stub, args)
 
-	// check if user exists
-	user_key := UserPrefix + new_name
-	userAsBytes, err := stub.GetState(user_key)
-	if err != nil {
-		return shim.Error("Fail to get user: " + err.Error())
-	} else if userAsBytes != nil {
-		return shim.Error("This user already exists: " + new_name)
-	}
-	userAddressAsBytes, err := stub.GetState(UserPrefix + new_add)
-	if err != nil {
-		return shim.Error("Fail to get user by address: " + err.Error())
-	} else if userAddressAsBytes != nil {
-		return shim.Error("This address already registered")
-	}
+	case RequestRefund:
+		if len(args) < 1 || len(args) > 3 {
+			return shim.Error("Incorrect number of arguments. Expecting 1 to 3.")
+		}
+		//args[0]: service name
+		//args[1]: call times to refund (optional, all call times left by default)
+		//args[2]: buyer's name, when the developer refunds a buyer (optional)
+		return t.requestRefund(stub, args)
+
+	case PayRefunds:
+		if len(args) > 1 {
+			return shim.Error("Incorrect number of arguments. Expecting 0 or 1.")
+		}
+		//args[0]: most to pay (optional, all the refunds owed by default)
+		return t.payRefunds(stub, args)
+
+	case QueryRefundDues:
+		if len(args) != 1 {
+			return shim.Error("Incorrect number of arguments. Expecting 1.")
+		}
+		//args[0]: user name
+		return t.queryRefundDues(stub, args)
+
+	// ********************************************************
+	// PART 5: call time lot-related invokes
+	case SetCallTimeValidity:
+		if len(args) != 2 {
+			return shim.Error("Incorrect number of arguments. Expecting 2.")
+		}
+		//args[0]: service name
+		//args[1]: seconds the call times bought stay valid, 0 for never expire
+		return t.setCallTimeValidity(stub, args)
+
+	case ExpireCallTimes:
+		if len(args) != 1 && len(args) != 2 {
+			return shim.Error("Incorrect number of arguments. Expecting 1 or 2.")
+		}
+		//args[0]: service name
+		//args[1]: user name (optional, all users by default)
+		return t.expireCallTimes(stub, args)
+
+	// ********************************************************
+	// PART 6: call time transfer-related invokes
+	case SetTransferApproval:
+		if len(args) != 2 {
+			return shim.Error("Incorrect number of arguments. Expecting 2.")
+		}
+		//args[0]: service name
+		//args[1]: "true" to require approval, "false" otherwise
+		return t.setTransferApproval(stub, args)
+
+	case TransferCallTimes:
+		if len(args) != 3 {
+			return shim.Error("Incorrect number of arguments. Expecting 3.")
+		}
+		//args[0]: service name
+		//args[1]: recipient's user name
+		//args[2]: call times to transfer
+		return t.transferCallTimes(stub, args)
+
+	case ApproveCallTimeTransfer:
+		if len(args) != 3 {
+			return shim.Error("Incorrect number of arguments. Expecting 3.")
+		}
+		//args[0]: service name
+		//args[1]: transfer id
+		//args[2]: "true" to approve, "false" to reject
+		return t.approveCallTimeTransfer(stub, args)
+
+	case QueryCallTimeTransfers:
+		if len(args) != 1 && len(args) != 2 {
+			return shim.Error("Incorrect number of arguments. Expecting 1 or 2.")
+		}
+		//args[0]: user name
+		//args[1]: service name (optional)
+		return t.queryCallTimeTransfers(stub, args)
+
+	// ********************************************************
+	// PART 7: call time resale-related invokes
+	case SetResaleRoyalty:
+		if len(args) != 2 {
+			return shim.Error("Incorrect number of arguments. Expecting 2.")
+		}
+		//args[0]: service name
+		//args[1]: percentage of every resale paid to the developer
+		return t.setResaleRoyalty(stub, args)
+
+	case CreateSellOrder:
+		if len(args) != 3 {
+			return shim.Error("Incorrect number of arguments. Expecting 3.")
+		}
+		//args[0]: service name
+		//args[1]: call times to sell
+		//args[2]: price per call
+		return t.createSellOrder(stub, args)
+
+	case CancelSellOrder:
+		if len(args) != 2 {
+			return shim.Error("Incorrect number of arguments. Expecting 2.")
+		}
+		//args[0]: service name
+		//args[1]: order id
+		return t.cancelSellOrder(stub, args)
+
+	case BuyResale:
+		if len(args) != 3 {
+			return shim.Error("Incorrect number of arguments. Expecting 3.")
+		}
+		//args[0]: service name
+		//args[1]: call times to buy
+		//args[2]: highest price per call to pay
+		return t.buyResale(stub, args)
+
+	case QuerySellOrders:
+		if len(args) != 1 {
+			return shim.Error("Incorrect number of arguments. Expecting 1.")
+		}
+		//args[0]: service name
+		return t.querySellOrders(stub, args)
+
+	// ********************************************************
+	// PART 8: usage receipt-related invokes
+	case SetUsageKey:
+		if len(args) != 1 {
+			return shim.Error("Incorrect number of arguments. Expecting 1.")
+		}
+		//args[0]: hex encoded uncompressed P-256 public key
+		return t.setUsageKey(stub, args)
+
+	case SettleUsage:
+		if len(args) != 5 {
+			return shim.Error("Incorrect number of arguments. Expecting 5.")
+		}
+		//args[0]: service name
+		//args[1]: caller name
+		//args[2]: cumulative calls counted by the receipt
+		//args[3]: nonce of the receipt
+		//args[4]: hex encoded signature of the receipt by the caller
+		return t.settleUsage(stub, args)
+
+	case GetUsageSettlement:
+		if len(args) != 2 {
+			return shim.Error("Incorrect number of arguments. Expecting 2.")
+		}
+		//args[0]: service name
+		//args[1]: caller name
+		return t.getUsageSettlement(stub, args)
+
+	// ********************************************************
+	// PART 9: dispute-related invokes
+	case AddArbitrator, RemoveArbitrator:
+		if len(args) != 1 {
+			return shim.Error("Incorrect number of arguments. Expecting 1.")
+		}
+		//args[0]: user name
+		return t.setArbitrator(stub, args, function == AddArbitrator)
+
+	case OpenDispute:
+		if len(args) != 3 {
+			return shim.Error("Incorrect number of arguments. Expecting 3.")
+		}
+		//args[0]: service name
+		//args[1]: reduce id, the transaction of the reduction or its unix time if reduced before
+		//args[2]: reason
+		return t.openDispute(stub, args)
+
+	case ResolveDispute:
+		if len(args) != 4 && len(args) != 5 {
+			return shim.Error("Incorrect number of arguments. Expecting 4 or 5.")
+		}
+		//args[0]: service name
+		//args[1]: caller name
+		//args[2]: reduce id
+		//args[3]: "true" to uphold, "false" to reject
+		//args[4]: ruling (optional)
+		return t.resolveDispute(stub, args)
+
+	case QueryDisputes:
+		if len(args) != 1 && len(args) != 2 {
+			return shim.Error("Incorrect number of arguments. Expecting 1 or 2.")
+		}
+		//args[0]: service name
+		//args[1]: caller name (optional)
+		return t.queryDisputes(stub, args)
+	}
+
+	return shim.Error("Invalid invoke function.")
+}
+
+// Invoke func about user
+// ==================================================================================
+
+// ==================================
+// registerUser: Register a new user
+// ==================================
+func (t *serviceChaincode) registerUser(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var new_name string
+	var new_intro string
+	var new_add string
+	var new_org string
+	var err error
+
+	new_name = args[0]
+	new_intro = args[1]
+	if len(args) > 2 {
+		new_org = strings.TrimSpace(args[2])
+	}
+	if len(new_name) == 0 || strings.Contains(new_name, NamespaceSeparator) {
+		return shim.Error("User name must be non-empty and can not contain \"" + NamespaceSeparator + "\"")
+	}
+
+	// Get the user's address automatically through INKchian's GetSender() interface
+	new_add, err = stub.GetSender()
+	if err != nil {
+		return shim.Error("Fail to get the sender's address.")
+	}
+
+	// check if user exists
+	user_key := UserPrefix + new_name
+	userAsBytes, err := stub.GetState(user_key)
+	if err != nil {
+		return shim.Error("Fail to get user: " + err.Error())
+	} else if userAsBytes != nil {
+		return shim.Error("This user already exists: " + new_name)
+	}
+	userAddressAsBytes, err := stub.GetState(UserPrefix + new_add)
+	if err != nil {
+		return shim.Error("Fail to get user by address: " + err.Error())
+	} else if userAddressAsBytes != nil {
+		return shim.Error("This address already registered")
+	}
 
 	// register user
-	user := &user{new_name, new_intro, new_add, 1, 0, 0, 0}
+	user := &user{new_name, new_intro, new_add, new_org, "", "", 1, 0, 0, 0}
 	userJSONasBytes, err := json.Marshal(user)
 	if err != nil {
 		return shim.Error(err.Error())
@@ -460,6 +1414,18 @@ func (t *serviceChaincode) registerService(stub shim.ChaincodeStubInterface, arg
 	if !ok {
 		return shim.Error("6th args must be intefer")
 	}
+	license := L_Commercial
+	if len(args) > 6 {
+		license = strings.TrimSpace(args[6])
+		if !isValidLicense(license) {
+			return shim.Error("Invalid license: " + license)
+		}
+	}
+	if len(service_name) == 0 || strings.Contains(service_name, NamespaceSeparator) {
+		return shim.Error("Service name must be non-empty and can not contain \"" + NamespaceSeparator + "\"")
+	}
+	// the service is registered in its developer's namespace
+	service_name = qualifiedServiceName(user_name, service_name)
 
 	// get service developer, check if it corresponds with the input user
 	service_dev, err = stub.GetSender()
@@ -489,23 +1455,37 @@ func (t *serviceChaincode) registerService(stub shim.ChaincodeStubInterface, arg
 		return shim.Error("This service already exists: " + service_name)
 	}
 
-	// get current time
-	tNow := time.Now()
-	tString := tNow.UTC().Format(time.UnixDate)
+	// get the transaction time
+	tString, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	// register service
-	newS := &service{service_name, service_type, user_name,
-		service_des, service_address, price, tString, "", S_Created,
-		false, make(map[string]int)}
-	serviceJSONasBytes, err := json.Marshal(newS)
+	newS := &service{
+		Name:        service_name,
+		Type:        service_type,
+		Developer:   user_name,
+		Description: service_des,
+		Price:       price,
+		License:     license,
+		CreatedTime: tString,
+		Visibility:  V_Public,
+		Status:      S_Created,
+		IsMashup:    false,
+		Composition: make(map[string]int),
+	}
+	// the resource is stored apart from the public service record,
+	// as it is if the developer has no key to encrypt it with
+	newS.PlainResource = len(service_address) > 0 && len(userJSON.EncryptionKey) == 0
+	err = t.saveServiceResource(stub, service_name, service_address)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	err = stub.PutState(service_key, serviceJSONasBytes)
+	err = t.saveService(stub, *newS)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	err = t.saveServiceByUserName(stub, user_name, service_name, serviceJSONasBytes)
 	userJSON.TotalService = userJSON.TotalService + 1
 	err = t.updateUser(userJSON, stub)
 	if err != nil {
@@ -521,7 +1501,10 @@ func (t *serviceChaincode) invalidateService(stub shim.ChaincodeStubInterface, a
 	var service_name string
 	var err error
 
-	service_name = args[0]
+	service_name, err = t.resolveServiceName(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	// STEP 0: check if service exists
 	service_key := ServicePrefix + service_name
@@ -555,31 +1538,50 @@ func (t *serviceChaincode) invalidateService(stub shim.ChaincodeStubInterface, a
 	var DevJSON user
 	err = json.Unmarshal([]byte(devAsBytes), &DevJSON)
 
-	fmt.Println("DevAddress:  " + DevJSON.Address)
 	if senderAdd != DevJSON.Address {
 		return shim.Error("Aurthority err! Not invoke by the service's developer.")
 	}
 
 	// STEP 2: invalidate the service and store it.
 	// new service, make it invalidated
-	new_service := &service{serviceJSON.Name, serviceJSON.Type, serviceJSON.Developer,
-		serviceJSON.Description, serviceJSON.Resource, serviceJSON.Price, serviceJSON.CreatedTime, serviceJSON.UpdatedTime,
-		S_Invalid, serviceJSON.IsMashup, serviceJSON.Composition}
+	new_service := &serviceJSON
+	new_service.Status = S_Invalid
 	// store the new service
-	assetJSONasBytes, err := json.Marshal(new_service)
+	err = t.saveService(stub, *new_service)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-
-	err = stub.PutState(service_key, assetJSONasBytes)
+	// STEP 3: degrade the mashups that depend on it
+	err = t.propagateStatus(stub, *new_service)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	err = t.saveServiceByUserName(stub, new_service.Developer, service_name, assetJSONasBytes)
 
 	return shim.Success([]byte("Invalidate Service success."))
 }
 
+// =================================================
+// retireService: withdraw a service for good, the
+// mashups that depend on it are degraded
+// =================================================
+func (t *serviceChaincode) retireService(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	serviceJSON, err := t.getDevelopedService(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	serviceJSON.Status = S_Retired
+	err = t.saveService(stub, serviceJSON)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = t.propagateStatus(stub, serviceJSON)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success([]byte("Retire Service success."))
+}
+
 // =================================================
 // publishService: publish a created service
 // =================================================
@@ -587,7 +1589,10 @@ func (t *serviceChaincode) publishService(stub shim.ChaincodeStubInterface, args
 	var service_name string
 	var err error
 
-	service_name = args[0]
+	service_name, err = t.resolveServiceName(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	// STEP 0: check if service exists
 	service_key := ServicePrefix + service_name
@@ -611,9 +1616,6 @@ func (t *serviceChaincode) publishService(stub shim.ChaincodeStubInterface, args
 		return shim.Error("Error unmarshal service bytes.")
 	}
 
-	fmt.Println("SenderAdd:  " + senderAdd)
-	fmt.Println("Developer:  " + serviceJSON.Developer)
-
 	// 0125
 	// get developer's address
 	dev_key := UserPrefix + serviceJSON.Developer
@@ -624,27 +1626,39 @@ func (t *serviceChaincode) publishService(stub shim.ChaincodeStubInterface, args
 	var DevJSON user
 	err = json.Unmarshal([]byte(devAsBytes), &DevJSON)
 
-	fmt.Println("DevAddress:  " + DevJSON.Address)
 	if senderAdd != DevJSON.Address {
 		return shim.Error("Aurthority err! Not invoke by the service's developer.")
 	}
 
 	// STEP 2: publish the service and store it.
 	// new service, make it invalidated
-	new_service := &service{serviceJSON.Name, serviceJSON.Type, serviceJSON.Developer,
-		serviceJSON.Description, serviceJSON.Resource, serviceJSON.Price, serviceJSON.CreatedTime, serviceJSON.UpdatedTime,
-		S_Available, serviceJSON.IsMashup, serviceJSON.Composition}
+	new_service := &serviceJSON
+	if new_service.Status == S_Retired {
+		return shim.Error("This service is retired: " + service_name)
+	}
+	// a mashup can only be published when all its components are available
+	if new_service.IsMashup {
+		components, err := t.getComponents(stub, new_service.Composition)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		for _, component := range components {
+			if component.Status != S_Available {
+				return shim.Error("This service is not available: " + component.Name)
+			}
+		}
+	}
+	new_service.Status = S_Available
 	// store the new service
-	serviceJSONasBytes, err := json.Marshal(new_service)
+	err = t.saveService(stub, *new_service)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-
-	err = stub.PutState(service_key, serviceJSONasBytes)
+	// STEP 3: restore the mashups that were degraded by it
+	err = t.propagateStatus(stub, *new_service)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	err = t.saveServiceByUserName(stub, new_service.Developer, service_name, serviceJSONasBytes)
 
 	return shim.Success([]byte("Publish Service success."))
 }
@@ -656,7 +1670,10 @@ func (t *serviceChaincode) queryService(stub shim.ChaincodeStubInterface, args [
 	var service_name string
 	var err error
 
-	service_name = args[0]
+	service_name, err = t.resolveServiceName(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	// check if service exists
 	service_key := ServicePrefix + service_name
@@ -666,6 +1683,17 @@ func (t *serviceChaincode) queryService(stub shim.ChaincodeStubInterface, args [
 	} else if serviceAsBytes == nil {
 		return shim.Error("This service does not exist: " + service_name)
 	}
+	var serviceJSON service
+	err = json.Unmarshal(serviceAsBytes, &serviceJSON)
+	if err != nil {
+		return shim.Error("Error unmarshal service bytes.")
+	}
+	serviceJSON.License = serviceLicense(serviceJSON)
+	serviceJSON.Resource = ""
+	serviceAsBytes, err = json.Marshal(serviceJSON)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	// return service info
 	return shim.Success(serviceAsBytes)
@@ -676,7 +1704,7 @@ func (t *serviceChaincode) queryService(stub shim.ChaincodeStubInterface, args [
 // args[0]: service name
 // args[1]: service type
 // args[2]: service description
-// args[3]: service path
+// args[3]: service path, encrypted with the developer's encryption key, or plain if they have none
 // args[4]: service price
 // ======================================
 func (t *serviceChaincode) editService(stub shim.ChaincodeStubInterface, args []string) pb.Response {
@@ -684,7 +1712,10 @@ func (t *serviceChaincode) editService(stub shim.ChaincodeStubInterface, args []
 	var price *big.Int
 	var err error
 
-	serviceName = args[0]
+	serviceName, err = t.resolveServiceName(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 	serviceType = args[1]
 	description = args[2]
 	resource = args[3]
@@ -731,33 +1762,44 @@ func (t *serviceChaincode) editService(stub shim.ChaincodeStubInterface, args []
 	}
 
 	// STEP 2: update time information
-	tNow := time.Now()
-	tString := tNow.UTC().Format(time.UnixDate)
+	tString, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
-	newService := &service{serviceJSON.Name, serviceType, serviceJSON.Developer,
-		description, resource, price, serviceJSON.CreatedTime, tString,
-		serviceJSON.Status, serviceJSON.IsMashup, serviceJSON.Composition}
+	newService := &serviceJSON
+	newService.Type = serviceType
+	newService.Description = description
+	newService.Resource = ""
+	newService.PlainResource = len(resource) > 0 && len(DevJSON.EncryptionKey) == 0
+	newService.Price = price
+	newService.UpdatedTime = tString
+	// STEP 3: store the resource apart from the public service record
+	err = t.saveServiceResource(stub, serviceName, resource)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 	// STEP 4: store the service
-	serviceJSONasBytes, err := json.Marshal(newService)
+	err = t.saveService(stub, *newService)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-
-	err = stub.PutState(serviceKey, serviceJSONasBytes)
+	serviceJSONasBytes, err := json.Marshal(newService)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	err = t.saveServiceByUserName(stub, newService.Developer, serviceName, serviceJSONasBytes)
 
 	// return service info
-	return shim.Success(serviceAsBytes)
+	return shim.Success(serviceJSONasBytes)
 }
 
 // =======================================================
 // createMashup: Create a new mashup
 // note: a mashup should invoke at least one service API
+// When "origin" is given, the new mashup is a fork of it
+// and utilizes the same services.
 // =======================================================
-func (t *serviceChaincode) createMashup(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+func (t *serviceChaincode) createMashup(stub shim.ChaincodeStubInterface, args []string, origin *service) pb.Response {
 	var mashup_name string
 	var mashup_type string
 	var mashup_des string
@@ -770,11 +1812,20 @@ func (t *serviceChaincode) createMashup(stub shim.ChaincodeStubInterface, args [
 	mashup_type = args[1]
 	mashup_des = args[2]
 	user_name = args[3]
-	price_str := args[4]
+	price_str := strings.TrimSpace(args[4])
 	price, ok := big.NewInt(0).SetString(price_str, 10)
-	if !ok {
-		return shim.Error("4th args must be integer")
+	if !ok && price_str != AutoPrice {
+		return shim.Error("5th args must be integer or \"" + AutoPrice + "\"")
+	}
+	mashup_license := strings.TrimSpace(args[5])
+	if !isValidLicense(mashup_license) {
+		return shim.Error("Invalid license: " + mashup_license)
 	}
+	if len(mashup_name) == 0 || strings.Contains(mashup_name, NamespaceSeparator) {
+		return shim.Error("Mashup name must be non-empty and can not contain \"" + NamespaceSeparator + "\"")
+	}
+	// the mashup is registered in its developer's namespace
+	mashup_name = qualifiedServiceName(user_name, mashup_name)
 
 	// STEP 0: get mashup developer
 	mashup_dev, err = stub.GetSender()
@@ -805,65 +1856,100 @@ func (t *serviceChaincode) createMashup(stub shim.ChaincodeStubInterface, args [
 	}
 
 	// STEP 2: create a new mashup
-	// get current time
-	tNow := time.Now()
-	tString := tNow.UTC().Format(time.UnixDate)
+	// get the transaction time
+	tString, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	// create composition
-	new_map := make(map[string]int)
-	new_developer_map := make(map[string]int)
-	for i := 5; i < len(args); i++ {
-		// check the service exist
-		service_key := ServicePrefix + args[i]
-		serviceAsBytes, err := stub.GetState(service_key)
+	var new_map map[string]int
+	if origin != nil {
+		new_map = make(map[string]int)
+		for k, n := range origin.Composition {
+			component_name, err := t.resolveServiceName(stub, k)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			new_map[component_name] += n
+		}
+	} else {
+		new_map, err = t.parseComposition(stub, args[6:])
 		if err != nil {
-			return shim.Error("Fail to get service: " + err.Error())
-		} else if serviceAsBytes == nil {
-			return shim.Error("This service doesn't exist: " + args[i])
+			return shim.Error(err.Error())
 		}
-		// add the service into map
-		new_map[args[i]] = 1
-		// temporarily store their addresses
-		var serviceJSON service
-		err = json.Unmarshal([]byte(serviceAsBytes), &serviceJSON)
+	}
+	components, err := t.getComponents(stub, new_map)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	// nested mashups must not be too deep or call the new mashup back
+	err = t.checkComposition(stub, mashup_name, new_map)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	component_cost := big.NewInt(0)
+	for _, serviceJSON := range components {
+		n := big.NewInt(int64(new_map[serviceJSON.Name]))
+		component_cost.Add(component_cost, new(big.Int).Mul(serviceJSON.Price, n))
+	}
+	if price_str == AutoPrice {
+		price = component_cost
+	}
+
+	for _, serviceJSON := range components {
+		// check the service can be used
+		if serviceJSON.Status != S_Available {
+			return shim.Error("This service is not available: " + serviceJSON.Name)
+		}
+		// check the mashup developer can see the service
+		if !canAccessService(serviceJSON, userJSON) {
+			return shim.Error("This service is not accessible: " + serviceJSON.Name)
+		}
+		// check the service's license allows the composition
+		err = checkLicense(serviceJSON, user_name, price, mashup_license)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	// a fork must be allowed by the original mashup too
+	if origin != nil {
+		if !canAccessService(*origin, userJSON) {
+			return shim.Error("This service is not accessible: " + origin.Name)
+		}
+		err = checkLicense(*origin, user_name, price, mashup_license)
 		if err != nil {
-			return shim.Error("Error unmarshal service bytes.")
+			return shim.Error(err.Error())
 		}
-		new_developer_map[serviceJSON.Developer] = 1
 	}
 
 	// new mashup
-	newS := &service{mashup_name, mashup_type, user_name,
-		mashup_des, "", price, tString, "", S_Created,
-		true, new_map}
+	newS := &service{
+		Name:        mashup_name,
+		Type:        mashup_type,
+		Developer:   user_name,
+		Description: mashup_des,
+		Price:       price,
+		License:     mashup_license,
+		CreatedTime: tString,
+		Visibility:  V_Public,
+		Status:      S_Created,
+		IsMashup:    true,
+		Composition: new_map,
+
+		ComponentCost: component_cost,
+	}
+	if origin != nil {
+		newS.ForkedFrom = origin.Name
+		newS.ForkRoyalty = origin.ForkRoyalty
+	}
 
 	// STEP 3: pay to the invoked services' developers
 	// Important!
 	// Incentive Mechanism Here
-
-	incentive_amount := big.NewInt(0)
-	incentive_amount.SetString(IncentiveMashupInvoke, 10)
-
-	for k, _ := range (new_developer_map) {
-		// get the k's address
-		user_key := UserPrefix + k
-		userAsBytes, err := stub.GetState(user_key)
-		if err != nil {
-			return shim.Error("Fail to get user: " + err.Error())
-		} else if userAsBytes == nil {
-			return shim.Error("This user doesn't exist: " + k)
-		}
-		var userJSON user
-		err = json.Unmarshal([]byte(userAsBytes), &userJSON)
-		if err != nil {
-			return shim.Error("Error unmarshal user bytes.")
-		}
-		// make incentive transfer
-		// from the mashup developer to the invoked service's developer
-		err = stub.Transfer(userJSON.Address, FeeBalanceType, incentive_amount)
-		if err != nil {
-			return shim.Error("Error when making transfer.")
-		}
+	err = t.payIncentives(stub, components, new_map)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
 
 	// STEP 4: store the new mashup
@@ -876,6 +1962,11 @@ func (t *serviceChaincode) createMashup(stub shim.ChaincodeStubInterface, args [
 		return shim.Error(err.Error())
 	}
 	err = t.saveServiceByUserName(stub, user_name, mashup_name, serviceJSONasBytes)
+	// STEP 5: index the dependencies, and the components' co-occurrence
+	err = t.updateDependencies(stub, mashup_name, nil, new_map)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 	userJSON.TotalService = userJSON.TotalService + 1
 	err = t.updateUser(userJSON, stub)
 	if err != nil {
@@ -885,515 +1976,5531 @@ func (t *serviceChaincode) createMashup(stub shim.ChaincodeStubInterface, args [
 }
 
 // =======================================================
-// rewardService: reward a service
-// reward a service's developer, transfer fixed amount of
-// specific reward_type token to the developer's account.
+// forkMashup: create a new mashup utilizing the same services
+// as an existing one, the original mashup's developer gets
+// its fork royalty from the new mashup's revenue
 // =======================================================
-func (t *serviceChaincode) rewardService(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	var service_name string
-	var reward_type string
-	var err error
-
-	service_name = args[0]
-	reward_type = args[1]
+func (t *serviceChaincode) forkMashup(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var origin service
 
-	// Amount
-	reward_amount := big.NewInt(0)
-	_, good := reward_amount.SetString(args[2], 10)
-	if !good {
-		return shim.Error("Expecting integer value for amount")
+	origin_name, err := t.resolveServiceName(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
 	}
-
-	// STEP 0: get service's developer
-	service_key := ServicePrefix + service_name
-	serviceAsBytes, err := stub.GetState(service_key)
+	originAsBytes, err := stub.GetState(ServicePrefix + origin_name)
 	if err != nil {
-		return shim.Error("Fail to get the service's info.")
+		return shim.Error("Fail to get service: " + err.Error())
+	} else if originAsBytes == nil {
+		return shim.Error("This service doesn't exist: " + args[0])
 	}
-
-	var serviceJSON service
-	err = json.Unmarshal([]byte(serviceAsBytes), &serviceJSON)
+	err = json.Unmarshal(originAsBytes, &origin)
 	if err != nil {
 		return shim.Error("Error unmarshal service bytes.")
 	}
+	if !origin.IsMashup {
+		return shim.Error("Not a mashup: " + origin.Name)
+	}
+	if origin.Status == S_Retired || origin.Status == S_Invalid {
+		return shim.Error("This service is not available: " + origin.Name)
+	}
 
-	dev := serviceJSON.Developer
+	return t.createMashup(stub, args[1:], &origin)
+}
 
-	// STEP 1: get the address of the dev
-	user_key := UserPrefix + dev
-	userAsBytes, err := stub.GetState(user_key)
-	if err != nil {
-		return shim.Error("Fail to get the developer's info.")
+// =======================================================
+// setForkRoyalty: set the percentage of the revenue of
+// mashups forked from now on paid to the mashup's developer
+// =======================================================
+func (t *serviceChaincode) setForkRoyalty(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	percent, err := strconv.ParseInt(strings.TrimSpace(args[1]), 10, 64)
+	if err != nil || percent < 0 || percent > 100 {
+		return shim.Error("2nd arg must be an integer between 0 and 100")
 	}
-	var userJSON user
-	err = json.Unmarshal([]byte(userAsBytes), &userJSON)
+
+	mashupJSON, err := t.getDevelopedService(stub, args[0])
 	if err != nil {
-		return shim.Error("Error unmarshal user bytes.")
+		return shim.Error(err.Error())
 	}
-
-	// STEP 3: reward the developer
-	toAdd := userJSON.Address
-	err = stub.Transfer(toAdd, reward_type, reward_amount)
+	if !mashupJSON.IsMashup {
+		return shim.Error("Not a mashup: " + mashupJSON.Name)
+	}
+	mashupJSON.ForkRoyalty = percent
+	err = t.saveService(stub, mashupJSON)
 	if err != nil {
-		return shim.Error("Fail realize the reawrd.")
+		return shim.Error(err.Error())
 	}
 
-	return shim.Success([]byte("Reward the service success."))
+	return shim.Success([]byte("Set fork royalty success."))
 }
 
-// ========================================================================
-// queryServiceByRange: query services' by page and limit
-//
-// // page and limit are case-se
-// ========================================================================
-func (t *serviceChaincode) queryServiceByRange(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	var page, limit int64
-	var err error
-	page, err = strconv.ParseInt(args[0], 10, 64)
+// =======================================================
+// editMashup: change the services a mashup utilizes
+// only the developers of newly composed services get
+// the composition incentive
+// =======================================================
+func (t *serviceChaincode) editMashup(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var operation string
+	var userJSON user
+
+	operation = strings.TrimSpace(args[1])
+	if operation != EditAdd && operation != EditRemove && operation != EditReplace {
+		return shim.Error("Invalid operation: " + operation)
+	}
+
+	time_stamp, err := stub.GetTxTimestamp()
 	if err != nil {
-		return shim.Error(err.Error())
+		return shim.Error("Can't get timestamp : " + err.Error())
 	}
-	limit, err = strconv.ParseInt(args[1], 10, 64)
+
+	// STEP 0: get the mashup, it can only be changed by its developer
+	mashupJSON, err := t.getDevelopedService(stub, args[0])
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	if limit == 0 {
-		limit = 10
+	if !mashupJSON.IsMashup {
+		return shim.Error("Not a mashup: " + mashupJSON.Name)
 	}
-	if page <= 0 {
-		page = 1
+	if mashupJSON.Status == S_Retired {
+		return shim.Error("This service is retired: " + mashupJSON.Name)
 	}
-	start := (page - 1) * limit
-	resultsIterator, err := stub.GetStateByPartialCompositeKey(UserServicesKey, []string{})
+	userAsBytes, err := stub.GetState(UserPrefix + mashupJSON.Developer)
 	if err != nil {
-		return shim.Error(err.Error())
+		return shim.Error("Fail to get user: " + err.Error())
 	}
-	services := make([]*service, 0)
-	for i := int64(0); resultsIterator.HasNext(); i++ {
-		responseRange, err := resultsIterator.Next()
+	err = json.Unmarshal(userAsBytes, &userJSON)
+	if err != nil {
+		return shim.Error("Error unmarshal user bytes.")
+	}
+
+	// STEP 1: compute the new composition
+	old_map := make(map[string]int)
+	for k, n := range mashupJSON.Composition {
+		name, err := t.resolveServiceName(stub, k)
 		if err != nil {
 			return shim.Error(err.Error())
 		}
-		if i >= start && i < start+limit {
-			service := &service{}
-			err = json.Unmarshal(responseRange.Value, service)
-			if err != nil {
-				return shim.Error(err.Error())
-			}
-			services = append(services, service)
-		} else if i >= start+limit {
-			break
-		}
+		old_map[name] += n
 	}
-	servicesBytes, err := json.Marshal(services)
+	changes, err := t.parseComposition(stub, args[2:])
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	return shim.Success(servicesBytes)
-}
-
-// ========================================================================
-// saveServiceByUserName: save service with key which include user name and service name
-//
-// userName are required
-// serviceName are required
-// ========================================================================
-func (t *serviceChaincode) saveServiceByUserName(stub shim.ChaincodeStubInterface, userName string, serviceName string, state []byte) error {
-	compositeKey, err := stub.CreateCompositeKey(UserServicesKey, []string{userName, serviceName})
-	if err != nil {
-		return fmt.Errorf(fmt.Sprintf("create composite key error: %s", err.Error()))
+	new_map := make(map[string]int)
+	switch operation {
+	case EditAdd:
+		for k, n := range old_map {
+			new_map[k] = n
+		}
+		for k, n := range changes {
+			new_map[k] += n
+		}
+	case EditRemove:
+		for k, n := range old_map {
+			if _, ok := changes[k]; !ok {
+				new_map[k] = n
+			}
+		}
+		if len(new_map) == len(old_map) {
+			return shim.Error("None of the services is composed by the mashup")
+		}
+	case EditReplace:
+		new_map = changes
 	}
-	err = stub.PutState(compositeKey, state)
-	if err != nil {
-		return fmt.Errorf(fmt.Sprintf("save error: %s", err.Error()))
+	if len(new_map) == 0 {
+		return shim.Error("A mashup should invoke at least one service")
 	}
-	return nil
-}
 
-// ========================================================================
-// queryServiceByUser: query services' names by user name (name)
-//
-// name are case-sensitive
-// use "" for both name if you want to query all the assets
-// ========================================================================
-func (t *serviceChaincode) queryServiceByUser(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	var page, limit int64
-	var err error
-	page, err = strconv.ParseInt(args[0], 10, 64)
+	// STEP 2: check the new composition
+	components, err := t.getComponents(stub, new_map)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	limit, err = strconv.ParseInt(args[1], 10, 64)
+	err = t.checkComposition(stub, mashupJSON.Name, new_map)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	if limit == 0 {
-		limit = 10
-	}
-	if page <= 0 {
-		page = 1
-	}
-	start := (page - 1) * limit
-	resultsIterator, err := stub.GetStateByPartialCompositeKey(UserServicesKey, []string{args[2]})
+	old_developers := make(map[string]bool)
+	old_components, err := t.getComponents(stub, old_map)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	services := make([]*service, 0)
-	for i := int64(0); resultsIterator.HasNext(); i++ {
-		responseRange, err := resultsIterator.Next()
+	for _, component := range old_components {
+		old_developers[component.Developer] = true
+	}
+	added := make([]string, 0)
+	new_components := make([]service, 0)
+	component_cost := big.NewInt(0)
+	available := true
+	for _, component := range components {
+		n := big.NewInt(int64(new_map[component.Name]))
+		component_cost.Add(component_cost, new(big.Int).Mul(component.Price, n))
+		if component.Status != S_Available {
+			available = false
+		}
+		if _, ok := old_map[component.Name]; ok {
+			continue
+		}
+		// newly composed services are checked like in createMashup
+		added = append(added, component.Name)
+		if component.Status != S_Available {
+			return shim.Error("This service is not available: " + component.Name)
+		}
+		if !canAccessService(component, userJSON) {
+			return shim.Error("This service is not accessible: " + component.Name)
+		}
+		err = checkLicense(component, mashupJSON.Developer, mashupJSON.Price, serviceLicense(mashupJSON))
 		if err != nil {
 			return shim.Error(err.Error())
 		}
-		if i >= start && i < start+limit {
-			service := &service{}
-			err = json.Unmarshal(responseRange.Value, service)
-			if err != nil {
-				return shim.Error(err.Error())
-			}
-			services = append(services, service)
-		} else if i >= start+limit {
-			break
+		if !old_developers[component.Developer] {
+			new_components = append(new_components, component)
 		}
 	}
-	servicesBytes, err := json.Marshal(services)
-	if err != nil {
-		return shim.Error(err.Error())
-	}
-	return shim.Success(servicesBytes)
-}
-
-// ========================================================================
-// callService: pay tokens to buy one service call times
-//
-// serviceName and callTimes are required
-// ========================================================================
-func (t *serviceChaincode) callService(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	var service_name, sender string
-	call_times := big.NewInt(0)
-	total := big.NewInt(0)
-	var service_data service
-	var user_data user
-	var record serviceCallTime
-	var err error
-
-	time_stamp, err := stub.GetTxTimestamp()
-	if err != nil {
-		return shim.Error("Can't get timestamp : " + err.Error())
+	removed := make([]string, 0)
+	for _, component := range old_components {
+		if _, ok := new_map[component.Name]; !ok {
+			removed = append(removed, component.Name)
+		}
 	}
 
-	sender, err = stub.GetSender()
+	// STEP 3: pay the developers that are newly composed
+	err = t.payIncentives(stub, new_components, new_map)
 	if err != nil {
-		return shim.Error("Failed to get sender : " + err.Error())
+		return shim.Error(err.Error())
 	}
 
-	service_name = strings.TrimSpace(args[0])
-	if len(service_name) <= 0 {
-		return shim.Error("1st arg must be non-empty string")
+	// STEP 4: store the mashup and update the dependencies
+	for k := range mashupJSON.RevenueShare {
+		if _, ok := new_map[k]; !ok {
+			delete(mashupJSON.RevenueShare, k)
+		}
 	}
-	call_time_str := strings.TrimSpace(args[1])
-	call_times, ok := big.NewInt(0).SetString(call_time_str, 10)
-	if !ok {
-		return shim.Error("2th arg must be integer")
+	mashupJSON.Composition = new_map
+	mashupJSON.ComponentCost = component_cost
+	mashupJSON.UpdatedTime = formatTime(time_stamp.Seconds)
+	statusChanged := false
+	if mashupJSON.Status == S_Degraded && available {
+		mashupJSON.Status = S_Available
+		statusChanged = true
+	} else if mashupJSON.Status == S_Available && !available {
+		mashupJSON.Status = S_Degraded
+		statusChanged = true
 	}
-
-	userAsJson, err := stub.GetState(UserPrefix + sender)
+	err = t.saveService(stub, mashupJSON)
 	if err != nil {
-		return shim.Error("Get user info failed: " + err.Error())
-	} else if userAsJson == nil {
-		return shim.Error("User not registered")
+		return shim.Error(err.Error())
 	}
-	err = json.Unmarshal(userAsJson, &user_data)
+	err = t.updateDependencies(stub, mashupJSON.Name, old_map, new_map)
 	if err != nil {
-		return shim.Error("Unmarshal user info failed: " + err.Error())
+		return shim.Error(err.Error())
+	}
+	if statusChanged {
+		err = t.propagateStatus(stub, mashupJSON)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
 	}
 
-	serviceJson, err := stub.GetState(ServicePrefix + service_name)
+	// STEP 5: record the change
+	change := compositionChange{mashupJSON.Name, operation, old_map, new_map, added, removed, formatTime(time_stamp.Seconds)}
+	changeJson, err := json.Marshal(change)
 	if err != nil {
-		return shim.Error("Get service info failed : " + err.Error())
-	} else if serviceJson == nil {
-		return shim.Error("Service not exists")
+		return shim.Error(err.Error())
 	}
-	service_data = service{}
-	err = json.Unmarshal(serviceJson, &service_data)
+	changeKey, err := stub.CreateCompositeKey(MashupHistoryKey,
+		[]string{mashupJSON.Name, fmt.Sprintf("%020d", time_stamp.Seconds), stub.GetTxID()})
 	if err != nil {
-		return shim.Error("Unmarshal service info failed: " + err.Error())
+		return shim.Error("Create composite key error: " + err.Error())
 	}
-	if service_data.Status != S_Available {
-		return shim.Error("Service not invalid")
+	err = stub.PutState(changeKey, changeJson)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
 
-	total = total.Mul(service_data.Price, call_times)
-	record_key := ServiceCallTimesPrefix + service_name + user_data.Name
-	callTimesJson, err := stub.GetState(record_key)
+	return shim.Success(changeJson)
+}
+
+// =======================================================
+// queryMashupHistory: query the composition changes of a
+// mashup, oldest first
+// =======================================================
+func (t *serviceChaincode) queryMashupHistory(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	mashup_name, err := t.resolveServiceName(stub, args[0])
 	if err != nil {
-		return shim.Error("Get old call times log failed: " + err.Error())
-	} else if callTimesJson != nil {
-		err = json.Unmarshal(callTimesJson, &record)
+		return shim.Error(err.Error())
+	}
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(MashupHistoryKey, []string{mashup_name})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+	changes := make([]*compositionChange, 0)
+	for resultsIterator.HasNext() {
+		responseRange, err := resultsIterator.Next()
 		if err != nil {
-			return shim.Error("Unmarshal old call times log failed: " + err.Error())
+			return shim.Error(err.Error())
 		}
-		record.CallTimes = big.NewInt(0).Add(call_times, record.CallTimes)
-		record.UpdateTime = time_stamp.String()
-		record.Total = big.NewInt(0).Add(total, record.Total)
-	} else {
-		record = serviceCallTime{service_name, user_data.Name, sender, call_times, total, time_stamp.String(), time_stamp.String()}
+		change := &compositionChange{}
+		err = json.Unmarshal(responseRange.Value, change)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		changes = append(changes, change)
 	}
-
-	recordJson, err := json.Marshal(record)
+	changesBytes, err := json.Marshal(changes)
 	if err != nil {
-		return shim.Error("Marshal call time info failed: " + err.Error())
+		return shim.Error(err.Error())
 	}
-	developerKey := UserPrefix + service_data.Developer
-	developerAsBytes, err := stub.GetState(developerKey)
-	if err != nil {
-		return shim.Error("Fail to get the developer's info.")
+	return shim.Success(changesBytes)
+}
+
+// =======================================================
+// setCompositionFee: set the fee that a mashup pays to the
+// developer for every call it makes to the service
+// =======================================================
+func (t *serviceChaincode) setCompositionFee(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fee, ok := big.NewInt(0).SetString(strings.TrimSpace(args[1]), 10)
+	if !ok || fee.Sign() < 0 {
+		return shim.Error("2nd arg must be a non-negative integer")
 	}
-	var developer user
-	err = json.Unmarshal([]byte(developerAsBytes), &developer)
-	if err != nil {
-		return shim.Error("Error unmarshal developer bytes.")
+	fee_type := FeeBalanceType
+	if len(args) > 2 {
+		fee_type = strings.TrimSpace(args[2])
+		if len(fee_type) == 0 {
+			return shim.Error("3rd arg must be non-empty string")
+		}
 	}
 
-	err = stub.Transfer(developer.Address, FeeBalanceType, service_data.Price)
+	serviceJSON, err := t.getDevelopedService(stub, args[0])
 	if err != nil {
-		return shim.Error("Send service fee failed: " + err.Error())
+		return shim.Error(err.Error())
 	}
-	err = stub.PutState(record_key, recordJson)
+	serviceJSON.CompositionFee = fee
+	serviceJSON.CompositionFeeType = fee_type
+	err = t.saveService(stub, serviceJSON)
 	if err != nil {
-		return shim.Error("Failed to save call time info: " + err.Error())
+		return shim.Error(err.Error())
 	}
 
-	buy_record := buyRecord{record_key, service_name, user_data.Name, call_times, total, time_stamp.String()}
-	buyRecordJson, err := json.Marshal(buy_record)
+	return shim.Success([]byte("Set composition fee success."))
+}
+
+// =======================================================
+// quoteMashup: get the fees that createMashup would charge
+// for composing a list of services
+// =======================================================
+func (t *serviceChaincode) quoteMashup(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	composition, err := t.parseComposition(stub, args)
 	if err != nil {
-		return shim.Error("Marshal buy record failed:" + err.Error())
+		return shim.Error(err.Error())
 	}
-	buy_record_key := fmt.Sprintf("%s%s%s%d", BuyRecordPrefix, service_name, user_data.Name, time_stamp.Seconds)
-	err = stub.PutState(buy_record_key, buyRecordJson)
+	components, err := t.getComponents(stub, composition)
 	if err != nil {
-		return shim.Error("Save buy record failed: " + err.Error())
+		return shim.Error(err.Error())
 	}
-	err = t.saveCallTimesByServiceName(stub, service_name, record_key, recordJson)
-	user_data.TotalCallTimes = user_data.TotalCallTimes + int(call_times.Int64())
-	err = t.updateUser(user_data, stub)
+
+	quote := mashupQuote{compositionFees(components, composition), make(map[string]*big.Int), big.NewInt(0)}
+	for _, fee := range quote.Fees {
+		if quote.Total[fee.FeeType] == nil {
+			quote.Total[fee.FeeType] = big.NewInt(0)
+		}
+		quote.Total[fee.FeeType].Add(quote.Total[fee.FeeType], fee.Amount)
+	}
+	for _, component := range components {
+		n := big.NewInt(int64(composition[component.Name]))
+		quote.ComponentCost.Add(quote.ComponentCost, new(big.Int).Mul(component.Price, n))
+	}
+	quoteBytes, err := json.Marshal(quote)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	return shim.Success(nil)
+	return shim.Success(quoteBytes)
 }
 
-// ========================================================================
-// saveCallTimesByServiceName: save callTime record with key which include service name and call time key
-//
-// serviceName are required
-// recordKey are required
-// ========================================================================
-func (t *serviceChaincode) saveCallTimesByServiceName(stub shim.ChaincodeStubInterface, serviceName string, recordKey string, state []byte) error {
-	compositeKey, err := stub.CreateCompositeKey(CallTimeKey, []string{serviceName, recordKey})
+// =======================================================
+// queryDependents: query the mashups that compose a service,
+// with how many times each of them calls it per call
+// =======================================================
+func (t *serviceChaincode) queryDependents(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	service_name, err := t.resolveServiceName(stub, args[0])
 	if err != nil {
-		return fmt.Errorf(fmt.Sprintf("create composite key error: %s", err.Error()))
+		return shim.Error(err.Error())
 	}
-	err = stub.PutState(compositeKey, state)
+	dependents, err := t.getDependents(stub, service_name)
 	if err != nil {
-		return fmt.Errorf(fmt.Sprintf("save error: %s", err.Error()))
+		return shim.Error(err.Error())
 	}
-	return nil
+	dependentsBytes, err := json.Marshal(dependents)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(dependentsBytes)
 }
 
-// ========================================================================
-// getCallTimes: query callTimes by service name
-//
-// name are case-sensitive
-// use "" for both name if you want to query all the assets
-// ========================================================================
-func (t *serviceChaincode) getCallTimes(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	var err error
-	resultsIterator, err := stub.GetStateByPartialCompositeKey(CallTimeKey, args)
+// =======================================================
+// queryMashupTree: query the transitive dependencies of a
+// mashup, nested mashups are resolved down to plain services
+// =======================================================
+func (t *serviceChaincode) queryMashupTree(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	mashup_name, err := t.resolveServiceName(stub, args[0])
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	callTimes := make([]*serviceCallTime, 0)
-	for i := 0; resultsIterator.HasNext(); i++ {
-		responseRange, err := resultsIterator.Next()
-		if err != nil {
-			return shim.Error(err.Error())
-		}
-		callTime := &serviceCallTime{}
-		err = json.Unmarshal(responseRange.Value, callTime)
-		if err != nil {
-			return shim.Error(err.Error())
-		}
-		callTimes = append(callTimes, callTime)
+
+	tree := mashupTree{Services: make(map[string]int)}
+	tree.Root, err = t.resolveMashupTree(stub, mashup_name, 1, 1, make(map[string]bool), 0)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
-	callTimesBytes, err := json.Marshal(callTimes)
+	collectMashupTree(tree.Root, 0, &tree)
+	treeBytes, err := json.Marshal(tree)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	return shim.Success(callTimesBytes)
+	return shim.Success(treeBytes)
 }
 
-// ========================================================================
-// getCallTime: query some one has buy service's call times
-//
-// serviceName and userName are required
-// ========================================================================
-func (t *serviceChaincode) getCallTime(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	var service_name, user_name string
-	var err error
+// =======================================================
+// setServiceLicense: change the license of a service
+// the new license only applies to mashups created later
+// =======================================================
+func (t *serviceChaincode) setServiceLicense(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var service_name, license string
 
-	service_name = strings.TrimSpace(args[0])
-	if len(service_name) <= 0 {
-		return shim.Error("1st arg must be non-empty string")
+	service_name = args[0]
+	license = strings.TrimSpace(args[1])
+	if !isValidLicense(license) {
+		return shim.Error("Invalid license: " + license)
 	}
 
-	user_name = strings.TrimSpace(args[1])
-	if len(user_name) <= 0 {
-		return shim.Error("2st arg must be non-empty string")
+	// STEP 0: get the service, it can only be changed by its developer
+	serviceJSON, err := t.getDevelopedService(stub, service_name)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
 
-	record_key := ServiceCallTimesPrefix + service_name + user_name
-	callTimeJson, err := stub.GetState(record_key)
+	// STEP 1: store the service with the new license
+	serviceJSON.License = license
+	err = t.saveService(stub, serviceJSON)
 	if err != nil {
 		return shim.Error(err.Error())
-	} else if callTimeJson == nil {
-		return shim.Error("User " + user_name + " have never buy service call times")
 	}
-	return shim.Success(callTimeJson)
+
+	return shim.Success([]byte("Set service license success."))
 }
 
-// ========================================================================
-// reduceCallTime: reduce user's service call times
-//
-// serviceName, userName and reduceTime are required
-// ========================================================================
-func (t *serviceChaincode) reduceCallTime(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	var service_name, sender, caller string
-	var reduce_time *big.Int
-	var call_time serviceCallTime
-	var reduce_record reduceRecord
-	var service_data service
-	var user_data user
-	var err error
+// =======================================================
+// setEncryptionKey: publish the key that developers use to
+// encrypt their services' resources for the sender
+// =======================================================
+func (t *serviceChaincode) setEncryptionKey(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	sender, err := stub.GetSender()
+	if err != nil {
+		return shim.Error("Fail to get the sender's address.")
+	}
+	userAsBytes, err := stub.GetState(UserPrefix + sender)
+	if err != nil {
+		return shim.Error("Fail to get user: " + err.Error())
+	} else if userAsBytes == nil {
+		return shim.Error("User not registered")
+	}
+	var userJSON user
+	err = json.Unmarshal(userAsBytes, &userJSON)
+	if err != nil {
+		return shim.Error("Error unmarshal user bytes.")
+	}
 
-	time_stamp, err := stub.GetTxTimestamp()
+	userJSON.EncryptionKey = strings.TrimSpace(args[0])
+	err = t.updateUser(userJSON, stub)
 	if err != nil {
-		return shim.Error("Can't get timestamp : " + err.Error())
+		return shim.Error(err.Error())
 	}
+	return shim.Success([]byte("Set encryption key success."))
+}
 
-	sender, err = stub.GetSender()
+// =======================================================
+// setBuyerResource: store a service's resource encrypted
+// with the buyer's encryption key, only the developer can set it.
+// The buyer gets it instead of the plain resource.
+// =======================================================
+func (t *serviceChaincode) setBuyerResource(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var service_name, buyer_name, cipher string
+
+	service_name = args[0]
+	buyer_name = strings.TrimSpace(args[1])
+	cipher = args[2]
+
+	serviceJSON, err := t.getDevelopedService(stub, service_name)
 	if err != nil {
-		return shim.Error("Failed to get sender : " + err.Error())
+		return shim.Error(err.Error())
+	}
+	buyerAsBytes, err := stub.GetState(UserPrefix + buyer_name)
+	if err != nil {
+		return shim.Error("Fail to get user: " + err.Error())
+	} else if buyerAsBytes == nil {
+		return shim.Error("This user does not exist: " + buyer_name)
 	}
 
-	service_name = strings.TrimSpace(args[0])
-	if len(service_name) == 0 {
-		return shim.Error("1st arg must be non-empty string")
+	compositeKey, err := stub.CreateCompositeKey(BuyerResourceKey, []string{serviceJSON.Name, buyer_name})
+	if err != nil {
+		return shim.Error("Create composite key error: " + err.Error())
 	}
-	caller = strings.TrimSpace(args[1])
-	if len(caller) == 0 {
-		return shim.Error("2st arg must be non-empty string")
+	if len(cipher) == 0 {
+		err = stub.DelState(compositeKey)
+	} else {
+		err = stub.PutState(compositeKey, []byte(cipher))
 	}
-	reduce_time_str := strings.TrimSpace(args[2])
-	reduce_time, ok := big.NewInt(0).SetString(reduce_time_str, 10)
-	if !ok {
-		return shim.Error("3th arg must be integer")
+	if err != nil {
+		return shim.Error(err.Error())
 	}
+	return shim.Success([]byte("Set buyer resource success."))
+}
 
-	userAsJson, err := stub.GetState(UserPrefix + sender)
+// =======================================================
+// getServiceResource: get the resource of a service
+// only the developer and users who have call times left
+// can get it. The developer gets the resource as they encrypted
+// it, a buyer gets the copy the developer encrypted for them,
+// or the resource itself if it's stored unencrypted.
+// =======================================================
+func (t *serviceChaincode) getServiceResource(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var service_name string
+	var serviceJSON service
+	var userJSON user
+
+	service_name, err := t.resolveServiceName(stub, args[0])
 	if err != nil {
-		return shim.Error("Get user info failed: " + err.Error())
-	} else if userAsJson == nil {
+		return shim.Error(err.Error())
+	}
+
+	sender, err := stub.GetSender()
+	if err != nil {
+		return shim.Error("Fail to get the sender's address.")
+	}
+	userAsBytes, err := stub.GetState(UserPrefix + sender)
+	if err != nil {
+		return shim.Error("Fail to get user: " + err.Error())
+	} else if userAsBytes == nil {
 		return shim.Error("User not registered")
 	}
-	err = json.Unmarshal(userAsJson, &user_data)
+	err = json.Unmarshal(userAsBytes, &userJSON)
 	if err != nil {
-		return shim.Error("Unmarshal user info failed: " + err.Error())
+		return shim.Error("Error unmarshal user bytes.")
 	}
 
-	service_key := ServicePrefix + service_name
-	serviceAsBytes, err := stub.GetState(service_key)
+	serviceAsBytes, err := stub.GetState(ServicePrefix + service_name)
 	if err != nil {
 		return shim.Error("Fail to get service: " + err.Error())
 	} else if serviceAsBytes == nil {
 		return shim.Error("This service does not exist: " + service_name)
 	}
-	err = json.Unmarshal(serviceAsBytes, &service_data)
+	err = json.Unmarshal(serviceAsBytes, &serviceJSON)
 	if err != nil {
-		return shim.Error("Fail to unmarshal service data")
-	} else if service_data.Developer != user_data.Name {
-		return shim.Error("Service not developed by you")
+		return shim.Error("Error unmarshal service bytes.")
 	}
 
-	call_time_key := ServiceCallTimesPrefix + service_name + caller
-	callTimeJson, err := stub.GetState(call_time_key)
-	if err != nil {
-		return shim.Error("Get call time info failed : " + err.Error())
-	} else if callTimeJson == nil {
-		return shim.Error("Have not buy this service call time")
+	if serviceJSON.Developer != userJSON.Name {
+		// the buyer must have call times left
+		callTimeJson, err := stub.GetState(ServiceCallTimesPrefix + service_name + userJSON.Name)
+		if err != nil {
+			return shim.Error("Get call time info failed : " + err.Error())
+		} else if callTimeJson == nil {
+			return shim.Error("Have not buy this service call time")
+		}
+		var call_time serviceCallTime
+		err = json.Unmarshal(callTimeJson, &call_time)
+		if err != nil {
+			return shim.Error("Unmarshal call time info failed : " + err.Error())
+		}
+		time_stamp, err := stub.GetTxTimestamp()
+		if err != nil {
+			return shim.Error("Can't get timestamp : " + err.Error())
+		}
+		if availableCallTimes(&call_time, time_stamp.Seconds, nil).Sign() <= 0 {
+			return shim.Error("Have not enough call times")
+		}
+
+		// a resource not migrated yet is still in the record, unencrypted
+		if !serviceJSON.PlainResource && serviceJSON.Resource == "" {
+			compositeKey, err := stub.CreateCompositeKey(BuyerResourceKey, []string{service_name, userJSON.Name})
+			if err != nil {
+				return shim.Error("Create composite key error: " + err.Error())
+			}
+			cipher, err := stub.GetState(compositeKey)
+			if err != nil {
+				return shim.Error(err.Error())
+			} else if cipher == nil {
+				return shim.Error("The resource is not encrypted for this user yet: " + userJSON.Name)
+			}
+			return shim.Success(cipher)
+		}
 	}
-	err = json.Unmarshal(callTimeJson, &call_time)
+
+	resource, err := stub.GetState(ResourcePrefix + service_name)
 	if err != nil {
-		return shim.Error("Unmarshal call time info failed : " + err.Error())
+		return shim.Error(err.Error())
+	} else if resource == nil && serviceJSON.Resource != "" {
+		return shim.Success([]byte(serviceJSON.Resource))
+	} else if resource == nil {
+		return shim.Error("This service has no resource: " + service_name)
 	}
+	return shim.Success(resource)
+}
 
-	if call_time.CallTimes.Cmp(big.NewInt(0)) == 0 && call_time.CallTimes.Cmp(reduce_time) < 0 {
-		return shim.Error("Have not enough call times")
+// =======================================================
+// migrateServiceName: move a service registered with a flat
+// name into its developer's namespace ("developer/service").
+// The flat name is kept as an alias of the new name, so that
+// mashups and clients using it keep working.
+// =======================================================
+func (t *serviceChaincode) migrateServiceName(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var flat_name, new_name string
+
+	flat_name = strings.TrimSpace(args[0])
+	if strings.Contains(flat_name, NamespaceSeparator) {
+		return shim.Error("Service is already namespaced: " + flat_name)
 	}
-	call_time.CallTimes = call_time.CallTimes.Sub(call_time.CallTimes, reduce_time)
-	call_time.UpdateTime = time_stamp.String()
-	callTimeJson, err = json.Marshal(call_time)
+
+	// STEP 0: get the service, it can only be migrated by its developer
+	serviceJSON, err := t.getDevelopedService(stub, flat_name)
 	if err != nil {
-		return shim.Error("Marshal call time info failed : " + err.Error())
+		return shim.Error(err.Error())
 	}
-	err = stub.PutState(call_time_key, callTimeJson)
+	if serviceJSON.Name != flat_name {
+		return shim.Error("Service is already migrated to: " + serviceJSON.Name)
+	}
+	new_name = qualifiedServiceName(serviceJSON.Developer, flat_name)
+	newAsBytes, err := stub.GetState(ServicePrefix + new_name)
 	if err != nil {
-		return shim.Error("Update call time failed : " + err.Error())
+		return shim.Error("Fail to get service: " + err.Error())
+	} else if newAsBytes != nil {
+		return shim.Error("This service already exists: " + new_name)
 	}
 
-	reduce_key := fmt.Sprintf("%s%s%s%d", ReduceRecordPrefix, service_name, caller, time_stamp.Seconds)
-	reduce_record = reduceRecord{service_name, call_time_key, user_data.Name, reduce_time, time_stamp.String()}
-	reduceJson, err := json.Marshal(reduce_record)
+	// STEP 1: move the service and its resource
+	err = t.moveService(stub, serviceJSON, new_name)
 	if err != nil {
-		return shim.Error("Marshal reduce info failed : " + err.Error())
+		return shim.Error(err.Error())
 	}
-
-	err = stub.PutState(reduce_key, reduceJson)
+	// STEP 2: move the buyers' call times, and the resources and quotas kept for them
+	err = t.moveServiceCallTimes(stub, flat_name, new_name)
 	if err != nil {
-		return shim.Error("Save reduce info failed : " + err.Error())
+		return shim.Error(err.Error())
 	}
-	user_data.TotalInvokeTimes = user_data.TotalInvokeTimes + int(reduce_time.Int64())
-	err = t.updateUser(user_data, stub)
+	// STEP 3: move the buy, reduce and refund records, their indexes and disputes, and the payouts
+	err = t.moveServiceHistory(stub, flat_name, new_name)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	return shim.Success(nil)
-}
-
-func (t *serviceChaincode) calcContribution(serviceUser user) user {
-	totalService := float64(serviceUser.TotalService)
-	totalInvokeTimes := float64(serviceUser.TotalInvokeTimes)
-	totalCallTimes := float64(serviceUser.TotalCallTimes)
-	if totalService == 0 {
-		serviceUser.Contribution = math.Log(totalService + 1)
-	} else {
-		serviceUser.Contribution = math.Log(totalService+1) +  L*(totalInvokeTimes/totalService) + R*(totalCallTimes/totalService)
+	// STEP 4: the mashups composing the service compose it by its new name
+	err = t.moveServiceComposition(stub, flat_name, new_name)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
-	return serviceUser
+	// STEP 5: move the call time transfers, the resale orders and trades
+	err = t.moveServiceMarket(stub, flat_name, new_name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success([]byte(new_name))
 }
 
-func (t *serviceChaincode) updateUser(serviceUser user, stub shim.ChaincodeStubInterface) error {
-	userKey := UserPrefix + serviceUser.Name
-	userJSONasBytes, err := json.Marshal(serviceUser)
+// moveService moves a service with a flat name and its resource to "newName",
+// keeping the flat name as an alias
+func (t *serviceChaincode) moveService(stub shim.ChaincodeStubInterface, s service, newName string) error {
+	flatName := s.Name
+	resource, err := stub.GetState(ResourcePrefix + flatName)
 	if err != nil {
 		return err
 	}
-	err = stub.PutState(userKey, userJSONasBytes)
+	err = t.saveServiceResource(stub, newName, string(resource))
 	if err != nil {
 		return err
 	}
-	err = stub.PutState(UserPrefix+serviceUser.Address, userJSONasBytes)
+	s.Name = newName
+	err = t.saveService(stub, s)
+	if err != nil {
+		return err
+	}
+	err = stub.DelState(ServicePrefix + flatName)
+	if err != nil {
+		return err
+	}
+	err = stub.DelState(ResourcePrefix + flatName)
+	if err != nil {
+		return err
+	}
+	compositeKey, err := stub.CreateCompositeKey(UserServicesKey, []string{s.Developer, flatName})
+	if err != nil {
+		return fmt.Errorf("create composite key error: %s", err.Error())
+	}
+	err = stub.DelState(compositeKey)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(ServiceAliasPrefix+flatName, []byte(newName))
+}
+
+// moveServiceCallTimes moves the call times of a migrated service's buyers, the resources
+// encrypted for them, their quota usage and the usage receipts settled
+func (t *serviceChaincode) moveServiceCallTimes(stub shim.ChaincodeStubInterface, flatName string, newName string) error {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(CallTimeKey, []string{flatName})
 	if err != nil {
 		return err
 	}
+	defer resultsIterator.Close()
+	for resultsIterator.HasNext() {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		_, keys, err := stub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return err
+		}
+		var record serviceCallTime
+		recordJson, err := stub.GetState(keys[1])
+		if err != nil {
+			return fmt.Errorf("get call time info failed: %s", err.Error())
+		} else if recordJson == nil {
+			recordJson = responseRange.Value
+		}
+		err = json.Unmarshal(recordJson, &record)
+		if err != nil {
+			return fmt.Errorf("unmarshal call time info failed: %s", err.Error())
+		}
+		record.ServiceName = newName
+		err = t.saveCallTimeRecord(stub, record)
+		if err != nil {
+			return err
+		}
+		err = stub.DelState(keys[1])
+		if err != nil {
+			return err
+		}
+		err = stub.DelState(responseRange.Key)
+		if err != nil {
+			return err
+		}
+	}
+	for _, objectType := range []string{BuyerResourceKey, QuotaUsageKey, UsageSettlementKey} {
+		err = t.renameServiceKeys(stub, objectType, 0, flatName, newName)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
+
+// moveServiceHistory moves the buy, reduce and refund records of a migrated service,
+// their history indexes, the disputes of the reduce records and the payouts of the service
+func (t *serviceChaincode) moveServiceHistory(stub shim.ChaincodeStubInterface, flatName string, newName string) error {
+	for _, prefix := range []string{BuyRecordPrefix, ReduceRecordPrefix, RefundRecordPrefix} {
+		err := t.renameServiceRecords(stub, prefix, flatName, newName)
+		if err != nil {
+			return err
+		}
+	}
+	// the attribute the service name is at in the keys of each type
+	positions := map[string]int{UserPurchaseKey: 1, UserConsumeKey: 1, ServicePurchaseKey: 0, ServiceConsumeKey: 0, DisputeKey: 0, PayoutKey: 1}
+	for _, objectType := range []string{UserPurchaseKey, UserConsumeKey, ServicePurchaseKey, ServiceConsumeKey, DisputeKey, PayoutKey} {
+		err := t.renameServiceKeys(stub, objectType, positions[objectType], flatName, newName)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveServiceComposition renames a migrated service in the compositions and revenue shares of the
+// mashups composing it, in their dependencies and in the composition history of every mashup
+func (t *serviceChaincode) moveServiceComposition(stub shim.ChaincodeStubInterface, flatName string, newName string) error {
+	dependents, err := t.getDependents(stub, flatName)
+	if err != nil {
+		return err
+	}
+	for _, dependent := range dependents {
+		mashupAsBytes, err := stub.GetState(ServicePrefix + dependent.MashupName)
+		if err != nil {
+			return fmt.Errorf("fail to get service: %s", err.Error())
+		} else if mashupAsBytes == nil {
+			continue
+		}
+		var mashup service
+		err = json.Unmarshal(mashupAsBytes, &mashup)
+		if err != nil {
+			return fmt.Errorf("error unmarshal service bytes")
+		}
+		if n, ok := mashup.Composition[flatName]; ok {
+			delete(mashup.Composition, flatName)
+			mashup.Composition[newName] += n
+		}
+		if weight, ok := mashup.RevenueShare[flatName]; ok {
+			delete(mashup.RevenueShare, flatName)
+			mashup.RevenueShare[newName] = weight
+		}
+		err = t.saveService(stub, mashup)
+		if err != nil {
+			return err
+		}
+	}
+	for position := 0; position < 2; position++ {
+		err = t.renameServiceKeys(stub, DependencyKey, position, flatName, newName)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the history of the service if it's a mashup, and of the mashups that composed it at any time
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(MashupHistoryKey, []string{})
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+	for resultsIterator.HasNext() {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		var change compositionChange
+		err = json.Unmarshal(responseRange.Value, &change)
+		if err != nil {
+			return fmt.Errorf("unmarshal composition change failed: %s", err.Error())
+		}
+		if !renameCompositionChange(&change, flatName, newName) {
+			continue
+		}
+		changeJson, err := json.Marshal(change)
+		if err != nil {
+			return err
+		}
+		_, keys, err := stub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 && keys[0] == flatName {
+			keys[0] = newName
+			err = stub.DelState(responseRange.Key)
+			if err != nil {
+				return err
+			}
+		}
+		changeKey, err := stub.CreateCompositeKey(MashupHistoryKey, keys)
+		if err != nil {
+			return fmt.Errorf("create composite key error: %s", err.Error())
+		}
+		err = stub.PutState(changeKey, changeJson)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renameCompositionChange renames a migrated service in a composition change,
+// as the mashup changed or as one of its components. It reports if anything is renamed.
+func renameCompositionChange(change *compositionChange, flatName string, newName string) bool {
+	renamed := false
+	if change.MashupName == flatName {
+		change.MashupName = newName
+		renamed = true
+	}
+	for _, composition := range []map[string]int{change.Old, change.New} {
+		if n, ok := composition[flatName]; ok {
+			delete(composition, flatName)
+			composition[newName] += n
+			renamed = true
+		}
+	}
+	for _, names := range [][]string{change.Added, change.Removed} {
+		for i := range names {
+			if names[i] == flatName {
+				names[i] = newName
+				renamed = true
+			}
+		}
+	}
+	return renamed
+}
+
+// moveServiceMarket moves the call time transfers of a migrated service, its resale orders and trades
+func (t *serviceChaincode) moveServiceMarket(stub shim.ChaincodeStubInterface, flatName string, newName string) error {
+	// the attribute the service name is at in the keys of each type
+	positions := map[string]int{TransferKey: 0, TransferLogKey: 1, SellOrderKey: 0, ResaleTradeKey: 0}
+	for _, objectType := range []string{TransferKey, TransferLogKey, SellOrderKey, ResaleTradeKey} {
+		err := t.renameServiceKeys(stub, objectType, positions[objectType], flatName, newName)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// =======================================================
+// setServiceQuota: limit how many calls each caller can
+// consume per hour and per day, 0 means unlimited
+// =======================================================
+func (t *serviceChaincode) setServiceQuota(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	per_hour, err := strconv.ParseInt(strings.TrimSpace(args[1]), 10, 64)
+	if err != nil || per_hour < 0 {
+		return shim.Error("2nd arg must be a non-negative integer")
+	}
+	per_day, err := strconv.ParseInt(strings.TrimSpace(args[2]), 10, 64)
+	if err != nil || per_day < 0 {
+		return shim.Error("3rd arg must be a non-negative integer")
+	}
+
+	serviceJSON, err := t.getDevelopedService(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	serviceJSON.QuotaPerHour = per_hour
+	serviceJSON.QuotaPerDay = per_day
+	err = t.saveService(stub, serviceJSON)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success([]byte("Set service quota success."))
+}
+
+// =======================================================
+// getQuota: get how many calls a caller can still consume
+// in the current hour and day windows
+// =======================================================
+func (t *serviceChaincode) getQuota(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var serviceJSON service
+
+	service_name, err := t.resolveServiceName(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	caller := strings.TrimSpace(args[1])
+	if len(caller) == 0 {
+		return shim.Error("2nd arg must be non-empty string")
+	}
+
+	time_stamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error("Can't get timestamp : " + err.Error())
+	}
+
+	serviceAsBytes, err := stub.GetState(ServicePrefix + service_name)
+	if err != nil {
+		return shim.Error("Fail to get service: " + err.Error())
+	} else if serviceAsBytes == nil {
+		return shim.Error("This service does not exist: " + service_name)
+	}
+	err = json.Unmarshal(serviceAsBytes, &serviceJSON)
+	if err != nil {
+		return shim.Error("Error unmarshal service bytes.")
+	}
+
+	usage, _, err := t.getQuotaUsage(stub, service_name, caller, time_stamp.Seconds)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	status := quotaStatus{service_name, caller, serviceJSON.QuotaPerHour, serviceJSON.QuotaPerDay,
+		usage.HourCalls, usage.DayCalls, -1, -1}
+	if serviceJSON.QuotaPerHour > 0 {
+		status.RemainingHour = serviceJSON.QuotaPerHour - usage.HourCalls
+		if status.RemainingHour < 0 {
+			status.RemainingHour = 0
+		}
+	}
+	if serviceJSON.QuotaPerDay > 0 {
+		status.RemainingDay = serviceJSON.QuotaPerDay - usage.DayCalls
+		if status.RemainingDay < 0 {
+			status.RemainingDay = 0
+		}
+	}
+	statusJson, err := json.Marshal(status)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(statusJson)
+}
+
+// =======================================================
+// setRevenueShare: share every payment for a mashup with the
+// developers of its components. "percent" of the payment is
+// split among the components by weight, the rest goes to the
+// mashup's developer.
+// =======================================================
+func (t *serviceChaincode) setRevenueShare(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	percent, err := strconv.ParseInt(strings.TrimSpace(args[1]), 10, 64)
+	if err != nil || percent < 0 || percent > 100 {
+		return shim.Error("2nd arg must be an integer between 0 and 100")
+	}
+
+	mashupJSON, err := t.getDevelopedService(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !mashupJSON.IsMashup {
+		return shim.Error("Not a mashup: " + mashupJSON.Name)
+	}
+
+	weights := make(map[string]int64)
+	for i := 2; i < len(args); i++ {
+		pair := strings.SplitN(args[i], "=", 2)
+		if len(pair) != 2 {
+			return shim.Error("Component weights must be given as \"component=weight\": " + args[i])
+		}
+		component_name, err := t.resolveServiceName(stub, pair[0])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if _, ok := mashupJSON.Composition[component_name]; !ok {
+			return shim.Error("Not a component of the mashup: " + pair[0])
+		}
+		weight, err := strconv.ParseInt(strings.TrimSpace(pair[1]), 10, 64)
+		if err != nil || weight < 0 {
+			return shim.Error("Component weight must be a non-negative integer: " + args[i])
+		}
+		weights[component_name] = weight
+	}
+
+	mashupJSON.ComponentShare = percent
+	mashupJSON.RevenueShare = weights
+	err = t.saveService(stub, mashupJSON)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success([]byte("Set revenue share success."))
+}
+
+// =======================================================
+// getPayouts: get the payouts a user received, optionally
+// only those for one service
+// =======================================================
+func (t *serviceChaincode) getPayouts(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	keys := []string{strings.TrimSpace(args[0])}
+	if len(args) > 1 && len(strings.TrimSpace(args[1])) > 0 {
+		service_name, err := t.resolveServiceName(stub, args[1])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		keys = append(keys, service_name)
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(PayoutKey, keys)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+	payouts := make([]*payoutRecord, 0)
+	for resultsIterator.HasNext() {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		payout := &payoutRecord{}
+		err = json.Unmarshal(responseRange.Value, payout)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		payouts = append(payouts, payout)
+	}
+	payoutsBytes, err := json.Marshal(payouts)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(payoutsBytes)
+}
+
+// =======================================================
+// setServiceVisibility: change who can find and use a service
+// =======================================================
+func (t *serviceChaincode) setServiceVisibility(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var service_name, visibility string
+
+	service_name = args[0]
+	visibility = strings.TrimSpace(args[1])
+	if visibility != V_Public && visibility != V_Unlisted && visibility != V_AllowList {
+		return shim.Error("Invalid visibility: " + visibility)
+	}
+
+	serviceJSON, err := t.getDevelopedService(stub, service_name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	serviceJSON.Visibility = visibility
+	err = t.saveService(stub, serviceJSON)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success([]byte("Set service visibility success."))
+}
+
+// =======================================================
+// updateServiceAllowList: add or remove users or organizations
+// from a service's allow-list
+// =======================================================
+func (t *serviceChaincode) updateServiceAllowList(stub shim.ChaincodeStubInterface, args []string, add bool) pb.Response {
+	var service_name, kind string
+
+	service_name = args[0]
+	kind = strings.TrimSpace(args[1])
+	if kind != AllowUser && kind != AllowOrganization {
+		return shim.Error("2nd arg must be \"" + AllowUser + "\" or \"" + AllowOrganization + "\"")
+	}
+
+	serviceJSON, err := t.getDevelopedService(stub, service_name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	list := serviceJSON.AllowUsers
+	if kind == AllowOrganization {
+		list = serviceJSON.AllowOrgs
+	}
+	for i := 2; i < len(args); i++ {
+		name := strings.TrimSpace(args[i])
+		if len(name) == 0 {
+			return shim.Error("Allow-list entries must be non-empty strings")
+		}
+		if add {
+			if kind == AllowUser {
+				userAsBytes, err := stub.GetState(UserPrefix + name)
+				if err != nil {
+					return shim.Error("Fail to get user: " + err.Error())
+				} else if userAsBytes == nil {
+					return shim.Error("This user does not exist: " + name)
+				}
+			}
+			if !containsString(list, name) {
+				list = append(list, name)
+			}
+		} else {
+			list = removeString(list, name)
+		}
+	}
+	if kind == AllowUser {
+		serviceJSON.AllowUsers = list
+	} else {
+		serviceJSON.AllowOrgs = list
+	}
+
+	err = t.saveService(stub, serviceJSON)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success([]byte("Update service allow-list success."))
+}
+
+// =======================================================
+// rewardService: reward a service
+// reward a service's developer, transfer fixed amount of
+// specific reward_type token to the developer's account.
+// =======================================================
+func (t *serviceChaincode) rewardService(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var service_name string
+	var reward_type string
+	var err error
+
+	service_name, err = t.resolveServiceName(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	reward_type = args[1]
+
+	// Amount
+	reward_amount := big.NewInt(0)
+	_, good := reward_amount.SetString(args[2], 10)
+	if !good {
+		return shim.Error("Expecting integer value for amount")
+	}
+
+	// STEP 0: get service's developer
+	service_key := ServicePrefix + service_name
+	serviceAsBytes, err := stub.GetState(service_key)
+	if err != nil {
+		return shim.Error("Fail to get the service's info.")
+	}
+
+	var serviceJSON service
+	err = json.Unmarshal([]byte(serviceAsBytes), &serviceJSON)
+	if err != nil {
+		return shim.Error("Error unmarshal service bytes.")
+	}
+
+	dev := serviceJSON.Developer
+
+	// STEP 1: get the address of the dev
+	user_key := UserPrefix + dev
+	userAsBytes, err := stub.GetState(user_key)
+	if err != nil {
+		return shim.Error("Fail to get the developer's info.")
+	}
+	var userJSON user
+	err = json.Unmarshal([]byte(userAsBytes), &userJSON)
+	if err != nil {
+		return shim.Error("Error unmarshal user bytes.")
+	}
+
+	// STEP 3: reward the developer
+	toAdd := userJSON.Address
+	err = stub.Transfer(toAdd, reward_type, reward_amount)
+	if err != nil {
+		return shim.Error("Fail realize the reawrd.")
+	}
+
+	return shim.Success([]byte("Reward the service success."))
+}
+
+// ========================================================================
+// queryServiceByRange: query services' by page and limit
+//
+// // page and limit are case-se
+// ========================================================================
+func (t *serviceChaincode) queryServiceByRange(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var page, limit int64
+	var err error
+	page, err = strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	limit, err = strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if limit == 0 {
+		limit = 10
+	}
+	if page <= 0 {
+		page = 1
+	}
+	start := (page - 1) * limit
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(UserServicesKey, []string{})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	services := make([]*service, 0)
+	// only public services are listed
+	for i := int64(0); resultsIterator.HasNext(); {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		service := &service{}
+		err = json.Unmarshal(responseRange.Value, service)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if serviceVisibility(*service) != V_Public {
+			continue
+		}
+		if i >= start && i < start+limit {
+			service.License = serviceLicense(*service)
+			service.Resource = ""
+			services = append(services, service)
+		} else if i >= start+limit {
+			break
+		}
+		i++
+	}
+	servicesBytes, err := json.Marshal(services)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(servicesBytes)
+}
+
+// ========================================================================
+// saveServiceByUserName: save service with key which include user name and service name
+//
+// userName are required
+// serviceName are required
+// ========================================================================
+func (t *serviceChaincode) saveServiceByUserName(stub shim.ChaincodeStubInterface, userName string, serviceName string, state []byte) error {
+	compositeKey, err := stub.CreateCompositeKey(UserServicesKey, []string{userName, serviceName})
+	if err != nil {
+		return fmt.Errorf(fmt.Sprintf("create composite key error: %s", err.Error()))
+	}
+	err = stub.PutState(compositeKey, state)
+	if err != nil {
+		return fmt.Errorf(fmt.Sprintf("save error: %s", err.Error()))
+	}
+	return nil
+}
+
+// ========================================================================
+// queryServiceByUser: query services' names by user name (name)
+//
+// name are case-sensitive
+// use "" for both name if you want to query all the assets
+// ========================================================================
+func (t *serviceChaincode) queryServiceByUser(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var page, limit int64
+	var err error
+	page, err = strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	limit, err = strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if limit == 0 {
+		limit = 10
+	}
+	if page <= 0 {
+		page = 1
+	}
+	start := (page - 1) * limit
+
+	// the user sees all of their own services, others only see the public ones
+	own := false
+	sender, err := stub.GetSender()
+	if err == nil {
+		userAsBytes, err := stub.GetState(UserPrefix + sender)
+		if err == nil && userAsBytes != nil {
+			var userJSON user
+			err = json.Unmarshal(userAsBytes, &userJSON)
+			own = err == nil && userJSON.Name == args[2]
+		}
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(UserServicesKey, []string{args[2]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	services := make([]*service, 0)
+	for i := int64(0); resultsIterator.HasNext(); {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		service := &service{}
+		err = json.Unmarshal(responseRange.Value, service)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if !own && serviceVisibility(*service) != V_Public {
+			continue
+		}
+		if i >= start && i < start+limit {
+			service.License = serviceLicense(*service)
+			service.Resource = ""
+			services = append(services, service)
+		} else if i >= start+limit {
+			break
+		}
+		i++
+	}
+	servicesBytes, err := json.Marshal(services)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(servicesBytes)
+}
+
+// ========================================================================
+// callService: pay tokens to buy one service call times
+//
+// serviceName and callTimes are required
+// ========================================================================
+func (t *serviceChaincode) callService(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var service_name, sender string
+	call_times := big.NewInt(0)
+	var service_data service
+	var user_data user
+	var err error
+
+	time_stamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error("Can't get timestamp : " + err.Error())
+	}
+
+	sender, err = stub.GetSender()
+	if err != nil {
+		return shim.Error("Failed to get sender : " + err.Error())
+	}
+
+	// a retry of a request processed before gets its result
+	request_id := ""
+	if len(args) > 3 {
+		request_id = strings.TrimSpace(args[3])
+	}
+	if request_id != "" {
+		result, err := t.getProcessedRequest(stub, sender, CallService, request_id, args[:3])
+		if err != nil {
+			return shim.Error(err.Error())
+		} else if result != nil {
+			return shim.Success(result)
+		}
+	}
+
+	service_name = strings.TrimSpace(args[0])
+	if len(service_name) <= 0 {
+		return shim.Error("1st arg must be non-empty string")
+	}
+	service_name, err = t.resolveServiceName(stub, service_name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	call_time_str := strings.TrimSpace(args[1])
+	call_times, ok := big.NewInt(0).SetString(call_time_str, 10)
+	if !ok || call_times.Sign() <= 0 {
+		return shim.Error("2th arg must be positive integer")
+	}
+
+	userAsJson, err := stub.GetState(UserPrefix + sender)
+	if err != nil {
+		return shim.Error("Get user info failed: " + err.Error())
+	} else if userAsJson == nil {
+		return shim.Error("User not registered")
+	}
+	err = json.Unmarshal(userAsJson, &user_data)
+	if err != nil {
+		return shim.Error("Unmarshal user info failed: " + err.Error())
+	}
+
+	serviceJson, err := stub.GetState(ServicePrefix + service_name)
+	if err != nil {
+		return shim.Error("Get service info failed : " + err.Error())
+	} else if serviceJson == nil {
+		return shim.Error("Service not exists")
+	}
+	service_data = service{}
+	err = json.Unmarshal(serviceJson, &service_data)
+	if err != nil {
+		return shim.Error("Unmarshal service info failed: " + err.Error())
+	}
+	if service_data.Status != S_Available {
+		return shim.Error("Service not invalid")
+	}
+	if !canAccessService(service_data, user_data) {
+		return shim.Error("Service not accessible")
+	}
+
+	bundle := ""
+	if len(args) > 2 {
+		bundle = strings.TrimSpace(args[2])
+		if bundle != "" && bundle != BundleDeveloper && bundle != BundleBuyer {
+			return shim.Error("3rd arg must be \"" + BundleDeveloper + "\" or \"" + BundleBuyer + "\"")
+		}
+		if bundle != "" && !service_data.IsMashup {
+			return shim.Error("Only a mashup's call times can be bought with its components'")
+		}
+	}
+
+	// with a bundle, the cost of the component calls is paid for the components' call times
+	price := service_data.Price
+	if bundle != "" {
+		price = bundleMargin(service_data)
+	}
+	payments := make(map[string]*big.Int)
+	buy_record, err := t.buyCallTimes(stub, service_data, user_data, user_data.Name, call_times, price, payments, formatTime(time_stamp.Seconds), time_stamp.Seconds)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// buy the call times the mashup needs on the services it composes, in the same transaction;
+	// a nested mashup is charged its margin, as the services it composes are bought too
+	if bundle != "" {
+		beneficiary := user_data
+		if bundle == BundleDeveloper {
+			developerAsBytes, err := stub.GetState(UserPrefix + service_data.Developer)
+			if err != nil {
+				return shim.Error("Fail to get the developer's info.")
+			} else if developerAsBytes == nil {
+				return shim.Error("This user doesn't exist: " + service_data.Developer)
+			}
+			err = json.Unmarshal(developerAsBytes, &beneficiary)
+			if err != nil {
+				return shim.Error("Error unmarshal developer bytes.")
+			}
+		}
+		root, err := t.resolveMashupTree(stub, service_data.Name, 1, 1, make(map[string]bool), 0)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		// a service composed in several places is bought once for all its calls
+		bundle_calls := make(map[string]*big.Int)
+		collectBundleCalls(root, call_times, bundle_calls)
+		names := make(map[string]int)
+		for k := range bundle_calls {
+			names[k] = 1
+		}
+		components, err := t.getComponents(stub, names)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		for _, component := range components {
+			if component.Status != S_Available {
+				return shim.Error("Service not available: " + component.Name)
+			}
+			if !canAccessService(component, beneficiary) {
+				return shim.Error("Service not accessible: " + component.Name)
+			}
+			component_price := component.Price
+			if component.IsMashup {
+				component_price = bundleMargin(component)
+			}
+			_, err = t.buyCallTimes(stub, component, beneficiary, user_data.Name, bundle_calls[component.Name], component_price, payments, formatTime(time_stamp.Seconds), time_stamp.Seconds)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+		}
+	}
+	// a user earning from several of the services bought is paid once
+	err = t.transferToUsers(stub, payments)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	user_data.TotalCallTimes = user_data.TotalCallTimes + int(call_times.Int64())
+	err = t.updateUser(user_data, stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	result, err := json.Marshal(buy_record)
+	if err != nil {
+		return shim.Error("Marshal buy record failed: " + err.Error())
+	}
+	if request_id != "" {
+		err = t.saveProcessedRequest(stub, sender, CallService, request_id, args[:3], result, formatTime(time_stamp.Seconds))
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	return shim.Success(result)
+}
+
+// ========================================================================
+// buyCallTimes: the sender, user "payer", buys "callTimes" call times of
+// service "s" at "price" per call, which are added to the call times of
+// user "buyer" as a new lot. The fee is split by the service's revenue
+// terms and added to "payments", for the caller to pay at once; the lot
+// keeps the fee and the terms, which its refund is owed by.
+// It returns the buy record of the purchase.
+// ========================================================================
+func (t *serviceChaincode) buyCallTimes(stub shim.ChaincodeStubInterface, s service, buyer user, payer string, callTimes *big.Int, price *big.Int, payments map[string]*big.Int, createTime string, seconds int64) (buyRecord, error) {
+	var record serviceCallTime
+	var purchase buyRecord
+
+	total := big.NewInt(0).Mul(price, callTimes)
+	// the lot keeps the revenue terms the call times are bought with
+	terms, err := t.getRevenueTerms(stub, s)
+	if err != nil {
+		return purchase, err
+	}
+	lot := callTimeLot{stub.GetTxID(), callTimes, total, seconds, 0, terms}
+	if s.ValidityPeriod > 0 {
+		lot.ExpiresAt = seconds + s.ValidityPeriod
+	}
+	recordKey := ServiceCallTimesPrefix + s.Name + buyer.Name
+	callTimesJson, err := stub.GetState(recordKey)
+	if err != nil {
+		return purchase, fmt.Errorf("get old call times log failed: %s", err.Error())
+	} else if callTimesJson != nil {
+		err = json.Unmarshal(callTimesJson, &record)
+		if err != nil {
+			return purchase, fmt.Errorf("unmarshal old call times log failed: %s", err.Error())
+		}
+		normalizeLots(&record)
+		record.Lots = append(record.Lots, lot)
+		sumLots(&record)
+		record.UpdateTime = createTime
+		record.Total = big.NewInt(0).Add(total, record.Total)
+		record.BoughtAt = seconds
+	} else {
+		record = serviceCallTime{s.Name, buyer.Name, buyer.Address, callTimes, total, total, seconds, []callTimeLot{lot}, createTime, createTime}
+	}
+
+	recordJson, err := json.Marshal(record)
+	if err != nil {
+		return purchase, fmt.Errorf("marshal call time info failed: %s", err.Error())
+	}
+
+	shares := splitRevenue(s.Developer, *terms, total)
+	err = t.recordPayouts(stub, s.Name, payer, shares, createTime)
+	if err != nil {
+		return purchase, err
+	}
+	for k, v := range shares {
+		if payments[k] == nil {
+			payments[k] = big.NewInt(0)
+		}
+		payments[k].Add(payments[k], v)
+	}
+	err = stub.PutState(recordKey, recordJson)
+	if err != nil {
+		return purchase, fmt.Errorf("failed to save call time info: %s", err.Error())
+	}
+
+	purchase = buyRecord{recordKey, s.Name, buyer.Name, stub.GetTxID(), callTimes, total, createTime, false}
+	buyRecordJson, err := json.Marshal(purchase)
+	if err != nil {
+		return purchase, fmt.Errorf("marshal buy record failed: %s", err.Error())
+	}
+	buyRecordKey := BuyRecordPrefix + s.Name + buyer.Name + stub.GetTxID()
+	err = stub.PutState(buyRecordKey, buyRecordJson)
+	if err != nil {
+		return purchase, fmt.Errorf("save buy record failed: %s", err.Error())
+	}
+	err = t.indexRecord(stub, UserPurchaseKey, ServicePurchaseKey, buyer.Name, s.Name, seconds, stub.GetTxID(), buyRecordJson)
+	if err != nil {
+		return purchase, err
+	}
+	return purchase, t.saveCallTimesByServiceName(stub, s.Name, recordKey, recordJson)
+}
+
+// ========================================================================
+// saveCallTimesByServiceName: save callTime record with key which include service name and call time key
+//
+// serviceName are required
+// recordKey are required
+// ========================================================================
+func (t *serviceChaincode) saveCallTimesByServiceName(stub shim.ChaincodeStubInterface, serviceName string, recordKey string, state []byte) error {
+	compositeKey, err := stub.CreateCompositeKey(CallTimeKey, []string{serviceName, recordKey})
+	if err != nil {
+		return fmt.Errorf(fmt.Sprintf("create composite key error: %s", err.Error()))
+	}
+	err = stub.PutState(compositeKey, state)
+	if err != nil {
+		return fmt.Errorf(fmt.Sprintf("save error: %s", err.Error()))
+	}
+	return nil
+}
+
+// ========================================================================
+// getCallTimes: query callTimes by service name
+//
+// name are case-sensitive
+// use "" for both name if you want to query all the assets
+// ========================================================================
+func (t *serviceChaincode) getCallTimes(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	if len(args[0]) > 0 {
+		args[0], err = t.resolveServiceName(stub, args[0])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(CallTimeKey, args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	callTimes := make([]*serviceCallTime, 0)
+	for i := 0; resultsIterator.HasNext(); i++ {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		callTime := &serviceCallTime{}
+		err = json.Unmarshal(responseRange.Value, callTime)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		callTimes = append(callTimes, callTime)
+	}
+	callTimesBytes, err := json.Marshal(callTimes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(callTimesBytes)
+}
+
+// ========================================================================
+// getCallTime: query some one has buy service's call times
+//
+// serviceName and userName are required
+// ========================================================================
+func (t *serviceChaincode) getCallTime(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var service_name, user_name string
+	var err error
+
+	service_name = strings.TrimSpace(args[0])
+	if len(service_name) <= 0 {
+		return shim.Error("1st arg must be non-empty string")
+	}
+	service_name, err = t.resolveServiceName(stub, service_name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	user_name = strings.TrimSpace(args[1])
+	if len(user_name) <= 0 {
+		return shim.Error("2st arg must be non-empty string")
+	}
+
+	record_key := ServiceCallTimesPrefix + service_name + user_name
+	callTimeJson, err := stub.GetState(record_key)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if callTimeJson == nil {
+		return shim.Error("User " + user_name + " have never buy service call times")
+	}
+	return shim.Success(callTimeJson)
+}
+
+// ========================================================================
+// reduceCallTime: reduce user's service call times
+//
+// serviceName, userName and reduceTime are required
+// ========================================================================
+func (t *serviceChaincode) reduceCallTime(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var service_name, sender, caller string
+	var reduce_time *big.Int
+	var service_data service
+	var user_data user
+	var err error
+
+	time_stamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error("Can't get timestamp : " + err.Error())
+	}
+
+	sender, err = stub.GetSender()
+	if err != nil {
+		return shim.Error("Failed to get sender : " + err.Error())
+	}
+
+	// a retry of a request processed before gets its result
+	request_id := ""
+	if len(args) > 3 {
+		request_id = strings.TrimSpace(args[3])
+	}
+	if request_id != "" {
+		result, err := t.getProcessedRequest(stub, sender, ReduceCallTime, request_id, args[:3])
+		if err != nil {
+			return shim.Error(err.Error())
+		} else if result != nil {
+			return shim.Success(result)
+		}
+	}
+
+	service_name = strings.TrimSpace(args[0])
+	if len(service_name) == 0 {
+		return shim.Error("1st arg must be non-empty string")
+	}
+	service_name, err = t.resolveServiceName(stub, service_name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	caller = strings.TrimSpace(args[1])
+	if len(caller) == 0 {
+		return shim.Error("2st arg must be non-empty string")
+	}
+	reduce_time_str := strings.TrimSpace(args[2])
+	reduce_time, ok := big.NewInt(0).SetString(reduce_time_str, 10)
+	if !ok || reduce_time.Sign() <= 0 {
+		return shim.Error("3th arg must be positive integer")
+	}
+
+	userAsJson, err := stub.GetState(UserPrefix + sender)
+	if err != nil {
+		return shim.Error("Get user info failed: " + err.Error())
+	} else if userAsJson == nil {
+		return shim.Error("User not registered")
+	}
+	err = json.Unmarshal(userAsJson, &user_data)
+	if err != nil {
+		return shim.Error("Unmarshal user info failed: " + err.Error())
+	}
+
+	service_key := ServicePrefix + service_name
+	serviceAsBytes, err := stub.GetState(service_key)
+	if err != nil {
+		return shim.Error("Fail to get service: " + err.Error())
+	} else if serviceAsBytes == nil {
+		return shim.Error("This service does not exist: " + service_name)
+	}
+	err = json.Unmarshal(serviceAsBytes, &service_data)
+	if err != nil {
+		return shim.Error("Fail to unmarshal service data")
+	} else if service_data.Developer != user_data.Name {
+		return shim.Error("Service not developed by you")
+	}
+
+	reduce_record, err := t.consumeCallTimes(stub, service_data, caller, reduce_time, formatTime(time_stamp.Seconds), time_stamp.Seconds)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	user_data.TotalInvokeTimes = user_data.TotalInvokeTimes + int(reduce_time.Int64())
+	err = t.updateUser(user_data, stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	result, err := json.Marshal(reduce_record)
+	if err != nil {
+		return shim.Error("Marshal reduce info failed : " + err.Error())
+	}
+	if request_id != "" {
+		err = t.saveProcessedRequest(stub, sender, ReduceCallTime, request_id, args[:3], result, formatTime(time_stamp.Seconds))
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	return shim.Success(result)
+}
+
+// ========================================================================
+// reduceCallTimes: reduce the call times of many callers of the sender's
+// services at once, all of them are reduced or none. Entries of the same
+// service and caller are added up.
+//
+// a JSON list of {"service", "caller", "count"} is required, requestId is optional
+// ========================================================================
+func (t *serviceChaincode) reduceCallTimes(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var entries []reduceEntry
+	var user_data user
+
+	time_stamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error("Can't get timestamp : " + err.Error())
+	}
+	sender, err := stub.GetSender()
+	if err != nil {
+		return shim.Error("Failed to get sender : " + err.Error())
+	}
+
+	// a retry of a request processed before gets its result
+	request_id := ""
+	if len(args) > 1 {
+		request_id = strings.TrimSpace(args[1])
+	}
+	if request_id != "" {
+		result, err := t.getProcessedRequest(stub, sender, ReduceCallTimes, request_id, args[:1])
+		if err != nil {
+			return shim.Error(err.Error())
+		} else if result != nil {
+			return shim.Success(result)
+		}
+	}
+
+	err = json.Unmarshal([]byte(args[0]), &entries)
+	if err != nil {
+		return shim.Error("1st arg must be a JSON list of reduce entries: " + err.Error())
+	} else if len(entries) == 0 {
+		return shim.Error("No reduce entries")
+	}
+	userAsJson, err := stub.GetState(UserPrefix + sender)
+	if err != nil {
+		return shim.Error("Get user info failed: " + err.Error())
+	} else if userAsJson == nil {
+		return shim.Error("User not registered")
+	}
+	err = json.Unmarshal(userAsJson, &user_data)
+	if err != nil {
+		return shim.Error("Unmarshal user info failed: " + err.Error())
+	}
+
+	// STEP 1: validate the entries and add up those of the same service and caller
+	services := make(map[string]service)
+	merged := make([]reduceEntry, 0, len(entries))
+	index := make(map[string]int)
+	for i, entry := range entries {
+		entry.Caller = strings.TrimSpace(entry.Caller)
+		if len(entry.Caller) == 0 {
+			return shim.Error(fmt.Sprintf("Entry %d: caller must be non-empty string", i))
+		}
+		if entry.Count == nil || entry.Count.Sign() <= 0 {
+			return shim.Error(fmt.Sprintf("Entry %d: count must be positive integer", i))
+		}
+		service_name, err := t.resolveServiceName(stub, strings.TrimSpace(entry.ServiceName))
+		if err != nil {
+			return shim.Error(fmt.Sprintf("Entry %d: %s", i, err.Error()))
+		}
+		if _, ok := services[service_name]; !ok {
+			serviceAsBytes, err := stub.GetState(ServicePrefix + service_name)
+			if err != nil {
+				return shim.Error("Fail to get service: " + err.Error())
+			} else if serviceAsBytes == nil {
+				return shim.Error("This service does not exist: " + service_name)
+			}
+			var service_data service
+			err = json.Unmarshal(serviceAsBytes, &service_data)
+			if err != nil {
+				return shim.Error("Fail to unmarshal service data")
+			} else if service_data.Developer != user_data.Name {
+				return shim.Error("Service not developed by you: " + service_name)
+			}
+			services[service_name] = service_data
+		}
+		entry.ServiceName = service_name
+		key := service_name + "\x00" + entry.Caller
+		if j, ok := index[key]; ok {
+			merged[j].Count = new(big.Int).Add(merged[j].Count, entry.Count)
+			continue
+		}
+		index[key] = len(merged)
+		merged = append(merged, entry)
+	}
+
+	// STEP 2: reduce the call times
+	records := make([]reduceRecord, 0, len(merged))
+	total := big.NewInt(0)
+	for _, entry := range merged {
+		record, err := t.consumeCallTimes(stub, services[entry.ServiceName], entry.Caller, entry.Count, formatTime(time_stamp.Seconds), time_stamp.Seconds)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("Reduce %s of %s failed: %s", entry.ServiceName, entry.Caller, err.Error()))
+		}
+		records = append(records, record)
+		total.Add(total, entry.Count)
+	}
+
+	user_data.TotalInvokeTimes = user_data.TotalInvokeTimes + int(total.Int64())
+	err = t.updateUser(user_data, stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	recordsBytes, err := json.Marshal(records)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if request_id != "" {
+		err = t.saveProcessedRequest(stub, sender, ReduceCallTimes, request_id, args[:1], recordsBytes, formatTime(time_stamp.Seconds))
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	return shim.Success(recordsBytes)
+}
+
+// ========================================================================
+// queryHistory: query the buy or reduce records indexed by "userIndex" and
+// "serviceIndex", by user and/or service, within a time range, a page at a time
+//
+// userName or serviceName is required, from, to, pageSize and bookmark are optional
+// ========================================================================
+func (t *serviceChaincode) queryHistory(stub shim.ChaincodeStubInterface, args []string, userIndex string, serviceIndex string) pb.Response {
+	var err error
+	user_name := strings.TrimSpace(args[0])
+	service_name := strings.TrimSpace(args[1])
+	if len(service_name) > 0 {
+		service_name, err = t.resolveServiceName(stub, service_name)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	// the time range and page, as optional args
+	optional := make([]string, 4)
+	copy(optional, args[2:])
+	from, to := int64(0), int64(math.MaxInt64)
+	page_size := 100
+	if s := strings.TrimSpace(optional[0]); s != "" {
+		from, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return shim.Error("3rd arg must be unix time")
+		}
+	}
+	if s := strings.TrimSpace(optional[1]); s != "" {
+		to, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return shim.Error("4th arg must be unix time")
+		}
+	}
+	if s := strings.TrimSpace(optional[2]); s != "" {
+		page_size, err = strconv.Atoi(s)
+		if err != nil || page_size <= 0 {
+			return shim.Error("5th arg must be positive integer")
+		}
+	}
+	bookmark := strings.TrimSpace(optional[3])
+
+	// records of a user are indexed by [user, service, time, tx],
+	// records of a service by [service, time, user, tx]
+	index, keys, time_attr := userIndex, []string{user_name}, 2
+	if len(user_name) == 0 {
+		if len(service_name) == 0 {
+			return shim.Error("User name or service name is required")
+		}
+		index, keys, time_attr = serviceIndex, []string{service_name}, 1
+	} else if len(service_name) > 0 {
+		keys = append(keys, service_name)
+	}
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(index, keys)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	page := historyPage{make([]json.RawMessage, 0), ""}
+	for resultsIterator.HasNext() {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if bookmark != "" && responseRange.Key <= bookmark {
+			continue
+		}
+		_, attrs, err := stub.SplitCompositeKey(responseRange.Key)
+		if err != nil || len(attrs) <= time_attr {
+			continue
+		}
+		seconds, err := strconv.ParseInt(attrs[time_attr], 10, 64)
+		if err != nil || seconds < from || seconds > to {
+			continue
+		}
+		if len(page.Records) == page_size {
+			page.Bookmark = bookmark
+			break
+		}
+		page.Records = append(page.Records, json.RawMessage(responseRange.Value))
+		bookmark = responseRange.Key
+	}
+	pageBytes, err := json.Marshal(page)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(pageBytes)
+}
+
+// ========================================================================
+// indexHistory: index the buy and reduce records saved before they were
+// indexed by user and service, only the admin account can invoke it.
+// Records indexed already are skipped, so it can be invoked again safely.
+// ========================================================================
+func (t *serviceChaincode) indexHistory(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	err := t.checkAdmin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	indexed := 0
+	for _, prefix := range []string{BuyRecordPrefix, ReduceRecordPrefix} {
+		resultsIterator, err := stub.GetStateByRange(prefix, prefix+"~")
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		for resultsIterator.HasNext() {
+			responseRange, err := resultsIterator.Next()
+			if err != nil {
+				resultsIterator.Close()
+				return shim.Error(err.Error())
+			}
+			// the keys are prefix + service + user + tx id,
+			// or + unix time for the records saved before
+			var user_name, service_name, tx_id, create_time string
+			var user_index, service_index string
+			if prefix == BuyRecordPrefix {
+				var record buyRecord
+				err = json.Unmarshal(responseRange.Value, &record)
+				if err != nil {
+					continue
+				}
+				user_name, service_name = record.UserName, record.ServiceName
+				tx_id, create_time = record.TxID, record.CreateTime
+				user_index, service_index = UserPurchaseKey, ServicePurchaseKey
+			} else {
+				var record reduceRecord
+				err = json.Unmarshal(responseRange.Value, &record)
+				if err != nil {
+					continue
+				}
+				user_name = record.Caller
+				if user_name == "" {
+					user_name = strings.TrimPrefix(record.ServiceCallTimeKey, ServiceCallTimesPrefix+record.ServiceName)
+				}
+				service_name = record.ServiceName
+				tx_id, create_time = record.TxID, record.CreateTime
+				user_index, service_index = UserConsumeKey, ServiceConsumeKey
+			}
+			key_head := prefix + service_name + user_name
+			if !strings.HasPrefix(responseRange.Key, key_head) {
+				continue
+			}
+			var seconds int64
+			var ok bool
+			if tx_id != "" {
+				seconds, ok = parseRecordTime(create_time)
+			} else {
+				seconds, err = strconv.ParseInt(responseRange.Key[len(key_head):], 10, 64)
+				ok = err == nil
+			}
+			if !ok {
+				continue
+			}
+			exists, err := t.isIndexed(stub, user_index, user_name, service_name, seconds, tx_id)
+			if err != nil {
+				resultsIterator.Close()
+				return shim.Error(err.Error())
+			} else if exists {
+				continue
+			}
+			err = t.indexRecord(stub, user_index, service_index, user_name, service_name, seconds, tx_id, responseRange.Value)
+			if err != nil {
+				resultsIterator.Close()
+				return shim.Error(err.Error())
+			}
+			indexed++
+		}
+		resultsIterator.Close()
+	}
+	return shim.Success([]byte(fmt.Sprintf("%d records indexed.", indexed)))
+}
+
+// ========================================================================
+// migrateTimes: convert the times of the records saved before the
+// transaction time was used, only the admin account can invoke it.
+// Services were stamped in time.UnixDate and other records with the
+// transaction timestamp's text, they are all stored in RFC 3339 now.
+//
+// key prefixes or composite key types are optional, all records if none
+// ========================================================================
+func (t *serviceChaincode) migrateTimes(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	err := t.checkAdmin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// every kind of record, the ones that are not JSON or have no times are left as they are
+	prefixes := []string{UserPrefix, ServicePrefix, ServiceCallTimesPrefix, BuyRecordPrefix, ReduceRecordPrefix,
+		RefundRecordPrefix, ResourcePrefix, ServiceAliasPrefix}
+	compositeTypes := []string{UserServicesKey, CallTimeKey, BuyerResourceKey, QuotaUsageKey, PayoutKey,
+		DependencyKey, MashupHistoryKey, UserPurchaseKey, ServicePurchaseKey, UserConsumeKey, ServiceConsumeKey,
+		RequestKey, ArbitratorKey, DisputeKey, RefundDueKey, TransferKey, TransferLogKey, SellOrderKey,
+		ResaleTradeKey, UsageSettlementKey}
+	if len(args) > 0 {
+		selected := make([]string, 0, len(args))
+		for _, arg := range args {
+			selected = append(selected, strings.TrimSpace(arg))
+		}
+		prefixes = selectStrings(prefixes, selected)
+		compositeTypes = selectStrings(compositeTypes, selected)
+	}
+
+	migrated := 0
+	for i := 0; i < len(prefixes)+len(compositeTypes); i++ {
+		var resultsIterator shim.StateQueryIteratorInterface
+		if i < len(prefixes) {
+			resultsIterator, err = stub.GetStateByRange(prefixes[i], prefixes[i]+"~")
+		} else {
+			resultsIterator, err = stub.GetStateByPartialCompositeKey(compositeTypes[i-len(prefixes)], []string{})
+		}
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		for resultsIterator.HasNext() {
+			responseRange, err := resultsIterator.Next()
+			if err != nil {
+				resultsIterator.Close()
+				return shim.Error(err.Error())
+			}
+			value, changed, err := migrateRecordTimes(responseRange.Value)
+			if err != nil || !changed {
+				continue
+			}
+			err = stub.PutState(responseRange.Key, value)
+			if err != nil {
+				resultsIterator.Close()
+				return shim.Error(err.Error())
+			}
+			migrated++
+		}
+		resultsIterator.Close()
+	}
+	return shim.Success([]byte(fmt.Sprintf("%d records migrated.", migrated)))
+}
+
+// ========================================================================
+// migrateResources: move the resources of the services registered before
+// resources were stored apart out of their public records, only the admin
+// account can invoke it. They are kept unencrypted and given to buyers as
+// they are, until the developers store them encrypted with editService.
+// ========================================================================
+func (t *serviceChaincode) migrateResources(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	err := t.checkAdmin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	resultsIterator, err := stub.GetStateByRange(ServicePrefix, ServicePrefix+"~")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+	migrated := 0
+	for resultsIterator.HasNext() {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		var service_data service
+		err = json.Unmarshal(responseRange.Value, &service_data)
+		if err != nil || service_data.Resource == "" {
+			continue
+		}
+		err = t.saveService(stub, service_data)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		migrated++
+	}
+	return shim.Success([]byte(fmt.Sprintf("%d resources migrated.", migrated)))
+}
+
+// ========================================================================
+// consumeCallTimes: reduce "calls" of the call times of "caller" of service
+// "s", the lots expiring first are consumed first. The reduce record keeps
+// the fee paid for the calls, which a dispute restores them with.
+// ========================================================================
+func (t *serviceChaincode) consumeCallTimes(stub shim.ChaincodeStubInterface, s service, caller string, calls *big.Int, createTime string, seconds int64) (reduceRecord, error) {
+	var callTime serviceCallTime
+	var reduction reduceRecord
+
+	callTimeKey := ServiceCallTimesPrefix + s.Name + caller
+	callTimeJson, err := stub.GetState(callTimeKey)
+	if err != nil {
+		return reduction, fmt.Errorf("get call time info failed: %s", err.Error())
+	} else if callTimeJson == nil {
+		return reduction, fmt.Errorf("have not buy this service call time")
+	}
+	err = json.Unmarshal(callTimeJson, &callTime)
+	if err != nil {
+		return reduction, fmt.Errorf("unmarshal call time info failed: %s", err.Error())
+	}
+
+	if availableCallTimes(&callTime, seconds, nil).Cmp(calls) < 0 {
+		return reduction, fmt.Errorf("have not enough call times")
+	}
+	// check and count the caller's quota
+	err = t.consumeQuota(stub, s, caller, calls.Int64(), seconds)
+	if err != nil {
+		return reduction, err
+	}
+	// consume the lots expiring first
+	lots := splitLots(&callTime, calls, seconds, nil)
+	callTime.UpdateTime = createTime
+	err = t.saveCallTimeRecord(stub, callTime)
+	if err != nil {
+		return reduction, err
+	}
+	paid := big.NewInt(0)
+	for _, lot := range lots {
+		paid.Add(paid, lot.Paid)
+	}
+
+	reduction = reduceRecord{s.Name, callTimeKey, s.Developer, calls, createTime, paid, caller, stub.GetTxID(), false}
+	err = t.saveReduceRecord(stub, reduction, seconds)
+	if err != nil {
+		return reduction, err
+	}
+	return reduction, nil
+}
+
+// saveReduceRecord saves the reduce record of the transaction and indexes it by caller and service,
+// a reduce record is keyed by its transaction, those before by the unix time
+func (t *serviceChaincode) saveReduceRecord(stub shim.ChaincodeStubInterface, record reduceRecord, seconds int64) error {
+	reduceJson, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("marshal reduce info failed: %s", err.Error())
+	}
+	err = stub.PutState(ReduceRecordPrefix+record.ServiceName+record.Caller+record.TxID, reduceJson)
+	if err != nil {
+		return fmt.Errorf("save reduce info failed: %s", err.Error())
+	}
+	return t.indexRecord(stub, UserConsumeKey, ServiceConsumeKey, record.Caller, record.ServiceName, seconds, record.TxID, reduceJson)
+}
+
+// ========================================================================
+// setRefundPolicy: set how the unused call times of a service are refunded
+//
+// serviceName and policy are required, "prorated" requires the refunded
+// percentage and "windowed" the window in seconds
+// ========================================================================
+func (t *serviceChaincode) setRefundPolicy(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	policy := strings.TrimSpace(args[1])
+	param := int64(0)
+	switch policy {
+	case R_None, R_Full:
+	case R_ProRated, R_Windowed:
+		if len(args) < 3 {
+			return shim.Error("Refund policy " + policy + " requires a 3rd arg")
+		}
+		var err error
+		param, err = strconv.ParseInt(strings.TrimSpace(args[2]), 10, 64)
+		if err != nil || param < 0 || (policy == R_ProRated && param > 100) {
+			return shim.Error("3rd arg must be a non-negative integer, at most 100 for a percentage")
+		}
+	default:
+		return shim.Error("Invalid refund policy: " + policy)
+	}
+
+	serviceJSON, err := t.getDevelopedService(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	serviceJSON.RefundPolicy = policy
+	serviceJSON.RefundPercent = 0
+	serviceJSON.RefundWindow = 0
+	if policy == R_ProRated {
+		serviceJSON.RefundPercent = param
+	} else if policy == R_Windowed {
+		serviceJSON.RefundWindow = param
+	}
+	err = t.saveService(stub, serviceJSON)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte("Set refund policy success."))
+}
+
+// ========================================================================
+// requestRefund: give back unused call times of a service, the fee paid
+// for them is refunded to the buyer by the service's refund policy. The fee
+// was paid to the developers at purchase, so every user it was paid to owes
+// their part of the refund (see refundDue); the part owed by the sender is
+// paid in the same transaction. The developer can refund a buyer, paying
+// the part they owe at once.
+//
+// serviceName is required, callTimes defaults to all the call times left,
+// buyerName is only given by the developer
+// ========================================================================
+func (t *serviceChaincode) requestRefund(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var service_data service
+	var sender_data, user_data user
+	var call_time serviceCallTime
+
+	time_stamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error("Can't get timestamp : " + err.Error())
+	}
+	sender, err := stub.GetSender()
+	if err != nil {
+		return shim.Error("Failed to get sender : " + err.Error())
+	}
+	userAsJson, err := stub.GetState(UserPrefix + sender)
+	if err != nil {
+		return shim.Error("Get user info failed: " + err.Error())
+	} else if userAsJson == nil {
+		return shim.Error("User not registered")
+	}
+	err = json.Unmarshal(userAsJson, &sender_data)
+	if err != nil {
+		return shim.Error("Unmarshal user info failed: " + err.Error())
+	}
+
+	service_name, err := t.resolveServiceName(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	serviceAsBytes, err := stub.GetState(ServicePrefix + service_name)
+	if err != nil {
+		return shim.Error("Fail to get service: " + err.Error())
+	} else if serviceAsBytes == nil {
+		return shim.Error("This service does not exist: " + service_name)
+	}
+	err = json.Unmarshal(serviceAsBytes, &service_data)
+	if err != nil {
+		return shim.Error("Fail to unmarshal service data")
+	}
+
+	// the developer refunds the buyer given, buyers refund themselves
+	user_data = sender_data
+	if len(args) > 2 && strings.TrimSpace(args[2]) != "" && strings.TrimSpace(args[2]) != sender_data.Name {
+		if service_data.Developer != sender_data.Name {
+			return shim.Error("Authority err! Not invoked by the service's developer.")
+		}
+		buyerAsJson, err := stub.GetState(UserPrefix + strings.TrimSpace(args[2]))
+		if err != nil {
+			return shim.Error("Get user info failed: " + err.Error())
+		} else if buyerAsJson == nil {
+			return shim.Error("User not registered: " + strings.TrimSpace(args[2]))
+		}
+		err = json.Unmarshal(buyerAsJson, &user_data)
+		if err != nil {
+			return shim.Error("Unmarshal user info failed: " + err.Error())
+		}
+	}
+
+	call_time_key := ServiceCallTimesPrefix + service_name + user_data.Name
+	callTimeJson, err := stub.GetState(call_time_key)
+	if err != nil {
+		return shim.Error("Get call time info failed : " + err.Error())
+	} else if callTimeJson == nil {
+		return shim.Error("Have not buy this service call time")
+	}
+	err = json.Unmarshal(callTimeJson, &call_time)
+	if err != nil {
+		return shim.Error("Unmarshal call time info failed : " + err.Error())
+	}
+
+	// "windowed" only refunds the call times bought within the window
+	policy := service_data.RefundPolicy
+	if policy == "" {
+		policy = R_None
+	}
+	var inWindow func(lot callTimeLot) bool
+	if policy == R_Windowed {
+		inWindow = func(lot callTimeLot) bool {
+			return time_stamp.Seconds-lot.BoughtAt <= service_data.RefundWindow
+		}
+	}
+	available := availableCallTimes(&call_time, time_stamp.Seconds, inWindow)
+
+	refund_times := new(big.Int).Set(available)
+	if len(args) > 1 && strings.TrimSpace(args[1]) != "" {
+		var ok bool
+		refund_times, ok = big.NewInt(0).SetString(strings.TrimSpace(args[1]), 10)
+		if !ok || refund_times.Sign() <= 0 {
+			return shim.Error("2nd arg must be positive integer")
+		}
+	}
+	if policy == R_None {
+		return shim.Error("This service does not refund call times")
+	}
+	if policy == R_Windowed && available.Sign() <= 0 {
+		return shim.Error("The refund window of this service has passed")
+	}
+	if refund_times.Sign() <= 0 || available.Cmp(refund_times) < 0 {
+		return shim.Error("Have not enough call times")
+	}
+
+	// STEP 1: apply the refund policy to the fee paid for the calls,
+	// every lot keeps the part refunded, to be owed by the lot's terms
+	lots := splitLots(&call_time, refund_times, time_stamp.Seconds, inWindow)
+	refund := big.NewInt(0)
+	forfeited := big.NewInt(0)
+	for i := range lots {
+		lot_refund := big.NewInt(0)
+		switch policy {
+		case R_Full, R_Windowed:
+			lot_refund.Set(lots[i].Paid)
+		case R_ProRated:
+			lot_refund.Mul(lots[i].Paid, big.NewInt(service_data.RefundPercent))
+			lot_refund.Quo(lot_refund, big.NewInt(100))
+		}
+		refund.Add(refund, lot_refund)
+		forfeited.Add(forfeited, new(big.Int).Sub(lots[i].Paid, lot_refund))
+		lots[i].Paid = lot_refund
+	}
+
+	// STEP 2: update the call times
+	call_time.UpdateTime = formatTime(time_stamp.Seconds)
+	callTimeJson, err = json.Marshal(call_time)
+	if err != nil {
+		return shim.Error("Marshal call time info failed : " + err.Error())
+	}
+	err = stub.PutState(call_time_key, callTimeJson)
+	if err != nil {
+		return shim.Error("Update call time failed : " + err.Error())
+	}
+	err = t.saveCallTimesByServiceName(stub, service_name, call_time_key, callTimeJson)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// STEP 3: the refund is owed by the users the fee was paid to,
+	// the sender pays their part at once
+	due, err := t.splitLotsRevenue(stub, service_data, lots)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if owed := due[sender_data.Name]; owed != nil && owed.Sign() > 0 && sender_data.Name != user_data.Name {
+		err = stub.Transfer(user_data.Address, FeeBalanceType, owed)
+		if err != nil {
+			return shim.Error("Transfer refund failed: " + err.Error())
+		}
+	}
+	delete(due, sender_data.Name)
+	for k, v := range due {
+		if v.Sign() <= 0 {
+			delete(due, k)
+		}
+	}
+	err = t.addRefundDues(stub, user_data.Name, due, time_stamp.Seconds)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// STEP 4: record the refund
+	refund_record := refundRecord{service_name, call_time_key, user_data.Name, stub.GetTxID(), refund_times, refund, forfeited, policy, formatTime(time_stamp.Seconds), due}
+	refundJson, err := json.Marshal(refund_record)
+	if err != nil {
+		return shim.Error("Marshal refund info failed : " + err.Error())
+	}
+	refund_key := RefundRecordPrefix + service_name + user_data.Name + stub.GetTxID()
+	err = stub.PutState(refund_key, refundJson)
+	if err != nil {
+		return shim.Error("Save refund info failed : " + err.Error())
+	}
+	return shim.Success(refundJson)
+}
+
+// ========================================================================
+// payRefunds: the sender pays the refunds they owe, the earliest first
+//
+// the most to pay is optional, all the refunds owed are paid if not given
+// ========================================================================
+func (t *serviceChaincode) payRefunds(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var user_data user
+
+	update_time, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	sender, err := stub.GetSender()
+	if err != nil {
+		return shim.Error("Failed to get sender : " + err.Error())
+	}
+	userAsJson, err := stub.GetState(UserPrefix + sender)
+	if err != nil {
+		return shim.Error("Get user info failed: " + err.Error())
+	} else if userAsJson == nil {
+		return shim.Error("User not registered")
+	}
+	err = json.Unmarshal(userAsJson, &user_data)
+	if err != nil {
+		return shim.Error("Unmarshal user info failed: " + err.Error())
+	}
+
+	dues, keys, err := t.getRefundDues(stub, user_data.Name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	left := big.NewInt(0)
+	for _, due := range dues {
+		left.Add(left, due.Amount)
+	}
+	if len(args) > 0 && strings.TrimSpace(args[0]) != "" {
+		most, ok := big.NewInt(0).SetString(strings.TrimSpace(args[0]), 10)
+		if !ok || most.Sign() <= 0 {
+			return shim.Error("1st arg must be positive integer")
+		}
+		if most.Cmp(left) < 0 {
+			left = most
+		}
+	}
+
+	paid := make([]refundDue, 0)
+	for i := range dues {
+		if left.Sign() <= 0 {
+			break
+		}
+		amount, err := t.payRefundDue(stub, &dues[i], keys[i], left, update_time)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		left.Sub(left, amount)
+		paid = append(paid, dues[i])
+	}
+	paidBytes, err := json.Marshal(paid)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(paidBytes)
+}
+
+// ========================================================================
+// queryRefundDues: query the refunds a user owes, the earliest first
+//
+// userName is required
+// ========================================================================
+func (t *serviceChaincode) queryRefundDues(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	dues, _, err := t.getRefundDues(stub, strings.TrimSpace(args[0]))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	duesBytes, err := json.Marshal(dues)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(duesBytes)
+}
+
+// ========================================================================
+// setCallTimeValidity: set how long the call times bought of a service stay
+// valid, call times bought before keep their expiry
+//
+// serviceName and seconds are required, 0 means never expire
+// ========================================================================
+func (t *serviceChaincode) setCallTimeValidity(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	validity, err := strconv.ParseInt(strings.TrimSpace(args[1]), 10, 64)
+	if err != nil || validity < 0 {
+		return shim.Error("2nd arg must be a non-negative integer")
+	}
+	serviceJSON, err := t.getDevelopedService(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	serviceJSON.ValidityPeriod = validity
+	err = t.saveService(stub, serviceJSON)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte("Set call time validity success."))
+}
+
+// ========================================================================
+// expireCallTimes: remove the expired call times of a service, anyone can
+// invoke it. Their fee was paid to the developers at purchase and is kept.
+//
+// serviceName is required, userName is optional, all users if not given
+// ========================================================================
+func (t *serviceChaincode) expireCallTimes(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	time_stamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error("Can't get timestamp : " + err.Error())
+	}
+	service_name, err := t.resolveServiceName(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	serviceAsBytes, err := stub.GetState(ServicePrefix + service_name)
+	if err != nil {
+		return shim.Error("Fail to get service: " + err.Error())
+	} else if serviceAsBytes == nil {
+		return shim.Error("This service does not exist: " + service_name)
+	}
+
+	// STEP 1: get the call time records to sweep
+	records := make([]serviceCallTime, 0)
+	if len(args) > 1 && len(strings.TrimSpace(args[1])) > 0 {
+		callTimeJson, err := stub.GetState(ServiceCallTimesPrefix + service_name + strings.TrimSpace(args[1]))
+		if err != nil {
+			return shim.Error("Get call time info failed : " + err.Error())
+		} else if callTimeJson == nil {
+			return shim.Error("Have not buy this service call time")
+		}
+		var call_time serviceCallTime
+		err = json.Unmarshal(callTimeJson, &call_time)
+		if err != nil {
+			return shim.Error("Unmarshal call time info failed : " + err.Error())
+		}
+		records = append(records, call_time)
+	} else {
+		resultsIterator, err := stub.GetStateByPartialCompositeKey(CallTimeKey, []string{service_name})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		defer resultsIterator.Close()
+		for resultsIterator.HasNext() {
+			responseRange, err := resultsIterator.Next()
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			var call_time serviceCallTime
+			err = json.Unmarshal(responseRange.Value, &call_time)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			records = append(records, call_time)
+		}
+	}
+
+	// STEP 2: expire the lots out of date
+	expired := make([]expiredCallTimes, 0)
+	for _, call_time := range records {
+		lots := expireLots(&call_time, time_stamp.Seconds)
+		if len(lots) == 0 {
+			continue
+		}
+		sum := serviceCallTime{Lots: lots}
+		sumLots(&sum)
+		call_time.UpdateTime = formatTime(time_stamp.Seconds)
+		callTimeJson, err := json.Marshal(call_time)
+		if err != nil {
+			return shim.Error("Marshal call time info failed : " + err.Error())
+		}
+		call_time_key := ServiceCallTimesPrefix + service_name + call_time.UserName
+		err = stub.PutState(call_time_key, callTimeJson)
+		if err != nil {
+			return shim.Error("Update call time failed : " + err.Error())
+		}
+		err = t.saveCallTimesByServiceName(stub, service_name, call_time_key, callTimeJson)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		expired = append(expired, expiredCallTimes{service_name, call_time.UserName, sum.CallTimes, sum.Paid})
+	}
+	// the lots held in open sell orders expire too
+	orders, err := t.getOpenSellOrders(stub, service_name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for _, order := range orders {
+		if len(args) > 1 && len(strings.TrimSpace(args[1])) > 0 && order.Seller != strings.TrimSpace(args[1]) {
+			continue
+		}
+		record := serviceCallTime{Lots: order.Lots}
+		lots := expireLots(&record, time_stamp.Seconds)
+		if len(lots) == 0 {
+			continue
+		}
+		sum := serviceCallTime{Lots: lots}
+		sumLots(&sum)
+		order.Lots = record.Lots
+		order.CallTimes = record.CallTimes
+		if order.CallTimes.Sign() <= 0 {
+			order.Status = O_Expired
+		}
+		order.UpdateTime = formatTime(time_stamp.Seconds)
+		_, err = t.saveSellOrder(stub, order)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		expired = append(expired, expiredCallTimes{service_name, order.Seller, sum.CallTimes, sum.Paid})
+	}
+	// and so do the lots of transfers waiting for approval, they are the sender's until approved
+	transfers, err := t.getPendingTransfers(stub, service_name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for _, transfer := range transfers {
+		if len(args) > 1 && len(strings.TrimSpace(args[1])) > 0 && transfer.From != strings.TrimSpace(args[1]) {
+			continue
+		}
+		lots := expireTransferLots(&transfer, time_stamp.Seconds)
+		if len(lots) == 0 {
+			continue
+		}
+		sum := serviceCallTime{Lots: lots}
+		sumLots(&sum)
+		transfer.UpdateTime = formatTime(time_stamp.Seconds)
+		err = t.saveTransfer(stub, transfer)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		expired = append(expired, expiredCallTimes{service_name, transfer.From, sum.CallTimes, sum.Paid})
+	}
+
+	expiredBytes, err := json.Marshal(expired)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(expiredBytes)
+}
+
+// ========================================================================
+// setTransferApproval: set whether the developer approves every transfer
+// of a service's call times
+//
+// serviceName and "true"/"false" are required
+// ========================================================================
+func (t *serviceChaincode) setTransferApproval(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	approval, err := strconv.ParseBool(strings.TrimSpace(args[1]))
+	if err != nil {
+		return shim.Error("2nd arg must be \"true\" or \"false\"")
+	}
+	serviceJSON, err := t.getDevelopedService(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	serviceJSON.TransferApproval = approval
+	err = t.saveService(stub, serviceJSON)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte("Set transfer approval success."))
+}
+
+// ========================================================================
+// transferCallTimes: move call times of a service from the sender to
+// another user, along with the fee paid for them and their expiry. If the
+// service requires approval, the call times wait for the developer's approval.
+//
+// serviceName, userName and callTimes are required
+// ========================================================================
+func (t *serviceChaincode) transferCallTimes(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var service_data service
+	var from_user, to_user user
+	var call_time serviceCallTime
+
+	time_stamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error("Can't get timestamp : " + err.Error())
+	}
+	sender, err := stub.GetSender()
+	if err != nil {
+		return shim.Error("Failed to get sender : " + err.Error())
+	}
+	userAsJson, err := stub.GetState(UserPrefix + sender)
+	if err != nil {
+		return shim.Error("Get user info failed: " + err.Error())
+	} else if userAsJson == nil {
+		return shim.Error("User not registered")
+	}
+	err = json.Unmarshal(userAsJson, &from_user)
+	if err != nil {
+		return shim.Error("Unmarshal user info failed: " + err.Error())
+	}
+
+	to_name := strings.TrimSpace(args[1])
+	if len(to_name) == 0 {
+		return shim.Error("2nd arg must be non-empty string")
+	} else if to_name == from_user.Name {
+		return shim.Error("Can't transfer call times to yourself")
+	}
+	toAsJson, err := stub.GetState(UserPrefix + to_name)
+	if err != nil {
+		return shim.Error("Get user info failed: " + err.Error())
+	} else if toAsJson == nil {
+		return shim.Error("User not registered: " + to_name)
+	}
+	err = json.Unmarshal(toAsJson, &to_user)
+	if err != nil {
+		return shim.Error("Unmarshal user info failed: " + err.Error())
+	}
+
+	call_times, ok := big.NewInt(0).SetString(strings.TrimSpace(args[2]), 10)
+	if !ok || call_times.Sign() <= 0 {
+		return shim.Error("3rd arg must be positive integer")
+	}
+
+	service_name, err := t.resolveServiceName(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	serviceAsBytes, err := stub.GetState(ServicePrefix + service_name)
+	if err != nil {
+		return shim.Error("Fail to get service: " + err.Error())
+	} else if serviceAsBytes == nil {
+		return shim.Error("This service does not exist: " + service_name)
+	}
+	err = json.Unmarshal(serviceAsBytes, &service_data)
+	if err != nil {
+		return shim.Error("Fail to unmarshal service data")
+	}
+	if !canAccessService(service_data, to_user) {
+		return shim.Error("Service not accessible to " + to_name)
+	}
+
+	callTimeJson, err := stub.GetState(ServiceCallTimesPrefix + service_name + from_user.Name)
+	if err != nil {
+		return shim.Error("Get call time info failed : " + err.Error())
+	} else if callTimeJson == nil {
+		return shim.Error("Have not buy this service call time")
+	}
+	err = json.Unmarshal(callTimeJson, &call_time)
+	if err != nil {
+		return shim.Error("Unmarshal call time info failed : " + err.Error())
+	}
+	if availableCallTimes(&call_time, time_stamp.Seconds, nil).Cmp(call_times) < 0 {
+		return shim.Error("Have not enough call times")
+	}
+
+	// STEP 1: take the call times out of the sender's
+	lots := splitLots(&call_time, call_times, time_stamp.Seconds, nil)
+	call_time.UpdateTime = formatTime(time_stamp.Seconds)
+	err = t.saveCallTimeRecord(stub, call_time)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	paid := big.NewInt(0)
+	for _, lot := range lots {
+		paid.Add(paid, lot.Paid)
+	}
+	transfer := callTimeTransfer{stub.GetTxID(), service_name, from_user.Name, to_name, call_times, paid, lots, T_Pending, formatTime(time_stamp.Seconds), formatTime(time_stamp.Seconds)}
+
+	// STEP 2: give them to the recipient, unless the developer has to approve it
+	if !service_data.TransferApproval || service_data.Developer == from_user.Name {
+		err = t.creditLots(stub, service_name, to_user, lots, formatTime(time_stamp.Seconds))
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		transfer.Status = T_Completed
+	}
+	err = t.saveTransfer(stub, transfer)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	transferJson, err := json.Marshal(transfer)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(transferJson)
+}
+
+// ========================================================================
+// approveCallTimeTransfer: the developer approves a transfer of call times
+// waiting for approval, or rejects it and the call times are given back.
+// The call times expired while waiting are removed, the transfer expires
+// instead if none is left.
+//
+// serviceName, transferId and "true"/"false" are required
+// ========================================================================
+func (t *serviceChaincode) approveCallTimeTransfer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var transfer callTimeTransfer
+	var recipient user
+
+	approve, err := strconv.ParseBool(strings.TrimSpace(args[2]))
+	if err != nil {
+		return shim.Error("3rd arg must be \"true\" or \"false\"")
+	}
+	time_stamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error("Can't get timestamp : " + err.Error())
+	}
+	serviceJSON, err := t.getDevelopedService(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	transferKey, err := stub.CreateCompositeKey(TransferKey, []string{serviceJSON.Name, strings.TrimSpace(args[1])})
+	if err != nil {
+		return shim.Error("Create composite key error: " + err.Error())
+	}
+	transferAsBytes, err := stub.GetState(transferKey)
+	if err != nil {
+		return shim.Error("Get transfer failed: " + err.Error())
+	} else if transferAsBytes == nil {
+		return shim.Error("No transfer waiting for approval: " + args[1])
+	}
+	err = json.Unmarshal(transferAsBytes, &transfer)
+	if err != nil {
+		return shim.Error("Unmarshal transfer failed: " + err.Error())
+	}
+	if transfer.Status != T_Pending {
+		return shim.Error("This transfer is " + transfer.Status + ": " + args[1])
+	}
+	transfer.UpdateTime = formatTime(time_stamp.Seconds)
+	expireTransferLots(&transfer, time_stamp.Seconds)
+	if transfer.Status == T_Pending {
+		recipient_name := transfer.To
+		transfer.Status = T_Completed
+		if !approve {
+			recipient_name = transfer.From
+			transfer.Status = T_Rejected
+		}
+		userAsJson, err := stub.GetState(UserPrefix + recipient_name)
+		if err != nil {
+			return shim.Error("Get user info failed: " + err.Error())
+		} else if userAsJson == nil {
+			return shim.Error("User not registered: " + recipient_name)
+		}
+		err = json.Unmarshal(userAsJson, &recipient)
+		if err != nil {
+			return shim.Error("Unmarshal user info failed: " + err.Error())
+		}
+		err = t.creditLots(stub, transfer.ServiceName, recipient, transfer.Lots, formatTime(time_stamp.Seconds))
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	err = t.saveTransfer(stub, transfer)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	transferJson, err := json.Marshal(transfer)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(transferJson)
+}
+
+// ========================================================================
+// queryCallTimeTransfers: query the call time transfers from or to a user
+//
+// userName is required, serviceName is optional
+// ========================================================================
+func (t *serviceChaincode) queryCallTimeTransfers(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	keys := []string{strings.TrimSpace(args[0])}
+	if len(args) > 1 && len(strings.TrimSpace(args[1])) > 0 {
+		service_name, err := t.resolveServiceName(stub, args[1])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		keys = append(keys, service_name)
+	}
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(TransferLogKey, keys)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	transfers := make([]callTimeTransfer, 0)
+	for resultsIterator.HasNext() {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		var transfer callTimeTransfer
+		err = json.Unmarshal(responseRange.Value, &transfer)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		transfers = append(transfers, transfer)
+	}
+	transfersBytes, err := json.Marshal(transfers)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(transfersBytes)
+}
+
+// ========================================================================
+// setResaleRoyalty: set the percentage of every resale of a service's call
+// times paid to the developer
+//
+// serviceName and percentage are required
+// ========================================================================
+func (t *serviceChaincode) setResaleRoyalty(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	royalty, err := strconv.ParseInt(strings.TrimSpace(args[1]), 10, 64)
+	if err != nil || royalty < 0 || royalty > 100 {
+		return shim.Error("2nd arg must be an integer between 0 and 100")
+	}
+	serviceJSON, err := t.getDevelopedService(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	serviceJSON.ResaleRoyalty = royalty
+	err = t.saveService(stub, serviceJSON)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte("Set resale royalty success."))
+}
+
+// ========================================================================
+// createSellOrder: offer call times of a service for sale, they are taken
+// out of the sender's call times until sold, cancelled or expired.
+//
+// serviceName, callTimes and unitPrice are required
+// ========================================================================
+func (t *serviceChaincode) createSellOrder(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var user_data user
+	var call_time serviceCallTime
+
+	time_stamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error("Can't get timestamp : " + err.Error())
+	}
+	sender, err := stub.GetSender()
+	if err != nil {
+		return shim.Error("Failed to get sender : " + err.Error())
+	}
+	userAsJson, err := stub.GetState(UserPrefix + sender)
+	if err != nil {
+		return shim.Error("Get user info failed: " + err.Error())
+	} else if userAsJson == nil {
+		return shim.Error("User not registered")
+	}
+	err = json.Unmarshal(userAsJson, &user_data)
+	if err != nil {
+		return shim.Error("Unmarshal user info failed: " + err.Error())
+	}
+
+	service_name, err := t.resolveServiceName(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	call_times, ok := big.NewInt(0).SetString(strings.TrimSpace(args[1]), 10)
+	if !ok || call_times.Sign() <= 0 {
+		return shim.Error("2nd arg must be positive integer")
+	}
+	unit_price, ok := big.NewInt(0).SetString(strings.TrimSpace(args[2]), 10)
+	if !ok || unit_price.Sign() < 0 {
+		return shim.Error("3rd arg must be non-negative integer")
+	}
+	serviceAsBytes, err := stub.GetState(ServicePrefix + service_name)
+	if err != nil {
+		return shim.Error("Fail to get service: " + err.Error())
+	} else if serviceAsBytes == nil {
+		return shim.Error("This service does not exist: " + service_name)
+	}
+
+	callTimeJson, err := stub.GetState(ServiceCallTimesPrefix + service_name + user_data.Name)
+	if err != nil {
+		return shim.Error("Get call time info failed : " + err.Error())
+	} else if callTimeJson == nil {
+		return shim.Error("Have not buy this service call time")
+	}
+	err = json.Unmarshal(callTimeJson, &call_time)
+	if err != nil {
+		return shim.Error("Unmarshal call time info failed : " + err.Error())
+	}
+	if availableCallTimes(&call_time, time_stamp.Seconds, nil).Cmp(call_times) < 0 {
+		return shim.Error("Have not enough call times")
+	}
+
+	lots := splitLots(&call_time, call_times, time_stamp.Seconds, nil)
+	call_time.UpdateTime = formatTime(time_stamp.Seconds)
+	err = t.saveCallTimeRecord(stub, call_time)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	order := sellOrder{stub.GetTxID(), service_name, user_data.Name, call_times, unit_price, lots, O_Open, formatTime(time_stamp.Seconds), formatTime(time_stamp.Seconds)}
+	orderJson, err := t.saveSellOrder(stub, order)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(orderJson)
+}
+
+// ========================================================================
+// cancelSellOrder: withdraw a sell order, the call times left are given
+// back to the seller
+//
+// serviceName and orderId are required
+// ========================================================================
+func (t *serviceChaincode) cancelSellOrder(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var user_data user
+
+	time_stamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error("Can't get timestamp : " + err.Error())
+	}
+	sender, err := stub.GetSender()
+	if err != nil {
+		return shim.Error("Failed to get sender : " + err.Error())
+	}
+	userAsJson, err := stub.GetState(UserPrefix + sender)
+	if err != nil {
+		return shim.Error("Get user info failed: " + err.Error())
+	} else if userAsJson == nil {
+		return shim.Error("User not registered")
+	}
+	err = json.Unmarshal(userAsJson, &user_data)
+	if err != nil {
+		return shim.Error("Unmarshal user info failed: " + err.Error())
+	}
+
+	service_name, err := t.resolveServiceName(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	order, err := t.getSellOrder(stub, service_name, strings.TrimSpace(args[1]))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if order.Seller != user_data.Name {
+		return shim.Error("Sell order not created by you")
+	} else if order.Status != O_Open {
+		return shim.Error("Sell order is " + order.Status)
+	}
+
+	err = t.creditLots(stub, service_name, user_data, order.Lots, formatTime(time_stamp.Seconds))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	order.Lots = nil
+	order.CallTimes = big.NewInt(0)
+	order.Status = O_Cancelled
+	order.UpdateTime = formatTime(time_stamp.Seconds)
+	orderJson, err := t.saveSellOrder(stub, order)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(orderJson)
+}
+
+// ========================================================================
+// buyResale: buy call times of a service from its open sell orders, the
+// cheapest first and at most at the given price per call. The sender pays
+// the sellers, and the resale royalty of the service to its developer.
+//
+// serviceName, callTimes and maxUnitPrice are required,
+// the call times are bought as many as the sell orders can fill
+// ========================================================================
+func (t *serviceChaincode) buyResale(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var service_data service
+	var buyer user
+
+	time_stamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error("Can't get timestamp : " + err.Error())
+	}
+	sender, err := stub.GetSender()
+	if err != nil {
+		return shim.Error("Failed to get sender : " + err.Error())
+	}
+	userAsJson, err := stub.GetState(UserPrefix + sender)
+	if err != nil {
+		return shim.Error("Get user info failed: " + err.Error())
+	} else if userAsJson == nil {
+		return shim.Error("User not registered")
+	}
+	err = json.Unmarshal(userAsJson, &buyer)
+	if err != nil {
+		return shim.Error("Unmarshal user info failed: " + err.Error())
+	}
+
+	service_name, err := t.resolveServiceName(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	call_times, ok := big.NewInt(0).SetString(strings.TrimSpace(args[1]), 10)
+	if !ok || call_times.Sign() <= 0 {
+		return shim.Error("2nd arg must be positive integer")
+	}
+	max_price, ok := big.NewInt(0).SetString(strings.TrimSpace(args[2]), 10)
+	if !ok || max_price.Sign() < 0 {
+		return shim.Error("3rd arg must be non-negative integer")
+	}
+
+	serviceAsBytes, err := stub.GetState(ServicePrefix + service_name)
+	if err != nil {
+		return shim.Error("Fail to get service: " + err.Error())
+	} else if serviceAsBytes == nil {
+		return shim.Error("This service does not exist: " + service_name)
+	}
+	err = json.Unmarshal(serviceAsBytes, &service_data)
+	if err != nil {
+		return shim.Error("Fail to unmarshal service data")
+	}
+	if service_data.Status != S_Available {
+		return shim.Error("Service not available")
+	}
+	if !canAccessService(service_data, buyer) {
+		return shim.Error("Service not accessible")
+	}
+
+	// STEP 1: match the cheapest open sell orders of other users
+	trades, payments, bought, err := t.matchSellOrders(stub, service_data, buyer.Name, call_times, max_price, time_stamp.Seconds)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(trades) == 0 {
+		return shim.Error("No call times for sale at the price")
+	}
+
+	// STEP 2: pay the sellers and the developer
+	err = t.transferToUsers(stub, payments)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// STEP 3: give the call times to the buyer, and record the trades
+	err = t.recordResale(stub, service_data, buyer, trades, bought, time_stamp.Seconds)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	tradesBytes, err := json.Marshal(trades)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(tradesBytes)
+}
+
+// ========================================================================
+// querySellOrders: query the open sell orders of a service, the cheapest first
+//
+// serviceName is required
+// ========================================================================
+func (t *serviceChaincode) querySellOrders(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	service_name, err := t.resolveServiceName(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	orders, err := t.getOpenSellOrders(stub, service_name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	ordersBytes, err := json.Marshal(orders)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(ordersBytes)
+}
+
+// ========================================================================
+// setUsageKey: publish the public key the sender signs usage receipts with
+//
+// the key is a hex encoded uncompressed P-256 point
+// ========================================================================
+func (t *serviceChaincode) setUsageKey(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	key := strings.TrimSpace(args[0])
+	_, err := parseUsageKey(key)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	sender, err := stub.GetSender()
+	if err != nil {
+		return shim.Error("Fail to get the sender's address.")
+	}
+	userAsBytes, err := stub.GetState(UserPrefix + sender)
+	if err != nil {
+		return shim.Error("Fail to get user: " + err.Error())
+	} else if userAsBytes == nil {
+		return shim.Error("User not registered")
+	}
+	var userJSON user
+	err = json.Unmarshal(userAsBytes, &userJSON)
+	if err != nil {
+		return shim.Error("Error unmarshal user bytes.")
+	}
+
+	userJSON.UsageKey = key
+	err = t.updateUser(userJSON, stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte("Set usage key success."))
+}
+
+// ========================================================================
+// settleUsage: the developer submits the latest usage receipt signed by a
+// caller, the calls counted since the receipt settled last are reduced.
+// The caller signs the SHA-256 digest of usageReceipt(service, caller,
+// cumulative, nonce), the nonce must grow with every receipt settled.
+//
+// serviceName, userName, cumulative, nonce and signature are required
+// ========================================================================
+func (t *serviceChaincode) settleUsage(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var caller_data user
+	var settlement usageSettlement
+
+	time_stamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error("Can't get timestamp : " + err.Error())
+	}
+	service_data, err := t.getDevelopedService(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	caller := strings.TrimSpace(args[1])
+	if len(caller) == 0 {
+		return shim.Error("2nd arg must be non-empty string")
+	}
+	cumulative, ok := big.NewInt(0).SetString(strings.TrimSpace(args[2]), 10)
+	if !ok || cumulative.Sign() < 0 {
+		return shim.Error("3rd arg must be non-negative integer")
+	}
+	nonce, err := strconv.ParseUint(strings.TrimSpace(args[3]), 10, 64)
+	if err != nil {
+		return shim.Error("4th arg must be non-negative integer")
+	}
+
+	// STEP 1: verify the receipt is signed by the caller
+	callerAsBytes, err := stub.GetState(UserPrefix + caller)
+	if err != nil {
+		return shim.Error("Get user info failed: " + err.Error())
+	} else if callerAsBytes == nil {
+		return shim.Error("User not registered: " + caller)
+	}
+	err = json.Unmarshal(callerAsBytes, &caller_data)
+	if err != nil {
+		return shim.Error("Unmarshal user info failed: " + err.Error())
+	}
+	if caller_data.UsageKey == "" {
+		return shim.Error("The caller has not set a usage key")
+	}
+	err = verifyUsageReceipt(caller_data.UsageKey, usageReceipt(service_data.Name, caller, cumulative, nonce), strings.TrimSpace(args[4]))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// STEP 2: reject receipts older than the one settled last
+	settlementKey, err := stub.CreateCompositeKey(UsageSettlementKey, []string{service_data.Name, caller})
+	if err != nil {
+		return shim.Error("Create composite key error: " + err.Error())
+	}
+	settlementAsBytes, err := stub.GetState(settlementKey)
+	if err != nil {
+		return shim.Error("Get usage settlement failed: " + err.Error())
+	} else if settlementAsBytes != nil {
+		err = json.Unmarshal(settlementAsBytes, &settlement)
+		if err != nil {
+			return shim.Error("Unmarshal usage settlement failed: " + err.Error())
+		}
+		if nonce <= settlement.Nonce {
+			return shim.Error("The receipt has been settled")
+		}
+	} else {
+		settlement = usageSettlement{service_data.Name, caller, big.NewInt(0), 0, ""}
+	}
+	calls := new(big.Int).Sub(cumulative, settlement.Cumulative)
+	if calls.Sign() < 0 {
+		return shim.Error("The receipt counts less calls than the one settled last")
+	} else if calls.Sign() == 0 {
+		return shim.Error("No calls to settle")
+	}
+
+	// STEP 3: reduce the calls made since
+	_, err = t.consumeCallTimes(stub, service_data, caller, calls, formatTime(time_stamp.Seconds), time_stamp.Seconds)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	settlement.Cumulative = cumulative
+	settlement.Nonce = nonce
+	settlement.UpdateTime = formatTime(time_stamp.Seconds)
+	settlementAsBytes, err = json.Marshal(settlement)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(settlementKey, settlementAsBytes)
+	if err != nil {
+		return shim.Error("Save usage settlement failed: " + err.Error())
+	}
+
+	// STEP 4: count the developer's invoke times
+	developerAsBytes, err := stub.GetState(UserPrefix + service_data.Developer)
+	if err != nil {
+		return shim.Error("Get user info failed: " + err.Error())
+	} else if developerAsBytes == nil {
+		return shim.Error("User not registered")
+	}
+	var developer user
+	err = json.Unmarshal(developerAsBytes, &developer)
+	if err != nil {
+		return shim.Error("Unmarshal user info failed: " + err.Error())
+	}
+	developer.TotalInvokeTimes = developer.TotalInvokeTimes + int(calls.Int64())
+	err = t.updateUser(developer, stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(settlementAsBytes)
+}
+
+// ========================================================================
+// getUsageSettlement: query the latest usage receipt settled of a caller
+//
+// serviceName and userName are required
+// ========================================================================
+func (t *serviceChaincode) getUsageSettlement(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	service_name, err := t.resolveServiceName(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	caller := strings.TrimSpace(args[1])
+	settlementKey, err := stub.CreateCompositeKey(UsageSettlementKey, []string{service_name, caller})
+	if err != nil {
+		return shim.Error("Create composite key error: " + err.Error())
+	}
+	settlementAsBytes, err := stub.GetState(settlementKey)
+	if err != nil {
+		return shim.Error("Get usage settlement failed: " + err.Error())
+	} else if settlementAsBytes == nil {
+		settlementAsBytes, err = json.Marshal(usageSettlement{service_name, caller, big.NewInt(0), 0, ""})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	return shim.Success(settlementAsBytes)
+}
+
+// ========================================================================
+// setArbitrator: allow or disallow a user to resolve disputes, only the
+// admin account can invoke it
+//
+// userName is required
+// ========================================================================
+func (t *serviceChaincode) setArbitrator(stub shim.ChaincodeStubInterface, args []string, allow bool) pb.Response {
+	err := t.checkAdmin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	user_name := strings.TrimSpace(args[0])
+	userAsBytes, err := stub.GetState(UserPrefix + user_name)
+	if err != nil {
+		return shim.Error("Fail to get user: " + err.Error())
+	} else if userAsBytes == nil {
+		return shim.Error("User not registered: " + user_name)
+	}
+	arbitratorKey, err := stub.CreateCompositeKey(ArbitratorKey, []string{user_name})
+	if err != nil {
+		return shim.Error("Create composite key error: " + err.Error())
+	}
+	if allow {
+		err = stub.PutState(arbitratorKey, []byte(user_name))
+	} else {
+		err = stub.DelState(arbitratorKey)
+	}
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte("Set arbitrator success."))
+}
+
+// ========================================================================
+// openDispute: the sender contests a reduction of their call times of a
+// service, within DisputeWindow seconds of it. A reduction is identified by
+// its transaction, or by its unix time if reduced before they were keyed
+// by transaction.
+//
+// serviceName, reduceId and reason are required
+// ========================================================================
+func (t *serviceChaincode) openDispute(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var user_data user
+	var reduce_record reduceRecord
+
+	time_stamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error("Can't get timestamp : " + err.Error())
+	}
+	sender, err := stub.GetSender()
+	if err != nil {
+		return shim.Error("Failed to get sender : " + err.Error())
+	}
+	userAsJson, err := stub.GetState(UserPrefix + sender)
+	if err != nil {
+		return shim.Error("Get user info failed: " + err.Error())
+	} else if userAsJson == nil {
+		return shim.Error("User not registered")
+	}
+	err = json.Unmarshal(userAsJson, &user_data)
+	if err != nil {
+		return shim.Error("Unmarshal user info failed: " + err.Error())
+	}
+
+	service_name, err := t.resolveServiceName(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	reduce_id := strings.TrimSpace(args[1])
+	if len(reduce_id) == 0 {
+		return shim.Error("2nd arg must be non-empty string")
+	}
+	reason := strings.TrimSpace(args[2])
+	if len(reason) == 0 {
+		return shim.Error("3rd arg must be non-empty string")
+	}
+
+	reduce_key := ReduceRecordPrefix + service_name + user_data.Name + reduce_id
+	reduceJson, err := stub.GetState(reduce_key)
+	if err != nil {
+		return shim.Error("Get reduce info failed : " + err.Error())
+	} else if reduceJson == nil {
+		return shim.Error("No reduction of your call times: " + reduce_id)
+	}
+	err = json.Unmarshal(reduceJson, &reduce_record)
+	if err != nil {
+		return shim.Error("Unmarshal reduce info failed : " + err.Error())
+	}
+	reduce_seconds, ok := parseRecordTime(reduce_record.CreateTime)
+	if !ok {
+		reduce_seconds, err = strconv.ParseInt(reduce_id, 10, 64)
+		if err != nil {
+			return shim.Error("Unknown time of the reduction: " + reduce_id)
+		}
+	}
+	if time_stamp.Seconds-reduce_seconds > DisputeWindow {
+		return shim.Error("The dispute window of the reduction has passed")
+	}
+
+	disputeKey, err := stub.CreateCompositeKey(DisputeKey, []string{service_name, user_data.Name, reduce_id})
+	if err != nil {
+		return shim.Error("Create composite key error: " + err.Error())
+	}
+	disputeAsBytes, err := stub.GetState(disputeKey)
+	if err != nil {
+		return shim.Error("Get dispute failed: " + err.Error())
+	} else if disputeAsBytes != nil {
+		return shim.Error("The reduction has been disputed")
+	}
+
+	paid := reduce_record.Paid
+	if paid == nil {
+		paid = big.NewInt(0)
+	}
+	record := dispute{stub.GetTxID(), service_name, user_data.Name, reduce_record.UserName, reduce_key, reduce_seconds, reduce_record.ReduceTime, paid,
+		reason, D_Open, "", "", formatTime(time_stamp.Seconds), formatTime(time_stamp.Seconds)}
+	disputeAsBytes, err = json.Marshal(record)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(disputeKey, disputeAsBytes)
+	if err != nil {
+		return shim.Error("Save dispute failed: " + err.Error())
+	}
+	return shim.Success(disputeAsBytes)
+}
+
+// ========================================================================
+// resolveDispute: an arbitrator upholds or rejects an open dispute. If
+// upheld, the reduced call times are restored to the caller as a new lot,
+// along with the fee paid for them: the fee stays with the users it was
+// paid to, who owe its refund if the call times are refunded. The calls
+// no longer count against the caller's quota if its window is still open.
+//
+// serviceName, userName, reduceId and "true"/"false" are required
+// ========================================================================
+func (t *serviceChaincode) resolveDispute(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var arbitrator, caller user
+	var record dispute
+	var reduce_record reduceRecord
+	var service_data service
+
+	time_stamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error("Can't get timestamp : " + err.Error())
+	}
+	sender, err := stub.GetSender()
+	if err != nil {
+		return shim.Error("Failed to get sender : " + err.Error())
+	}
+	userAsJson, err := stub.GetState(UserPrefix + sender)
+	if err != nil {
+		return shim.Error("Get user info failed: " + err.Error())
+	} else if userAsJson == nil {
+		return shim.Error("User not registered")
+	}
+	err = json.Unmarshal(userAsJson, &arbitrator)
+	if err != nil {
+		return shim.Error("Unmarshal user info failed: " + err.Error())
+	}
+	arbitratorKey, err := stub.CreateCompositeKey(ArbitratorKey, []string{arbitrator.Name})
+	if err != nil {
+		return shim.Error("Create composite key error: " + err.Error())
+	}
+	arbitratorAsBytes, err := stub.GetState(arbitratorKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if arbitratorAsBytes == nil {
+		return shim.Error("Authority err! Not invoked by an arbitrator.")
+	}
+
+	uphold, err := strconv.ParseBool(strings.TrimSpace(args[3]))
+	if err != nil {
+		return shim.Error("4th arg must be \"true\" or \"false\"")
+	}
+	ruling := ""
+	if len(args) > 4 {
+		ruling = strings.TrimSpace(args[4])
+	}
+
+	// STEP 1: get the open dispute
+	service_name, err := t.resolveServiceName(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	caller_name := strings.TrimSpace(args[1])
+	reduce_id := strings.TrimSpace(args[2])
+	disputeKey, err := stub.CreateCompositeKey(DisputeKey, []string{service_name, caller_name, reduce_id})
+	if err != nil {
+		return shim.Error("Create composite key error: " + err.Error())
+	}
+	disputeAsBytes, err := stub.GetState(disputeKey)
+	if err != nil {
+		return shim.Error("Get dispute failed: " + err.Error())
+	} else if disputeAsBytes == nil {
+		return shim.Error("The reduction is not disputed")
+	}
+	err = json.Unmarshal(disputeAsBytes, &record)
+	if err != nil {
+		return shim.Error("Unmarshal dispute failed: " + err.Error())
+	}
+	if record.Status != D_Open {
+		return shim.Error("The dispute has been resolved")
+	} else if arbitrator.Name == record.Caller || arbitrator.Name == record.Developer {
+		return shim.Error("Can't resolve a dispute you are a party of")
+	}
+
+	record.Status = D_Rejected
+	if uphold {
+		record.Status = D_Upheld
+		reduceJson, err := stub.GetState(record.ReduceKey)
+		if err != nil {
+			return shim.Error("Get reduce info failed : " + err.Error())
+		} else if reduceJson == nil {
+			return shim.Error("The reduction does not exist")
+		}
+		err = json.Unmarshal(reduceJson, &reduce_record)
+		if err != nil {
+			return shim.Error("Unmarshal reduce info failed : " + err.Error())
+		}
+		serviceAsBytes, err := stub.GetState(ServicePrefix + service_name)
+		if err != nil {
+			return shim.Error("Fail to get service: " + err.Error())
+		} else if serviceAsBytes == nil {
+			return shim.Error("This service does not exist: " + service_name)
+		}
+		err = json.Unmarshal(serviceAsBytes, &service_data)
+		if err != nil {
+			return shim.Error("Fail to unmarshal service data")
+		}
+		callerAsJson, err := stub.GetState(UserPrefix + record.Caller)
+		if err != nil {
+			return shim.Error("Get user info failed: " + err.Error())
+		} else if callerAsJson == nil {
+			return shim.Error("User not registered: " + record.Caller)
+		}
+		err = json.Unmarshal(callerAsJson, &caller)
+		if err != nil {
+			return shim.Error("Unmarshal user info failed: " + err.Error())
+		}
+
+		// STEP 2: restore the call times and the fee paid for them to the caller, as a new lot
+		lot := callTimeLot{stub.GetTxID(), reduce_record.ReduceTime, record.Paid, time_stamp.Seconds, 0, nil}
+		if service_data.ValidityPeriod > 0 {
+			lot.ExpiresAt = time_stamp.Seconds + service_data.ValidityPeriod
+		}
+		err = t.creditLots(stub, service_name, caller, []callTimeLot{lot}, formatTime(time_stamp.Seconds))
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		// STEP 3: mark the reduce record reversed, and the developer's invoke times
+		reduce_record.Reversed = true
+		reduceJson, err = json.Marshal(reduce_record)
+		if err != nil {
+			return shim.Error("Marshal reduce info failed : " + err.Error())
+		}
+		err = stub.PutState(record.ReduceKey, reduceJson)
+		if err != nil {
+			return shim.Error("Save reduce info failed : " + err.Error())
+		}
+		if record.ReduceSeconds == 0 {
+			// disputes opened before were keyed by the unix time of the reduction
+			record.ReduceSeconds, _ = strconv.ParseInt(reduce_id, 10, 64)
+		}
+		// the reversed calls no longer count against the caller's quota
+		err = t.releaseQuota(stub, service_data, record.Caller, reduce_record.ReduceTime.Int64(), record.ReduceSeconds, time_stamp.Seconds)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = t.indexRecord(stub, UserConsumeKey, ServiceConsumeKey, record.Caller, service_name, record.ReduceSeconds, reduce_record.TxID, reduceJson)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		developerAsJson, err := stub.GetState(UserPrefix + record.Developer)
+		if err != nil {
+			return shim.Error("Get user info failed: " + err.Error())
+		} else if developerAsJson != nil {
+			var developer user
+			err = json.Unmarshal(developerAsJson, &developer)
+			if err != nil {
+				return shim.Error("Unmarshal user info failed: " + err.Error())
+			}
+			developer.TotalInvokeTimes = developer.TotalInvokeTimes - int(reduce_record.ReduceTime.Int64())
+			err = t.updateUser(developer, stub)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+		}
+	}
+
+	// STEP 4: record the resolution
+	record.Arbitrator = arbitrator.Name
+	record.Ruling = ruling
+	record.UpdateTime = formatTime(time_stamp.Seconds)
+	disputeAsBytes, err = json.Marshal(record)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(disputeKey, disputeAsBytes)
+	if err != nil {
+		return shim.Error("Save dispute failed: " + err.Error())
+	}
+	return shim.Success(disputeAsBytes)
+}
+
+// ========================================================================
+// queryDisputes: query the disputes of a service
+//
+// serviceName is required, userName is optional
+// ========================================================================
+func (t *serviceChaincode) queryDisputes(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	service_name, err := t.resolveServiceName(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	keys := []string{service_name}
+	if len(args) > 1 && len(strings.TrimSpace(args[1])) > 0 {
+		keys = append(keys, strings.TrimSpace(args[1]))
+	}
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(DisputeKey, keys)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	disputes := make([]dispute, 0)
+	for resultsIterator.HasNext() {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		var record dispute
+		err = json.Unmarshal(responseRange.Value, &record)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		disputes = append(disputes, record)
+	}
+	disputesBytes, err := json.Marshal(disputes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(disputesBytes)
+}
+
+func (t *serviceChaincode) calcContribution(serviceUser user) user {
+	totalService := float64(serviceUser.TotalService)
+	totalInvokeTimes := float64(serviceUser.TotalInvokeTimes)
+	totalCallTimes := float64(serviceUser.TotalCallTimes)
+	if totalService == 0 {
+		serviceUser.Contribution = math.Log(totalService + 1)
+	} else {
+		serviceUser.Contribution = math.Log(totalService+1) + L*(totalInvokeTimes/totalService) + R*(totalCallTimes/totalService)
+	}
+	return serviceUser
+}
+
+func (t *serviceChaincode) updateUser(serviceUser user, stub shim.ChaincodeStubInterface) error {
+	userKey := UserPrefix + serviceUser.Name
+	userJSONasBytes, err := json.Marshal(serviceUser)
+	if err != nil {
+		return err
+	}
+	err = stub.PutState(userKey, userJSONasBytes)
+	if err != nil {
+		return err
+	}
+	err = stub.PutState(UserPrefix+serviceUser.Address, userJSONasBytes)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func isValidLicense(license string) bool {
+	switch license {
+	case L_Proprietary, L_Attribution, L_Commercial, L_Royalty:
+		return true
+	}
+	return false
+}
+
+// serviceLicense returns the license of a service,
+// services registered before licenses existed are treated as commercial.
+func serviceLicense(s service) string {
+	if s.License == "" {
+		return L_Commercial
+	}
+	return s.License
+}
+
+// checkLicense checks whether "component" can be composed by "mashupDev"
+// into a mashup sold at "mashupPrice" under "mashupLicense".
+// A developer can always compose their own services.
+func checkLicense(component service, mashupDev string, mashupPrice *big.Int, mashupLicense string) error {
+	if component.Developer == mashupDev {
+		return nil
+	}
+	switch serviceLicense(component) {
+	case L_Proprietary:
+		return fmt.Errorf("service %s is proprietary and can not be composed", component.Name)
+	case L_Attribution:
+		if mashupPrice.Sign() > 0 {
+			return fmt.Errorf("service %s is licensed for attribution only, the mashup must be free", component.Name)
+		}
+		if mashupLicense == L_Proprietary {
+			return fmt.Errorf("service %s is licensed for attribution only, the mashup can not be proprietary", component.Name)
+		}
+	case L_Royalty:
+		if mashupPrice.Sign() <= 0 {
+			return fmt.Errorf("service %s is royalty-bearing, the mashup must be priced", component.Name)
+		}
+	}
+	return nil
+}
+
+// serviceVisibility returns the visibility of a service,
+// services registered before visibility existed are public.
+func serviceVisibility(s service) string {
+	if s.Visibility == "" {
+		return V_Public
+	}
+	return s.Visibility
+}
+
+// canAccessService checks whether user "u" can call or compose service "s"
+func canAccessService(s service, u user) bool {
+	if serviceVisibility(s) != V_AllowList || s.Developer == u.Name {
+		return true
+	}
+	if containsString(s.AllowUsers, u.Name) {
+		return true
+	}
+	return u.Organization != "" && containsString(s.AllowOrgs, u.Organization)
+}
+
+// getDevelopedService gets a service and checks that the sender is its developer
+func (t *serviceChaincode) getDevelopedService(stub shim.ChaincodeStubInterface, serviceName string) (service, error) {
+	var serviceJSON service
+	serviceName, err := t.resolveServiceName(stub, serviceName)
+	if err != nil {
+		return serviceJSON, err
+	}
+	serviceAsBytes, err := stub.GetState(ServicePrefix + serviceName)
+	if err != nil {
+		return serviceJSON, fmt.Errorf("fail to get service: %s", err.Error())
+	} else if serviceAsBytes == nil {
+		return serviceJSON, fmt.Errorf("this service does not exist: %s", serviceName)
+	}
+	err = json.Unmarshal(serviceAsBytes, &serviceJSON)
+	if err != nil {
+		return serviceJSON, fmt.Errorf("error unmarshal service bytes")
+	}
+
+	senderAdd, err := stub.GetSender()
+	if err != nil {
+		return serviceJSON, fmt.Errorf("fail to get the sender's address")
+	}
+	devAsBytes, err := stub.GetState(UserPrefix + serviceJSON.Developer)
+	if err != nil || devAsBytes == nil {
+		return serviceJSON, fmt.Errorf("error get the developer")
+	}
+	var DevJSON user
+	err = json.Unmarshal(devAsBytes, &DevJSON)
+	if err != nil {
+		return serviceJSON, fmt.Errorf("error unmarshal user bytes")
+	}
+	if senderAdd != DevJSON.Address {
+		return serviceJSON, fmt.Errorf("authority err! not invoked by the service's developer")
+	}
+	return serviceJSON, nil
+}
+
+// saveService stores a service and its copy indexed by the developer's name.
+// The resource of a service registered before resources were stored apart is moved out
+// of the record and kept unencrypted, unless the developer has stored one since.
+func (t *serviceChaincode) saveService(stub shim.ChaincodeStubInterface, s service) error {
+	if s.Resource != "" {
+		stored, err := stub.GetState(ResourcePrefix + s.Name)
+		if err != nil {
+			return err
+		}
+		if stored == nil {
+			err = t.saveServiceResource(stub, s.Name, s.Resource)
+			if err != nil {
+				return err
+			}
+			s.PlainResource = true
+		}
+		s.Resource = ""
+	}
+	serviceJSONasBytes, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	err = stub.PutState(ServicePrefix+s.Name, serviceJSONasBytes)
+	if err != nil {
+		return err
+	}
+	return t.saveServiceByUserName(stub, s.Developer, s.Name, serviceJSONasBytes)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func removeString(list []string, s string) []string {
+	result := make([]string, 0, len(list))
+	for _, v := range list {
+		if v != s {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// saveServiceResource stores the resource of a service, encrypted by its developer, apart from its public record
+func (t *serviceChaincode) saveServiceResource(stub shim.ChaincodeStubInterface, serviceName string, resource string) error {
+	if resource == "" {
+		return stub.DelState(ResourcePrefix + serviceName)
+	}
+	return stub.PutState(ResourcePrefix+serviceName, []byte(resource))
+}
+
+// renameServiceRecords moves the records stored under prefix+service name of a migrated service
+// to its new name. Keys of other services starting with the flat name are told apart by the
+// service name in the record.
+func (t *serviceChaincode) renameServiceRecords(stub shim.ChaincodeStubInterface, prefix string, flatName string, newName string) error {
+	resultsIterator, err := stub.GetStateByRange(prefix+flatName, prefix+flatName+"~")
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+	for resultsIterator.HasNext() {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		var record struct {
+			ServiceName string `json:"service_name"`
+		}
+		if json.Unmarshal(responseRange.Value, &record) != nil || record.ServiceName != flatName {
+			continue
+		}
+		value, err := renameServiceFields(responseRange.Value, flatName, newName)
+		if err != nil {
+			return err
+		}
+		err = stub.PutState(prefix+newName+strings.TrimPrefix(responseRange.Key, prefix+flatName), value)
+		if err != nil {
+			return err
+		}
+		err = stub.DelState(responseRange.Key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renameServiceKeys moves the composite keys of objectType whose attribute at "position" is the
+// flat name of a migrated service to its new name, renaming the service in their values too.
+func (t *serviceChaincode) renameServiceKeys(stub shim.ChaincodeStubInterface, objectType string, position int, flatName string, newName string) error {
+	var partial []string
+	if position == 0 {
+		partial = []string{flatName}
+	}
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(objectType, partial)
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+	for resultsIterator.HasNext() {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		_, keys, err := stub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return err
+		}
+		if len(keys) <= position || keys[position] != flatName {
+			continue
+		}
+		keys[position] = newName
+		compositeKey, err := stub.CreateCompositeKey(objectType, keys)
+		if err != nil {
+			return fmt.Errorf("create composite key error: %s", err.Error())
+		}
+		value, err := renameServiceFields(responseRange.Value, flatName, newName)
+		if err != nil {
+			return err
+		}
+		err = stub.PutState(compositeKey, value)
+		if err != nil {
+			return err
+		}
+		err = stub.DelState(responseRange.Key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renameServiceFields renames a migrated service in a stored record: its service name, and the keys
+// of its state built from the service name. Values that are not JSON objects are kept as they are.
+func renameServiceFields(value []byte, flatName string, newName string) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(value, &fields) != nil {
+		return value, nil
+	}
+	var serviceName string
+	if json.Unmarshal(fields["service_name"], &serviceName) != nil || serviceName != flatName {
+		return value, nil
+	}
+	renamed := map[string]string{"service_name": newName}
+	for field, prefix := range map[string]string{"service_call_time_key": ServiceCallTimesPrefix, "reduce_key": ReduceRecordPrefix} {
+		var key string
+		if json.Unmarshal(fields[field], &key) == nil && strings.HasPrefix(key, prefix+flatName) {
+			renamed[field] = prefix + newName + strings.TrimPrefix(key, prefix+flatName)
+		}
+	}
+	for field, v := range renamed {
+		raw, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		fields[field] = raw
+	}
+	return json.Marshal(fields)
+}
+
+// qualifiedServiceName returns the name of service "name" in the namespace of "developer"
+func qualifiedServiceName(developer string, name string) string {
+	return developer + NamespaceSeparator + name
+}
+
+// resolveServiceName maps a service name given by a client to the name the service is stored under.
+// A namespaced name ("developer/service") is used as it is; a flat name is either a service
+// registered before namespaces existed, or the alias of a migrated service.
+func (t *serviceChaincode) resolveServiceName(stub shim.ChaincodeStubInterface, name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if strings.Contains(name, NamespaceSeparator) {
+		return name, nil
+	}
+	serviceAsBytes, err := stub.GetState(ServicePrefix + name)
+	if err != nil {
+		return name, fmt.Errorf("fail to get service: %s", err.Error())
+	} else if serviceAsBytes != nil {
+		return name, nil
+	}
+	alias, err := stub.GetState(ServiceAliasPrefix + name)
+	if err != nil {
+		return name, fmt.Errorf("fail to get service alias: %s", err.Error())
+	} else if alias != nil {
+		return string(alias), nil
+	}
+	return name, nil
+}
+
+// getQuotaUsage gets a caller's usage of a service's quota at unix time "now",
+// windows that have passed are reset.
+func (t *serviceChaincode) getQuotaUsage(stub shim.ChaincodeStubInterface, serviceName string, caller string, now int64) (quotaUsage, string, error) {
+	usage := quotaUsage{ServiceName: serviceName, UserName: caller}
+	usageKey, err := stub.CreateCompositeKey(QuotaUsageKey, []string{serviceName, caller})
+	if err != nil {
+		return usage, "", fmt.Errorf("create composite key error: %s", err.Error())
+	}
+	usageAsBytes, err := stub.GetState(usageKey)
+	if err != nil {
+		return usage, "", fmt.Errorf("get quota usage failed: %s", err.Error())
+	} else if usageAsBytes != nil {
+		err = json.Unmarshal(usageAsBytes, &usage)
+		if err != nil {
+			return usage, "", fmt.Errorf("unmarshal quota usage failed: %s", err.Error())
+		}
+	}
+
+	hourStart := now - now%QuotaHour
+	if usage.HourStart != hourStart {
+		usage.HourStart = hourStart
+		usage.HourCalls = 0
+	}
+	dayStart := now - now%QuotaDay
+	if usage.DayStart != dayStart {
+		usage.DayStart = dayStart
+		usage.DayCalls = 0
+	}
+	return usage, usageKey, nil
+}
+
+// consumeQuota counts "calls" calls of "caller" against the service's quotas,
+// it fails if a quota would be exceeded.
+func (t *serviceChaincode) consumeQuota(stub shim.ChaincodeStubInterface, s service, caller string, calls int64, now int64) error {
+	if s.QuotaPerHour <= 0 && s.QuotaPerDay <= 0 {
+		return nil
+	}
+	usage, usageKey, err := t.getQuotaUsage(stub, s.Name, caller, now)
+	if err != nil {
+		return err
+	}
+	if s.QuotaPerHour > 0 && usage.HourCalls+calls > s.QuotaPerHour {
+		return fmt.Errorf("hourly quota exceeded, %d calls left", s.QuotaPerHour-usage.HourCalls)
+	}
+	if s.QuotaPerDay > 0 && usage.DayCalls+calls > s.QuotaPerDay {
+		return fmt.Errorf("daily quota exceeded, %d calls left", s.QuotaPerDay-usage.DayCalls)
+	}
+	usage.HourCalls += calls
+	usage.DayCalls += calls
+	usageAsBytes, err := json.Marshal(usage)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(usageKey, usageAsBytes)
+}
+
+// releaseQuota takes back "calls" calls of "caller" counted by consumeQuota at unix time "at",
+// from the windows open at unix time "now" that they were counted in
+func (t *serviceChaincode) releaseQuota(stub shim.ChaincodeStubInterface, s service, caller string, calls int64, at int64, now int64) error {
+	if s.QuotaPerHour <= 0 && s.QuotaPerDay <= 0 {
+		return nil
+	}
+	usage, usageKey, err := t.getQuotaUsage(stub, s.Name, caller, now)
+	if err != nil {
+		return err
+	}
+	if usage.HourStart == at-at%QuotaHour {
+		usage.HourCalls -= calls
+		if usage.HourCalls < 0 {
+			usage.HourCalls = 0
+		}
+	}
+	if usage.DayStart == at-at%QuotaDay {
+		usage.DayCalls -= calls
+		if usage.DayCalls < 0 {
+			usage.DayCalls = 0
+		}
+	}
+	usageAsBytes, err := json.Marshal(usage)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(usageKey, usageAsBytes)
+}
+
+// splitLotsRevenue splits the fee paid for "lots" of service "s" by the revenue terms every lot
+// was bought with; lots bought before terms were recorded are split by the current terms.
+func (t *serviceChaincode) splitLotsRevenue(stub shim.ChaincodeStubInterface, s service, lots []callTimeLot) (map[string]*big.Int, error) {
+	shares := map[string]*big.Int{s.Developer: big.NewInt(0)}
+	var current *revenueTerms
+	for _, lot := range lots {
+		if lot.Paid == nil || lot.Paid.Sign() <= 0 {
+			continue
+		}
+		terms := lot.Terms
+		if terms == nil {
+			if current == nil {
+				var err error
+				current, err = t.getRevenueTerms(stub, s)
+				if err != nil {
+					return nil, err
+				}
+			}
+			terms = current
+		}
+		for name, amount := range splitRevenue(s.Developer, *terms, lot.Paid) {
+			if shares[name] == nil {
+				shares[name] = big.NewInt(0)
+			}
+			shares[name].Add(shares[name], amount)
+		}
+	}
+	return shares, nil
+}
+
+// getRevenueTerms gets the current revenue terms of service "s": a fork records the
+// royalty it pays to the original mashup's developer, a mashup the weight of every
+// component's developer in its revenue share.
+func (t *serviceChaincode) getRevenueTerms(stub shim.ChaincodeStubInterface, s service) (*revenueTerms, error) {
+	terms := &revenueTerms{}
+	if s.ForkedFrom != "" && s.ForkRoyalty > 0 {
+		originName, err := t.resolveServiceName(stub, s.ForkedFrom)
+		if err != nil {
+			return nil, err
+		}
+		originAsBytes, err := stub.GetState(ServicePrefix + originName)
+		if err != nil {
+			return nil, fmt.Errorf("fail to get service: %s", err.Error())
+		} else if originAsBytes == nil {
+			return nil, fmt.Errorf("this service doesn't exist: %s", s.ForkedFrom)
+		}
+		var origin service
+		err = json.Unmarshal(originAsBytes, &origin)
+		if err != nil {
+			return nil, fmt.Errorf("error unmarshal service bytes")
+		}
+		terms.ForkDeveloper = origin.Developer
+		terms.ForkRoyalty = s.ForkRoyalty
+	}
+	if s.IsMashup && s.ComponentShare > 0 {
+		components := make([]string, 0, len(s.Composition))
+		for k := range s.Composition {
+			components = append(components, k)
+		}
+		sort.Strings(components)
+
+		terms.ComponentShare = s.ComponentShare
+		terms.Weights = make(map[string]int64)
+		for _, k := range components {
+			weight, ok := s.RevenueShare[k]
+			if !ok {
+				weight = int64(s.Composition[k])
+			}
+			if weight == 0 {
+				continue
+			}
+			componentName, err := t.resolveServiceName(stub, k)
+			if err != nil {
+				return nil, err
+			}
+			componentAsBytes, err := stub.GetState(ServicePrefix + componentName)
+			if err != nil {
+				return nil, fmt.Errorf("fail to get service: %s", err.Error())
+			} else if componentAsBytes == nil {
+				return nil, fmt.Errorf("this service doesn't exist: %s", k)
+			}
+			var component service
+			err = json.Unmarshal(componentAsBytes, &component)
+			if err != nil {
+				return nil, fmt.Errorf("error unmarshal service bytes")
+			}
+			terms.Weights[component.Developer] += weight
+		}
+	}
+	return terms, nil
+}
+
+// splitRevenue splits "amount" paid for a service of "developer" by "terms".
+// A plain service's payment goes to its developer; a fork first pays its royalty to the
+// original mashup's developer; a mashup's payment is shared with its components' developers
+// by their weights; the remainder goes to the developer.
+func splitRevenue(developer string, terms revenueTerms, amount *big.Int) map[string]*big.Int {
+	shares := make(map[string]*big.Int)
+	remainder := new(big.Int).Set(amount)
+	if terms.ForkDeveloper != "" && terms.ForkRoyalty > 0 && amount.Sign() > 0 {
+		royalty := new(big.Int).Mul(amount, big.NewInt(terms.ForkRoyalty))
+		royalty.Quo(royalty, big.NewInt(100))
+		if royalty.Sign() > 0 {
+			shares[terms.ForkDeveloper] = royalty
+			remainder.Sub(remainder, royalty)
+		}
+	}
+	if terms.ComponentShare > 0 && amount.Sign() > 0 {
+		pool := new(big.Int).Mul(remainder, big.NewInt(terms.ComponentShare))
+		pool.Quo(pool, big.NewInt(100))
+
+		developers := make([]string, 0, len(terms.Weights))
+		total := int64(0)
+		for k, weight := range terms.Weights {
+			developers = append(developers, k)
+			total += weight
+		}
+		sort.Strings(developers)
+		if total > 0 {
+			for _, k := range developers {
+				part := new(big.Int).Mul(pool, big.NewInt(terms.Weights[k]))
+				part.Quo(part, big.NewInt(total))
+				if part.Sign() == 0 {
+					continue
+				}
+				if shares[k] == nil {
+					shares[k] = big.NewInt(0)
+				}
+				shares[k].Add(shares[k], part)
+				remainder.Sub(remainder, part)
+			}
+		}
+	}
+	if shares[developer] == nil {
+		shares[developer] = big.NewInt(0)
+	}
+	shares[developer].Add(shares[developer], remainder)
+	return shares
+}
+
+// recordPayouts records a payout for every user's share of a payment
+func (t *serviceChaincode) recordPayouts(stub shim.ChaincodeStubInterface, serviceName string, payer string, shares map[string]*big.Int, createTime string) error {
+	recipients := make([]string, 0, len(shares))
+	for k := range shares {
+		recipients = append(recipients, k)
+	}
+	sort.Strings(recipients)
+
+	for _, recipient := range recipients {
+		amount := shares[recipient]
+		if amount.Sign() == 0 {
+			continue
+		}
+		payout := payoutRecord{serviceName, payer, recipient, amount, createTime}
+		payoutJson, err := json.Marshal(payout)
+		if err != nil {
+			return err
+		}
+		payoutKey, err := stub.CreateCompositeKey(PayoutKey, []string{recipient, serviceName, stub.GetTxID(), payer})
+		if err != nil {
+			return fmt.Errorf("create composite key error: %s", err.Error())
+		}
+		err = stub.PutState(payoutKey, payoutJson)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addRefundDues records the refunds owed to "buyer" by every user in the transaction
+func (t *serviceChaincode) addRefundDues(stub shim.ChaincodeStubInterface, buyer string, amounts map[string]*big.Int, seconds int64) error {
+	debtors := make([]string, 0, len(amounts))
+	for k := range amounts {
+		debtors = append(debtors, k)
+	}
+	sort.Strings(debtors)
+
+	for _, debtor := range debtors {
+		due := refundDue{stub.GetTxID(), debtor, buyer, amounts[debtor], formatTime(seconds), formatTime(seconds)}
+		dueJson, err := json.Marshal(due)
+		if err != nil {
+			return err
+		}
+		dueKey, err := stub.CreateCompositeKey(RefundDueKey, []string{debtor, fmt.Sprintf("%020d", seconds), stub.GetTxID()})
+		if err != nil {
+			return fmt.Errorf("create composite key error: %s", err.Error())
+		}
+		err = stub.PutState(dueKey, dueJson)
+		if err != nil {
+			return fmt.Errorf("save refund due failed: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// getRefundDues gets the refunds "debtor" owes, the earliest first, along with their keys
+func (t *serviceChaincode) getRefundDues(stub shim.ChaincodeStubInterface, debtor string) ([]refundDue, []string, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(RefundDueKey, []string{debtor})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resultsIterator.Close()
+
+	dues := make([]refundDue, 0)
+	keys := make([]string, 0)
+	for resultsIterator.HasNext() {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+		var due refundDue
+		err = json.Unmarshal(responseRange.Value, &due)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unmarshal refund due failed: %s", err.Error())
+		}
+		dues = append(dues, due)
+		keys = append(keys, responseRange.Key)
+	}
+	return dues, keys, nil
+}
+
+// payRefundDue pays at most "most" of refund "due", stored under "dueKey", from the sender
+// to the buyer, and saves what is left of it. It returns the amount paid.
+func (t *serviceChaincode) payRefundDue(stub shim.ChaincodeStubInterface, due *refundDue, dueKey string, most *big.Int, updateTime string) (*big.Int, error) {
+	amount := new(big.Int).Set(due.Amount)
+	if amount.Cmp(most) > 0 {
+		amount.Set(most)
+	}
+	buyerAsBytes, err := stub.GetState(UserPrefix + due.Buyer)
+	if err != nil {
+		return nil, fmt.Errorf("fail to get user: %s", err.Error())
+	} else if buyerAsBytes == nil {
+		return nil, fmt.Errorf("this user doesn't exist: %s", due.Buyer)
+	}
+	var buyer user
+	err = json.Unmarshal(buyerAsBytes, &buyer)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshal user bytes")
+	}
+	sender, err := stub.GetSender()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sender: %s", err.Error())
+	}
+	// a buyer paying a user who owes them a refund keeps it
+	if buyer.Address != sender {
+		err = stub.Transfer(buyer.Address, FeeBalanceType, amount)
+		if err != nil {
+			return nil, fmt.Errorf("transfer refund failed: %s", err.Error())
+		}
+	}
+
+	due.Amount = new(big.Int).Sub(due.Amount, amount)
+	due.UpdateTime = updateTime
+	if due.Amount.Sign() <= 0 {
+		return amount, stub.DelState(dueKey)
+	}
+	dueJson, err := json.Marshal(due)
+	if err != nil {
+		return nil, err
+	}
+	err = stub.PutState(dueKey, dueJson)
+	if err != nil {
+		return nil, fmt.Errorf("save refund due failed: %s", err.Error())
+	}
+	return amount, nil
+}
+
+// saveCallTimeRecord saves a call time record, and its copy indexed by the service name
+func (t *serviceChaincode) saveCallTimeRecord(stub shim.ChaincodeStubInterface, record serviceCallTime) error {
+	recordJson, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("marshal call time info failed: %s", err.Error())
+	}
+	recordKey := ServiceCallTimesPrefix + record.ServiceName + record.UserName
+	err = stub.PutState(recordKey, recordJson)
+	if err != nil {
+		return fmt.Errorf("update call time failed: %s", err.Error())
+	}
+	return t.saveCallTimesByServiceName(stub, record.ServiceName, recordKey, recordJson)
+}
+
+// creditLots adds the lots of call times to the call times of user "to" of a service
+func (t *serviceChaincode) creditLots(stub shim.ChaincodeStubInterface, serviceName string, to user, lots []callTimeLot, updateTime string) error {
+	var record serviceCallTime
+
+	callTimesJson, err := stub.GetState(ServiceCallTimesPrefix + serviceName + to.Name)
+	if err != nil {
+		return fmt.Errorf("get call time info failed: %s", err.Error())
+	} else if callTimesJson != nil {
+		err = json.Unmarshal(callTimesJson, &record)
+		if err != nil {
+			return fmt.Errorf("unmarshal call time info failed: %s", err.Error())
+		}
+	} else {
+		record = serviceCallTime{serviceName, to.Name, to.Address, big.NewInt(0), big.NewInt(0), big.NewInt(0), 0, nil, updateTime, updateTime}
+	}
+	normalizeLots(&record)
+	record.Lots = append(record.Lots, lots...)
+	sumLots(&record)
+	record.UpdateTime = updateTime
+	return t.saveCallTimeRecord(stub, record)
+}
+
+// saveTransfer saves a call time transfer into the histories of both users,
+// and keeps it for approval while it is pending
+func (t *serviceChaincode) saveTransfer(stub shim.ChaincodeStubInterface, transfer callTimeTransfer) error {
+	transferJson, err := json.Marshal(transfer)
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{transfer.From, transfer.To} {
+		logKey, err := stub.CreateCompositeKey(TransferLogKey, []string{name, transfer.ServiceName, transfer.ID})
+		if err != nil {
+			return fmt.Errorf("create composite key error: %s", err.Error())
+		}
+		err = stub.PutState(logKey, transferJson)
+		if err != nil {
+			return err
+		}
+	}
+	transferKey, err := stub.CreateCompositeKey(TransferKey, []string{transfer.ServiceName, transfer.ID})
+	if err != nil {
+		return fmt.Errorf("create composite key error: %s", err.Error())
+	}
+	if transfer.Status == T_Pending {
+		return stub.PutState(transferKey, transferJson)
+	}
+	return stub.DelState(transferKey)
+}
+
+// getPendingTransfers gets the transfers of a service's call times waiting for approval
+func (t *serviceChaincode) getPendingTransfers(stub shim.ChaincodeStubInterface, serviceName string) ([]callTimeTransfer, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(TransferKey, []string{serviceName})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	transfers := make([]callTimeTransfer, 0)
+	for resultsIterator.HasNext() {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var transfer callTimeTransfer
+		err = json.Unmarshal(responseRange.Value, &transfer)
+		if err != nil {
+			return nil, err
+		}
+		transfers = append(transfers, transfer)
+	}
+	return transfers, nil
+}
+
+// expireTransferLots removes the lots of a pending transfer expired at unix time "now" and returns them,
+// the transfer expires if no lot is left
+func expireTransferLots(transfer *callTimeTransfer, now int64) []callTimeLot {
+	record := serviceCallTime{Lots: transfer.Lots}
+	lots := expireLots(&record, now)
+	transfer.Lots = record.Lots
+	transfer.CallTimes = record.CallTimes
+	transfer.Paid = record.Paid
+	if len(transfer.Lots) == 0 {
+		transfer.Status = T_Expired
+	}
+	return lots
+}
+
+// getSellOrder gets a sell order of a service by its id
+func (t *serviceChaincode) getSellOrder(stub shim.ChaincodeStubInterface, serviceName string, id string) (sellOrder, error) {
+	var order sellOrder
+	orderKey, err := stub.CreateCompositeKey(SellOrderKey, []string{serviceName, id})
+	if err != nil {
+		return order, fmt.Errorf("create composite key error: %s", err.Error())
+	}
+	orderAsBytes, err := stub.GetState(orderKey)
+	if err != nil {
+		return order, fmt.Errorf("get sell order failed: %s", err.Error())
+	} else if orderAsBytes == nil {
+		return order, fmt.Errorf("sell order does not exist: %s", id)
+	}
+	err = json.Unmarshal(orderAsBytes, &order)
+	if err != nil {
+		return order, fmt.Errorf("unmarshal sell order failed: %s", err.Error())
+	}
+	return order, nil
+}
+
+// getOpenSellOrders gets the open sell orders of a service, by price and then by creation
+func (t *serviceChaincode) getOpenSellOrders(stub shim.ChaincodeStubInterface, serviceName string) ([]sellOrder, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(SellOrderKey, []string{serviceName})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	orders := make([]sellOrder, 0)
+	for resultsIterator.HasNext() {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var order sellOrder
+		err = json.Unmarshal(responseRange.Value, &order)
+		if err != nil {
+			return nil, err
+		}
+		if order.Status == O_Open {
+			orders = append(orders, order)
+		}
+	}
+	sort.SliceStable(orders, func(i, j int) bool {
+		if c := orders[i].UnitPrice.Cmp(orders[j].UnitPrice); c != 0 {
+			return c < 0
+		}
+		return orders[i].CreateTime < orders[j].CreateTime
+	})
+	return orders, nil
+}
+
+// saveSellOrder saves a sell order and returns it marshaled
+func (t *serviceChaincode) saveSellOrder(stub shim.ChaincodeStubInterface, order sellOrder) ([]byte, error) {
+	orderJson, err := json.Marshal(order)
+	if err != nil {
+		return nil, err
+	}
+	orderKey, err := stub.CreateCompositeKey(SellOrderKey, []string{order.ServiceName, order.ID})
+	if err != nil {
+		return nil, fmt.Errorf("create composite key error: %s", err.Error())
+	}
+	err = stub.PutState(orderKey, orderJson)
+	if err != nil {
+		return nil, fmt.Errorf("save sell order failed: %s", err.Error())
+	}
+	return orderJson, nil
+}
+
+// matchSellOrders takes up to "callTimes" call times of service "s" for "buyer" out of the cheapest
+// open sell orders of other users, at most at "maxPrice" per call, and saves the orders. It returns
+// the trades, the payments due to the sellers and the developer, and the lots taken.
+func (t *serviceChaincode) matchSellOrders(stub shim.ChaincodeStubInterface, s service, buyer string, callTimes *big.Int, maxPrice *big.Int, now int64) ([]resaleTrade, map[string]*big.Int, []callTimeLot, error) {
+	orders, err := t.getOpenSellOrders(stub, s.Name)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	trades := make([]resaleTrade, 0)
+	payments := make(map[string]*big.Int)
+	bought := make([]callTimeLot, 0)
+	left := new(big.Int).Set(callTimes)
+	for _, order := range orders {
+		if left.Sign() <= 0 || order.UnitPrice.Cmp(maxPrice) > 0 {
+			break
+		}
+		if order.Seller == buyer {
+			continue
+		}
+		record := serviceCallTime{Lots: order.Lots}
+		available := availableCallTimes(&record, now, nil)
+		if available.Sign() <= 0 {
+			continue
+		}
+		take := new(big.Int).Set(left)
+		if take.Cmp(available) > 0 {
+			take.Set(available)
+		}
+		bought = append(bought, splitLots(&record, take, now, nil)...)
+		left.Sub(left, take)
+
+		total := new(big.Int).Mul(take, order.UnitPrice)
+		royalty := addResalePayments(payments, s, order.Seller, total)
+		trades = append(trades, resaleTrade{order.ID, s.Name, order.Seller, buyer, take, order.UnitPrice, total, royalty, formatTime(now)})
+
+		order.Lots = record.Lots
+		order.CallTimes = record.CallTimes
+		if order.CallTimes.Sign() <= 0 {
+			order.Status = O_Filled
+		}
+		order.UpdateTime = formatTime(now)
+		_, err = t.saveSellOrder(stub, order)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	return trades, payments, bought, nil
+}
+
+// addResalePayments adds the payments of "total" paid for call times of service "s" resold by
+// "seller": the seller is paid the total less the developer's royalty. It returns the royalty.
+func addResalePayments(payments map[string]*big.Int, s service, seller string, total *big.Int) *big.Int {
+	royalty := new(big.Int).Mul(total, big.NewInt(s.ResaleRoyalty))
+	royalty.Quo(royalty, big.NewInt(100))
+	if payments[seller] == nil {
+		payments[seller] = big.NewInt(0)
+	}
+	payments[seller].Add(payments[seller], new(big.Int).Sub(total, royalty))
+	if payments[s.Developer] == nil {
+		payments[s.Developer] = big.NewInt(0)
+	}
+	payments[s.Developer].Add(payments[s.Developer], royalty)
+	return royalty
+}
+
+// recordResale gives "buyer" the lots bought from other users of service "s" in the transaction,
+// and saves the trades and the buy record of the purchase.
+func (t *serviceChaincode) recordResale(stub shim.ChaincodeStubInterface, s service, buyer user, trades []resaleTrade, lots []callTimeLot, seconds int64) error {
+	createTime := formatTime(seconds)
+	err := t.creditLots(stub, s.Name, buyer, lots, createTime)
+	if err != nil {
+		return err
+	}
+	callTimes := big.NewInt(0)
+	total := big.NewInt(0)
+	for _, trade := range trades {
+		tradeJson, err := json.Marshal(trade)
+		if err != nil {
+			return err
+		}
+		tradeKey, err := stub.CreateCompositeKey(ResaleTradeKey, []string{s.Name, stub.GetTxID(), trade.OrderID})
+		if err != nil {
+			return fmt.Errorf("create composite key error: %s", err.Error())
+		}
+		err = stub.PutState(tradeKey, tradeJson)
+		if err != nil {
+			return fmt.Errorf("save trade failed: %s", err.Error())
+		}
+		callTimes.Add(callTimes, trade.CallTimes)
+		total.Add(total, trade.Total)
+	}
+
+	recordKey := ServiceCallTimesPrefix + s.Name + buyer.Name
+	purchase := buyRecord{recordKey, s.Name, buyer.Name, stub.GetTxID(), callTimes, total, createTime, true}
+	buyRecordJson, err := json.Marshal(purchase)
+	if err != nil {
+		return fmt.Errorf("marshal buy record failed: %s", err.Error())
+	}
+	err = stub.PutState(BuyRecordPrefix+s.Name+buyer.Name+stub.GetTxID(), buyRecordJson)
+	if err != nil {
+		return fmt.Errorf("save buy record failed: %s", err.Error())
+	}
+	return t.indexRecord(stub, UserPurchaseKey, ServicePurchaseKey, buyer.Name, s.Name, seconds, stub.GetTxID(), buyRecordJson)
+}
+
+// transferToUsers pays the amounts from the sender to each user, one transfer per user.
+// The refunds a user owes are paid first out of their amount, the earliest first. All the
+// amounts paid in one transaction must be paid at once, as the state read in a transaction
+// does not reflect its own writes.
+func (t *serviceChaincode) transferToUsers(stub shim.ChaincodeStubInterface, amounts map[string]*big.Int) error {
+	updateTime, err := txTime(stub)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(amounts))
+	for k := range amounts {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		amount := new(big.Int).Set(amounts[name])
+		if amount.Sign() <= 0 {
+			continue
+		}
+		dues, keys, err := t.getRefundDues(stub, name)
+		if err != nil {
+			return err
+		}
+		for i := range dues {
+			if amount.Sign() <= 0 {
+				break
+			}
+			paid, err := t.payRefundDue(stub, &dues[i], keys[i], amount, updateTime)
+			if err != nil {
+				return err
+			}
+			amount.Sub(amount, paid)
+		}
+		if amount.Sign() <= 0 {
+			continue
+		}
+		userAsBytes, err := stub.GetState(UserPrefix + name)
+		if err != nil {
+			return fmt.Errorf("fail to get user: %s", err.Error())
+		} else if userAsBytes == nil {
+			return fmt.Errorf("this user doesn't exist: %s", name)
+		}
+		var userJSON user
+		err = json.Unmarshal(userAsBytes, &userJSON)
+		if err != nil {
+			return fmt.Errorf("error unmarshal user bytes")
+		}
+		err = stub.Transfer(userJSON.Address, FeeBalanceType, amount)
+		if err != nil {
+			return fmt.Errorf("error when making transfer: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// usageReceipt is the message a caller signs to count its calls of a service
+func usageReceipt(serviceName string, caller string, cumulative *big.Int, nonce uint64) string {
+	return fmt.Sprintf("%s|%s|%s|%d", serviceName, caller, cumulative.String(), nonce)
+}
+
+// parseUsageKey parses a hex encoded uncompressed P-256 public key
+func parseUsageKey(key string) (*ecdsa.PublicKey, error) {
+	keyBytes, err := hex.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("usage key must be hex encoded")
+	}
+	x, y := elliptic.Unmarshal(elliptic.P256(), keyBytes)
+	if x == nil {
+		return nil, fmt.Errorf("usage key must be an uncompressed P-256 point")
+	}
+	return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+}
+
+// verifyUsageReceipt checks "signature", a hex encoded ASN.1 ECDSA signature,
+// signs the SHA-256 digest of "receipt" with the usage key "key"
+func verifyUsageReceipt(key string, receipt string, signature string) error {
+	publicKey, err := parseUsageKey(key)
+	if err != nil {
+		return err
+	}
+	signatureBytes, err := hex.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("signature must be hex encoded")
+	}
+	var sig ecdsaSignature
+	rest, err := asn1.Unmarshal(signatureBytes, &sig)
+	if err != nil || len(rest) > 0 || sig.R == nil || sig.S == nil {
+		return fmt.Errorf("invalid signature")
+	}
+	digest := sha256.Sum256([]byte(receipt))
+	if !ecdsa.Verify(publicKey, digest[:], sig.R, sig.S) {
+		return fmt.Errorf("the receipt is not signed by the caller")
+	}
+	return nil
+}
+
+// indexRecord indexes a buy or reduce record by [user, service, time, tx] and [service, time, user, tx]
+func (t *serviceChaincode) indexRecord(stub shim.ChaincodeStubInterface, userIndex string, serviceIndex string, userName string, serviceName string, seconds int64, txID string, record []byte) error {
+	padded := fmt.Sprintf("%020d", seconds)
+	userKey, err := stub.CreateCompositeKey(userIndex, []string{userName, serviceName, padded, txID})
+	if err != nil {
+		return fmt.Errorf("create composite key error: %s", err.Error())
+	}
+	err = stub.PutState(userKey, record)
+	if err != nil {
+		return fmt.Errorf("index record failed: %s", err.Error())
+	}
+	serviceKey, err := stub.CreateCompositeKey(serviceIndex, []string{serviceName, padded, userName, txID})
+	if err != nil {
+		return fmt.Errorf("create composite key error: %s", err.Error())
+	}
+	err = stub.PutState(serviceKey, record)
+	if err != nil {
+		return fmt.Errorf("index record failed: %s", err.Error())
+	}
+	return nil
+}
+
+// isIndexed checks if the record of "userName" with "serviceName" saved by the transaction "txID" at
+// unix time "seconds" is indexed by "userIndex". Records saved before they were keyed by transaction
+// have no tx id, any record of the user with the service at that time is taken for them.
+func (t *serviceChaincode) isIndexed(stub shim.ChaincodeStubInterface, userIndex string, userName string, serviceName string, seconds int64, txID string) (bool, error) {
+	padded := fmt.Sprintf("%020d", seconds)
+	key, err := stub.CreateCompositeKey(userIndex, []string{userName, serviceName, padded, txID})
+	if err != nil {
+		return false, fmt.Errorf("create composite key error: %s", err.Error())
+	}
+	recordAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return false, err
+	} else if recordAsBytes != nil || txID != "" {
+		return recordAsBytes != nil, nil
+	}
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(userIndex, []string{userName, serviceName, padded})
+	if err != nil {
+		return false, err
+	}
+	defer resultsIterator.Close()
+	return resultsIterator.HasNext(), nil
+}
+
+// getProcessedRequest gets the result of the request "requestID" of "sender" processed before,
+// nil if not processed. The request id can't be reused for other args.
+func (t *serviceChaincode) getProcessedRequest(stub shim.ChaincodeStubInterface, sender string, function string, requestID string, args []string) ([]byte, error) {
+	requestKey, err := stub.CreateCompositeKey(RequestKey, []string{sender, function, requestID})
+	if err != nil {
+		return nil, fmt.Errorf("create composite key error: %s", err.Error())
+	}
+	requestAsBytes, err := stub.GetState(requestKey)
+	if err != nil {
+		return nil, fmt.Errorf("get processed request failed: %s", err.Error())
+	} else if requestAsBytes == nil {
+		return nil, nil
+	}
+	var request processedRequest
+	err = json.Unmarshal(requestAsBytes, &request)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal processed request failed: %s", err.Error())
+	}
+	if len(request.Args) != len(args) {
+		return nil, fmt.Errorf("request id %s is used by another request", requestID)
+	}
+	for i := range args {
+		if strings.TrimSpace(request.Args[i]) != strings.TrimSpace(args[i]) {
+			return nil, fmt.Errorf("request id %s is used by another request", requestID)
+		}
+	}
+	return request.Result, nil
+}
+
+// saveProcessedRequest saves the result of the request "requestID" of "sender"
+func (t *serviceChaincode) saveProcessedRequest(stub shim.ChaincodeStubInterface, sender string, function string, requestID string, args []string, result []byte, createTime string) error {
+	requestKey, err := stub.CreateCompositeKey(RequestKey, []string{sender, function, requestID})
+	if err != nil {
+		return fmt.Errorf("create composite key error: %s", err.Error())
+	}
+	requestAsBytes, err := json.Marshal(processedRequest{function, args, result, createTime})
+	if err != nil {
+		return err
+	}
+	return stub.PutState(requestKey, requestAsBytes)
+}
+
+// formatTime formats a unix time the way times are stored, in RFC 3339
+func formatTime(seconds int64) string {
+	return time.Unix(seconds, 0).UTC().Format(time.RFC3339)
+}
+
+// txTime gets the time of the transaction, formatted by formatTime
+func txTime(stub shim.ChaincodeStubInterface) (string, error) {
+	timeStamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return "", fmt.Errorf("can't get timestamp: %s", err.Error())
+	}
+	return formatTime(timeStamp.Seconds), nil
+}
+
+// parseLegacyTime parses a time stored before times were stored in RFC 3339,
+// either in time.UnixDate or the text of a transaction timestamp ("seconds:N nanos:M")
+func parseLegacyTime(value string) (int64, bool) {
+	if tm, err := time.Parse(time.UnixDate, value); err == nil {
+		return tm.Unix(), true
+	}
+	fields := strings.Fields(value)
+	for i, field := range fields {
+		if !strings.HasPrefix(field, "seconds:") {
+			continue
+		}
+		number := strings.TrimPrefix(field, "seconds:")
+		if number == "" && i+1 < len(fields) {
+			number = fields[i+1]
+		}
+		seconds, err := strconv.ParseInt(number, 10, 64)
+		if err == nil {
+			return seconds, true
+		}
+	}
+	return 0, false
+}
+
+// parseRecordTime parses a stored time, in RFC 3339 or a legacy format
+func parseRecordTime(value string) (int64, bool) {
+	if tm, err := time.Parse(time.RFC3339, value); err == nil {
+		return tm.Unix(), true
+	}
+	return parseLegacyTime(value)
+}
+
+// migrateRecordTimes converts the legacy times of a JSON record, and of the records in it,
+// to RFC 3339; it reports whether any time is converted
+func migrateRecordTimes(record []byte) ([]byte, bool, error) {
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(record))
+	decoder.UseNumber()
+	err := decoder.Decode(&value)
+	if err != nil {
+		return nil, false, err
+	}
+	if !migrateTimeFields(value) {
+		return record, false, nil
+	}
+	migrated, err := json.Marshal(value)
+	return migrated, err == nil, err
+}
+
+// migrateTimeFields converts the legacy times in a decoded JSON value,
+// held by the text fields named "...time" or "...Time" (create_time, updatedTime, ...)
+func migrateTimeFields(value interface{}) bool {
+	changed := false
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, field := range v {
+			if str, ok := field.(string); ok {
+				if !strings.HasSuffix(strings.ToLower(k), "time") {
+					continue
+				}
+				if seconds, ok := parseLegacyTime(str); ok {
+					v[k] = formatTime(seconds)
+					changed = true
+				}
+			} else if migrateTimeFields(field) {
+				changed = true
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if migrateTimeFields(item) {
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// selectStrings keeps the strings of "list" that are in "selected"
+func selectStrings(list []string, selected []string) []string {
+	kept := make([]string, 0, len(list))
+	for _, s := range list {
+		if containsString(selected, s) {
+			kept = append(kept, s)
+		}
+	}
+	return kept
+}
+
+// checkAdmin checks the sender is the admin account
+func (t *serviceChaincode) checkAdmin(stub shim.ChaincodeStubInterface) error {
+	accountAsBytes, err := stub.GetState(AdminAccountKey)
+	if err != nil {
+		return fmt.Errorf("fail to get the admin account: %s", err.Error())
+	} else if accountAsBytes == nil {
+		return fmt.Errorf("the admin account is not set")
+	}
+	sender, err := stub.GetSender()
+	if err != nil {
+		return fmt.Errorf("failed to get sender: %s", err.Error())
+	}
+	if sender != string(accountAsBytes) {
+		return fmt.Errorf("authority err! not invoked by the admin account")
+	}
+	return nil
+}
+
+// normalizeLots turns the call times of a record saved before lots were tracked into one lot never expiring
+func normalizeLots(record *serviceCallTime) {
+	if len(record.Lots) > 0 || record.CallTimes == nil || record.CallTimes.Sign() <= 0 {
+		return
+	}
+	paid := big.NewInt(0)
+	if record.Paid != nil {
+		paid.Set(record.Paid)
+	}
+	record.Lots = []callTimeLot{{"", new(big.Int).Set(record.CallTimes), paid, record.BoughtAt, 0, nil}}
+}
+
+// sumLots drops the used up lots of a record and adds up the call times and fee paid left
+func sumLots(record *serviceCallTime) {
+	lots := record.Lots[:0]
+	record.CallTimes = big.NewInt(0)
+	record.Paid = big.NewInt(0)
+	for _, lot := range record.Lots {
+		if lot.CallTimes.Sign() <= 0 && lot.Paid.Sign() <= 0 {
+			continue
+		}
+		record.CallTimes.Add(record.CallTimes, lot.CallTimes)
+		record.Paid.Add(record.Paid, lot.Paid)
+		lots = append(lots, lot)
+	}
+	record.Lots = lots
+}
+
+// lotExpired reports whether the call times of a lot have expired at unix time "now"
+func lotExpired(lot callTimeLot, now int64) bool {
+	return lot.ExpiresAt > 0 && now >= lot.ExpiresAt
+}
+
+// availableCallTimes adds up the call times of the lots in "record" not expired at "now",
+// only the lots accepted by "filter" are counted if it is not nil.
+func availableCallTimes(record *serviceCallTime, now int64, filter func(lot callTimeLot) bool) *big.Int {
+	normalizeLots(record)
+	available := big.NewInt(0)
+	for _, lot := range record.Lots {
+		if lotExpired(lot, now) || (filter != nil && !filter(lot)) {
+			continue
+		}
+		available.Add(available, lot.CallTimes)
+	}
+	return available
+}
+
+// splitLots takes "calls" call times out of the lots in "record" not expired at "now" and
+// accepted by "filter", the lots expiring first are taken first. It returns them as lots
+// keeping their purchase, expiry and revenue terms, with the fee paid for the calls taken,
+// in proportion to the call times left in every lot.
+// The caller checks there are enough call times available.
+func splitLots(record *serviceCallTime, calls *big.Int, now int64, filter func(lot callTimeLot) bool) []callTimeLot {
+	normalizeLots(record)
+	order := make([]int, 0, len(record.Lots))
+	for i, lot := range record.Lots {
+		if lotExpired(lot, now) || (filter != nil && !filter(lot)) {
+			continue
+		}
+		order = append(order, i)
+	}
+	// lots never expiring are taken last, lots bought earlier first
+	sort.SliceStable(order, func(a, b int) bool {
+		x, y := record.Lots[order[a]], record.Lots[order[b]]
+		if x.ExpiresAt != y.ExpiresAt {
+			return y.ExpiresAt == 0 || (x.ExpiresAt != 0 && x.ExpiresAt < y.ExpiresAt)
+		}
+		return x.BoughtAt < y.BoughtAt
+	})
+
+	taken := make([]callTimeLot, 0)
+	left := new(big.Int).Set(calls)
+	for _, i := range order {
+		if left.Sign() <= 0 {
+			break
+		}
+		lot := &record.Lots[i]
+		take := new(big.Int).Set(left)
+		if take.Cmp(lot.CallTimes) > 0 {
+			take.Set(lot.CallTimes)
+		}
+		fee := new(big.Int).Set(lot.Paid)
+		if take.Cmp(lot.CallTimes) < 0 {
+			fee.Mul(lot.Paid, take)
+			fee.Quo(fee, lot.CallTimes)
+		}
+		lot.CallTimes = new(big.Int).Sub(lot.CallTimes, take)
+		lot.Paid = new(big.Int).Sub(lot.Paid, fee)
+		taken = append(taken, callTimeLot{lot.TxID, take, fee, lot.BoughtAt, lot.ExpiresAt, lot.Terms})
+		left.Sub(left, take)
+	}
+	sumLots(record)
+	return taken
+}
+
+// expireLots removes the lots in "record" expired at "now", it returns the lots expired
+// with the call times and fee paid they had left.
+func expireLots(record *serviceCallTime, now int64) []callTimeLot {
+	normalizeLots(record)
+	expired := make([]callTimeLot, 0)
+	for i := range record.Lots {
+		lot := &record.Lots[i]
+		if !lotExpired(*lot, now) || (lot.CallTimes.Sign() <= 0 && lot.Paid.Sign() <= 0) {
+			continue
+		}
+		expired = append(expired, *lot)
+		lot.CallTimes = big.NewInt(0)
+		lot.Paid = big.NewInt(0)
+	}
+	sumLots(record)
+	return expired
+}
+
+// parseComposition parses a mashup's component list, every component is given
+// as "service" or "service:N"; a service given several times adds up its calls.
+func (t *serviceChaincode) parseComposition(stub shim.ChaincodeStubInterface, list []string) (map[string]int, error) {
+	composition := make(map[string]int)
+	for _, arg := range list {
+		name := strings.TrimSpace(arg)
+		n := 1
+		if i := strings.LastIndex(name, MultiplicitySeparator); i >= 0 {
+			if m, err := strconv.Atoi(name[i+1:]); err == nil {
+				if m <= 0 {
+					return nil, fmt.Errorf("component calls must be positive: %s", arg)
+				}
+				name, n = name[:i], m
+			}
+		}
+		if len(name) == 0 {
+			return nil, fmt.Errorf("component must be non-empty string")
+		}
+		componentName, err := t.resolveServiceName(stub, name)
+		if err != nil {
+			return nil, err
+		}
+		composition[componentName] += n
+	}
+	if len(composition) == 0 {
+		return nil, fmt.Errorf("a mashup should invoke at least one service")
+	}
+	return composition, nil
+}
+
+// getComponents gets the services of a composition, sorted by name
+func (t *serviceChaincode) getComponents(stub shim.ChaincodeStubInterface, composition map[string]int) ([]service, error) {
+	names := make([]string, 0, len(composition))
+	for k := range composition {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	components := make([]service, 0, len(names))
+	for _, name := range names {
+		serviceAsBytes, err := stub.GetState(ServicePrefix + name)
+		if err != nil {
+			return nil, fmt.Errorf("fail to get service: %s", err.Error())
+		} else if serviceAsBytes == nil {
+			return nil, fmt.Errorf("this service doesn't exist: %s", name)
+		}
+		var serviceJSON service
+		err = json.Unmarshal(serviceAsBytes, &serviceJSON)
+		if err != nil {
+			return nil, fmt.Errorf("error unmarshal service bytes")
+		}
+		components = append(components, serviceJSON)
+	}
+	return components, nil
+}
+
+// updateDependencies re-indexes a mashup whose composition changed from "oldComposition"
+// to "newComposition" under each of its components, and updates the co-occurrence of its
+// plain components with each other. Every component is stored once, as the state read
+// in a transaction does not reflect its own writes.
+func (t *serviceChaincode) updateDependencies(stub shim.ChaincodeStubInterface, mashupName string, oldComposition map[string]int, newComposition map[string]int) error {
+	oldResolved := make(map[string]int)
+	for k, n := range oldComposition {
+		name, err := t.resolveServiceName(stub, k)
+		if err != nil {
+			return err
+		}
+		oldResolved[name] += n
+	}
+	all := make(map[string]int)
+	for k := range oldResolved {
+		all[k] = 1
+	}
+	for k := range newComposition {
+		all[k] = 1
+	}
+	components, err := t.getComponents(stub, all)
+	if err != nil {
+		return err
+	}
+
+	for _, component := range components {
+		compositeKey, err := stub.CreateCompositeKey(DependencyKey, []string{component.Name, mashupName})
+		if err != nil {
+			return fmt.Errorf("create composite key error: %s", err.Error())
+		}
+		n, composed := newComposition[component.Name]
+		if composed {
+			err = stub.PutState(compositeKey, []byte(strconv.Itoa(n)))
+		} else {
+			err = stub.DelState(compositeKey)
+		}
+		if err != nil {
+			return err
+		}
+
+		// a mashup's composition records its own components, not its co-occurrence
+		if component.IsMashup {
+			continue
+		}
+		if component.Composition == nil {
+			component.Composition = make(map[string]int)
+		}
+		if _, ok := oldResolved[component.Name]; ok {
+			for other := range oldResolved {
+				if other == component.Name {
+					continue
+				}
+				component.Composition[other]--
+				if component.Composition[other] <= 0 {
+					delete(component.Composition, other)
+				}
+			}
+		}
+		if composed {
+			for other := range newComposition {
+				if other != component.Name {
+					component.Composition[other]++
+				}
+			}
+		}
+		err = t.saveService(stub, component)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// payIncentives pays the developers of "components" from the sender, the composition fee
+// of each service for every call that one mashup call makes to it, as given by "composition".
+func (t *serviceChaincode) payIncentives(stub shim.ChaincodeStubInterface, components []service, composition map[string]int) error {
+	// add up the fees by developer and token type
+	developerFees := make(map[string]map[string]*big.Int)
+	for _, fee := range compositionFees(components, composition) {
+		if fee.Amount.Sign() == 0 {
+			continue
+		}
+		if developerFees[fee.Developer] == nil {
+			developerFees[fee.Developer] = make(map[string]*big.Int)
+		}
+		if developerFees[fee.Developer][fee.FeeType] == nil {
+			developerFees[fee.Developer][fee.FeeType] = big.NewInt(0)
+		}
+		developerFees[fee.Developer][fee.FeeType].Add(developerFees[fee.Developer][fee.FeeType], fee.Amount)
+	}
+	developers := make([]string, 0, len(developerFees))
+	for k := range developerFees {
+		developers = append(developers, k)
+	}
+	sort.Strings(developers)
+	for _, k := range developers {
+		// get the k's address
+		userAsBytes, err := stub.GetState(UserPrefix + k)
+		if err != nil {
+			return fmt.Errorf("fail to get user: %s", err.Error())
+		} else if userAsBytes == nil {
+			return fmt.Errorf("this user doesn't exist: %s", k)
+		}
+		var userJSON user
+		err = json.Unmarshal(userAsBytes, &userJSON)
+		if err != nil {
+			return fmt.Errorf("error unmarshal user bytes")
+		}
+		feeTypes := make([]string, 0, len(developerFees[k]))
+		for feeType := range developerFees[k] {
+			feeTypes = append(feeTypes, feeType)
+		}
+		sort.Strings(feeTypes)
+		// make incentive transfer
+		// from the mashup developer to the invoked service's developer
+		for _, feeType := range feeTypes {
+			err = stub.Transfer(userJSON.Address, feeType, developerFees[k][feeType])
+			if err != nil {
+				return fmt.Errorf("error when making transfer")
+			}
+		}
+	}
+	return nil
+}
+
+// bundleMargin is the price of one call of mashup "s" bought along with the call times of its
+// components: its price less the cost of the component calls, which are paid for separately.
+func bundleMargin(s service) *big.Int {
+	margin := new(big.Int).Set(s.Price)
+	if s.ComponentCost != nil {
+		margin.Sub(margin, s.ComponentCost)
+	}
+	if margin.Sign() < 0 {
+		margin.SetInt64(0)
+	}
+	return margin
+}
+
+// collectBundleCalls adds up the calls made on every service below "node" by "calls" calls of the root
+func collectBundleCalls(node *mashupNode, calls *big.Int, totals map[string]*big.Int) {
+	for _, child := range node.Children {
+		if totals[child.Name] == nil {
+			totals[child.Name] = big.NewInt(0)
+		}
+		totals[child.Name].Add(totals[child.Name], new(big.Int).Mul(calls, big.NewInt(int64(child.TotalCalls))))
+		collectBundleCalls(child, calls, totals)
+	}
+}
+
+// compositionFees computes the fee of composing each of "components" with the calls given by "composition"
+func compositionFees(components []service, composition map[string]int) []compositionFee {
+	defaultFee := big.NewInt(0)
+	defaultFee.SetString(IncentiveMashupInvoke, 10)
+
+	fees := make([]compositionFee, 0, len(components))
+	for _, component := range components {
+		fee, feeType := defaultFee, FeeBalanceType
+		if component.CompositionFee != nil {
+			fee = component.CompositionFee
+			if component.CompositionFeeType != "" {
+				feeType = component.CompositionFeeType
+			}
+		}
+		calls := composition[component.Name]
+		amount := new(big.Int).Mul(fee, big.NewInt(int64(calls)))
+		fees = append(fees, compositionFee{component.Name, component.Developer, feeType, fee, calls, amount})
+	}
+	return fees
+}
+
+// getDependents gets the mashups that compose a service
+func (t *serviceChaincode) getDependents(stub shim.ChaincodeStubInterface, serviceName string) ([]dependency, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(DependencyKey, []string{serviceName})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+	dependents := make([]dependency, 0)
+	for resultsIterator.HasNext() {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, keys, err := stub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.Atoi(string(responseRange.Value))
+		if err != nil {
+			return nil, err
+		}
+		dependents = append(dependents, dependency{keys[0], keys[1], n})
+	}
+	return dependents, nil
+}
+
+// resolveMashupTree resolves the dependency tree of service "name", called "multiplicity"
+// times by its parent and "total" times per call of the root, at "depth" levels below the root.
+// "path" holds the mashups from the root down to the parent, meeting one of them again is a cycle.
+func (t *serviceChaincode) resolveMashupTree(stub shim.ChaincodeStubInterface, name string, multiplicity int, total int, path map[string]bool, depth int) (*mashupNode, error) {
+	if depth > MaxMashupDepth {
+		return nil, fmt.Errorf("mashups are nested deeper than %d levels at: %s", MaxMashupDepth, name)
+	}
+	name, err := t.resolveServiceName(stub, name)
+	if err != nil {
+		return nil, err
+	}
+	if path[name] {
+		return nil, fmt.Errorf("mashup composition cycle at: %s", name)
+	}
+	serviceAsBytes, err := stub.GetState(ServicePrefix + name)
+	if err != nil {
+		return nil, fmt.Errorf("fail to get service: %s", err.Error())
+	} else if serviceAsBytes == nil {
+		return nil, fmt.Errorf("this service doesn't exist: %s", name)
+	}
+	var serviceJSON service
+	err = json.Unmarshal(serviceAsBytes, &serviceJSON)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshal service bytes")
+	}
+
+	node := &mashupNode{serviceJSON.Name, serviceJSON.Developer, serviceJSON.Status,
+		serviceJSON.IsMashup, multiplicity, total, nil}
+	if !serviceJSON.IsMashup {
+		return node, nil
+	}
+
+	path[name] = true
+	defer delete(path, name)
+	components := make([]string, 0, len(serviceJSON.Composition))
+	for k := range serviceJSON.Composition {
+		components = append(components, k)
+	}
+	sort.Strings(components)
+	for _, k := range components {
+		n := serviceJSON.Composition[k]
+		child, err := t.resolveMashupTree(stub, k, n, total*n, path, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		node.Children = append(node.Children, child)
+	}
+	return node, nil
+}
+
+// checkComposition checks that a mashup named "mashupName" can compose "composition",
+// i.e. that no component calls the mashup back and the nesting is not too deep.
+func (t *serviceChaincode) checkComposition(stub shim.ChaincodeStubInterface, mashupName string, composition map[string]int) error {
+	path := map[string]bool{mashupName: true}
+	components := make([]string, 0, len(composition))
+	for k := range composition {
+		components = append(components, k)
+	}
+	sort.Strings(components)
+	for _, k := range components {
+		n := composition[k]
+		_, err := t.resolveMashupTree(stub, k, n, n, path, 1)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// collectMashupTree adds up the calls of every service below "node" into "tree"
+func collectMashupTree(node *mashupNode, depth int, tree *mashupTree) {
+	if depth > tree.Depth {
+		tree.Depth = depth
+	}
+	if depth > 0 {
+		tree.Services[node.Name] += node.TotalCalls
+	}
+	for _, child := range node.Children {
+		collectMashupTree(child, depth+1, tree)
+	}
+}
+
+// propagateStatus propagates the new status of service "s" to the mashups depending on it:
+// when it's no longer available, its available dependents are degraded; when it's available
+// again, its degraded dependents whose components are all available are restored.
+// Changes cascade through nested mashups, and are notified by a ServiceStatusEvent.
+func (t *serviceChaincode) propagateStatus(stub shim.ChaincodeStubInterface, s service) error {
+	// services changed in this transaction, as the state is only updated when it's committed
+	changed := map[string]service{s.Name: s}
+	event := statusEvent{s.Name, s.Status, make([]string, 0), make([]string, 0)}
+
+	getService := func(name string) (service, error) {
+		var serviceJSON service
+		name, err := t.resolveServiceName(stub, name)
+		if err != nil {
+			return serviceJSON, err
+		}
+		if c, ok := changed[name]; ok {
+			return c, nil
+		}
+		serviceAsBytes, err := stub.GetState(ServicePrefix + name)
+		if err != nil {
+			return serviceJSON, fmt.Errorf("fail to get service: %s", err.Error())
+		} else if serviceAsBytes == nil {
+			return serviceJSON, fmt.Errorf("this service doesn't exist: %s", name)
+		}
+		err = json.Unmarshal(serviceAsBytes, &serviceJSON)
+		if err != nil {
+			return serviceJSON, fmt.Errorf("error unmarshal service bytes")
+		}
+		return serviceJSON, nil
+	}
+
+	queue := []service{s}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		dependents, err := t.getDependents(stub, current.Name)
+		if err != nil {
+			return err
+		}
+		for _, d := range dependents {
+			mashup, err := getService(d.MashupName)
+			if err != nil {
+				return err
+			}
+			if current.Status != S_Available {
+				if mashup.Status != S_Available {
+					continue
+				}
+				mashup.Status = S_Degraded
+				event.Degraded = append(event.Degraded, mashup.Name)
+			} else {
+				if mashup.Status != S_Degraded {
+					continue
+				}
+				restore := true
+				for k := range mashup.Composition {
+					component, err := getService(k)
+					if err != nil {
+						return err
+					}
+					if component.Status != S_Available {
+						restore = false
+						break
+					}
+				}
+				if !restore {
+					continue
+				}
+				mashup.Status = S_Available
+				event.Restored = append(event.Restored, mashup.Name)
+			}
+			err = t.saveService(stub, mashup)
+			if err != nil {
+				return err
+			}
+			changed[mashup.Name] = mashup
+			queue = append(queue, mashup)
+		}
+	}
+
+	if len(event.Degraded) == 0 && len(event.Restored) == 0 {
+		return nil
+	}
+	eventJson, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return stub.SetEvent(ServiceStatusEvent, eventJson)
+}
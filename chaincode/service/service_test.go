@@ -0,0 +1,1663 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/inklabsfoundation/inkchain/core/chaincode/shim"
+	pb "github.com/inklabsfoundation/inkchain/protos/peer"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testAdmin = "admin"
+
+// address of a test user
+func addr(name string) string {
+	return "addr-" + name
+}
+
+// newTestMarket starts the chaincode with registered users holding "funds" tokens each
+func newTestMarket(t *testing.T, funds int64, names ...string) *mockStub {
+	stub := newMockStub(t, testAdmin)
+	for _, name := range names {
+		stub.mustInvoke(t, addr(name), RegisterUser, name, "intro of "+name)
+		stub.balances[addr(name)] = big.NewInt(funds)
+	}
+	return stub
+}
+
+// publish registers and publishes a service of "developer", it returns its name
+func publish(t *testing.T, stub *mockStub, developer string, name string, price string) string {
+	t.Helper()
+	stub.mustInvoke(t, addr(developer), RegisterService, name, "api", "service "+name, developer, "", price)
+	name = qualifiedServiceName(developer, name)
+	stub.mustInvoke(t, addr(developer), PublishService, name)
+	return name
+}
+
+func getCallTimeRecord(t *testing.T, stub *mockStub, serviceName string, userName string) serviceCallTime {
+	t.Helper()
+	var record serviceCallTime
+	err := json.Unmarshal(stub.state[ServiceCallTimesPrefix+serviceName+userName], &record)
+	if err != nil {
+		t.Fatalf("no call times of %s for %s: %v", serviceName, userName, err)
+	}
+	return record
+}
+
+// encode marshals a record stored by a test, failing the test if it can't
+func encode(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("marshal %+v: %v", v, err)
+	}
+	return data
+}
+
+// decode unmarshals a response of the chaincode, failing the test if it can't
+func decode(t *testing.T, data []byte, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatalf("unmarshal %q: %v", data, err)
+	}
+}
+
+// dueOf adds up the refunds a user owes
+func dueOf(t *testing.T, stub *mockStub, userName string) int64 {
+	t.Helper()
+	var dues []refundDue
+	decode(t, stub.mustInvoke(t, addr(userName), QueryRefundDues, userName), &dues)
+	total := int64(0)
+	for _, due := range dues {
+		total += due.Amount.Int64()
+	}
+	return total
+}
+
+func TestAdminAccount(t *testing.T) {
+	tests := []struct {
+		name   string
+		sender string
+		ok     bool
+	}{
+		{"admin", "admin", true},
+		{"deployer", "deployer", false},
+		{"user", addr("alice"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newMockStub(t, "deployer", "admin")
+			stub.mustInvoke(t, addr("alice"), RegisterUser, "alice", "intro")
+			if res := stub.invoke(tt.sender, AddArbitrator, "alice"); (res.Status == shim.OK) != tt.ok {
+				t.Errorf("addArbitrator status %d (%s), want success %v", res.Status, res.Message, tt.ok)
+			}
+			if res := stub.invoke(tt.sender, MigrateTimes); (res.Status == shim.OK) != tt.ok {
+				t.Errorf("migrateTimes status %d (%s), want success %v", res.Status, res.Message, tt.ok)
+			}
+		})
+	}
+}
+
+func TestSplitLots(t *testing.T) {
+	newRecord := func() *serviceCallTime {
+		record := &serviceCallTime{Lots: []callTimeLot{
+			{"a", big.NewInt(10), big.NewInt(100), 10, 0, nil},
+			{"b", big.NewInt(10), big.NewInt(50), 20, 1000, nil},
+			{"c", big.NewInt(5), big.NewInt(30), 5, 500, nil},
+		}}
+		sumLots(record)
+		return record
+	}
+	recent := func(lot callTimeLot) bool { return lot.BoughtAt >= 10 }
+	tests := []struct {
+		name   string
+		now    int64
+		calls  int64
+		filter func(lot callTimeLot) bool
+		taken  []string // lot and call times taken, as "tx:calls:fee"
+		left   int64
+		paid   int64
+	}{
+		{"expiring first", 100, 3, nil, []string{"c:3:18"}, 22, 162},
+		{"across lots", 100, 12, nil, []string{"c:5:30", "b:7:35"}, 13, 115},
+		{"expired lots skipped", 600, 15, nil, []string{"b:10:50", "a:5:50"}, 10, 80},
+		{"filtered lots skipped", 100, 12, recent, []string{"b:10:50", "a:2:20"}, 13, 110},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			record := newRecord()
+			lots := splitLots(record, big.NewInt(tt.calls), tt.now, tt.filter)
+			taken := make([]string, 0, len(lots))
+			for _, lot := range lots {
+				taken = append(taken, lot.TxID+":"+lot.CallTimes.String()+":"+lot.Paid.String())
+			}
+			if strings.Join(taken, ",") != strings.Join(tt.taken, ",") {
+				t.Errorf("taken %v, want %v", taken, tt.taken)
+			}
+			if record.CallTimes.Int64() != tt.left || record.Paid.Int64() != tt.paid {
+				t.Errorf("left %s calls and %s paid, want %d and %d", record.CallTimes, record.Paid, tt.left, tt.paid)
+			}
+		})
+	}
+}
+
+func TestExpireLots(t *testing.T) {
+	record := &serviceCallTime{Lots: []callTimeLot{
+		{"a", big.NewInt(10), big.NewInt(100), 10, 0, nil},
+		{"b", big.NewInt(4), big.NewInt(40), 20, 300, nil},
+	}}
+	sumLots(record)
+	if expired := expireLots(record, 299); len(expired) != 0 {
+		t.Fatalf("expired %v before the expiry", expired)
+	}
+	expired := expireLots(record, 300)
+	if len(expired) != 1 || expired[0].TxID != "b" || expired[0].Paid.Int64() != 40 {
+		t.Fatalf("expired %v, want lot b", expired)
+	}
+	if record.CallTimes.Int64() != 10 || len(record.Lots) != 1 {
+		t.Errorf("left %s calls in %d lots, want 10 in 1", record.CallTimes, len(record.Lots))
+	}
+}
+
+func TestRefundOwedByPurchaseTerms(t *testing.T) {
+	tests := []struct {
+		name         string
+		share        string // component share when bought
+		laterShare   string // component share changed before the refund
+		developer    int64  // paid to the developer at purchase, and owed back
+		componentDev int64  // paid to the component's developer at purchase, and owed back
+	}{
+		{"no share", "0", "", 300, 0},
+		{"half share", "50", "", 150, 150},
+		{"share raised after purchase", "0", "50", 300, 0},
+		{"share dropped after purchase", "50", "0", 150, 150},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newTestMarket(t, 1000, "alice", "bob", "carol")
+			component := publish(t, stub, "carol", "geo", "1")
+			stub.mustInvoke(t, addr("alice"), CreateMashup, "trip", "api", "mashup", "alice", "10", L_Commercial, component)
+			mashup := qualifiedServiceName("alice", "trip")
+			stub.mustInvoke(t, addr("alice"), PublishService, mashup)
+			stub.mustInvoke(t, addr("alice"), SetRevenueShare, mashup, tt.share)
+			stub.mustInvoke(t, addr("alice"), SetRefundPolicy, mashup, R_Full)
+
+			aliceBefore := stub.balance(addr("alice")).Int64()
+			carolBefore := stub.balance(addr("carol")).Int64()
+			stub.mustInvoke(t, addr("bob"), CallService, mashup, "30")
+			if got := stub.balance(addr("alice")).Int64() - aliceBefore; got != tt.developer {
+				t.Errorf("developer paid %d, want %d", got, tt.developer)
+			}
+			if got := stub.balance(addr("carol")).Int64() - carolBefore; got != tt.componentDev {
+				t.Errorf("component developer paid %d, want %d", got, tt.componentDev)
+			}
+
+			if tt.laterShare != "" {
+				stub.mustInvoke(t, addr("alice"), SetRevenueShare, mashup, tt.laterShare)
+			}
+			stub.mustInvoke(t, addr("bob"), RequestRefund, mashup)
+			if got := dueOf(t, stub, "alice"); got != tt.developer {
+				t.Errorf("developer owes %d, want %d", got, tt.developer)
+			}
+			if got := dueOf(t, stub, "carol"); got != tt.componentDev {
+				t.Errorf("component developer owes %d, want %d", got, tt.componentDev)
+			}
+		})
+	}
+}
+
+func TestBundleChargesComponentsOnce(t *testing.T) {
+	tests := []struct {
+		name    string
+		bundle  string
+		charged int64
+		calls   map[string]int64 // call times bought for bob
+	}{
+		{"no bundle", "", 70, map[string]int64{"alice/trip": 10}},
+		{"nested bundle", BundleBuyer, 70, map[string]int64{"alice/trip": 10, "alice/route": 10, "carol/geo": 20, "dave/map": 10}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newTestMarket(t, 1000, "alice", "bob", "carol", "dave")
+			geo := publish(t, stub, "carol", "geo", "2")
+			tiles := publish(t, stub, "dave", "map", "3")
+			stub.mustInvoke(t, addr("alice"), CreateMashup, "route", "api", "mashup", "alice", AutoPrice, L_Commercial, geo+":2")
+			stub.mustInvoke(t, addr("alice"), PublishService, "alice/route")
+			stub.mustInvoke(t, addr("alice"), CreateMashup, "trip", "api", "mashup", "alice", AutoPrice, L_Commercial, "alice/route", tiles)
+			stub.mustInvoke(t, addr("alice"), PublishService, "alice/trip")
+
+			before := stub.balance(addr("bob")).Int64()
+			args := []string{"alice/trip", "10"}
+			if tt.bundle != "" {
+				args = append(args, tt.bundle)
+			}
+			stub.mustInvoke(t, addr("bob"), CallService, args...)
+
+			if got := before - stub.balance(addr("bob")).Int64(); got != tt.charged {
+				t.Errorf("charged %d, want %d", got, tt.charged)
+			}
+			for name, calls := range tt.calls {
+				if got := getCallTimeRecord(t, stub, name, "bob").CallTimes.Int64(); got != calls {
+					t.Errorf("call times of %s = %d, want %d", name, got, calls)
+				}
+			}
+		})
+	}
+}
+
+func TestRequestRefund(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      []string // policy and its parameter
+		wait        int64    // seconds between the two purchases, and after them
+		byDeveloper bool
+		ok          bool
+		refund      int64 // refund to bob
+		paid        int64 // paid to bob in the transaction
+	}{
+		{"no refund", []string{R_None}, 10, false, false, 0, 0},
+		{"full", []string{R_Full}, 10, false, true, 200, 0},
+		{"prorated", []string{R_ProRated, "25"}, 10, false, true, 50, 0},
+		{"within the window", []string{R_Windowed, "100"}, 10, false, true, 200, 0},
+		{"last lot within the window", []string{R_Windowed, "100"}, 60, false, true, 100, 0},
+		{"after the window", []string{R_Windowed, "100"}, 200, false, false, 0, 0},
+		{"paid by the developer", []string{R_ProRated, "25"}, 10, true, true, 50, 50},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newTestMarket(t, 1000, "alice", "bob")
+			api := publish(t, stub, "alice", "api", "10")
+			stub.mustInvoke(t, addr("alice"), SetRefundPolicy, append([]string{api}, tt.policy...)...)
+			stub.mustInvoke(t, addr("bob"), CallService, api, "10")
+			stub.now += tt.wait
+			stub.mustInvoke(t, addr("bob"), CallService, api, "10")
+			stub.now += tt.wait
+
+			before := stub.balance(addr("bob")).Int64()
+			var res pb.Response
+			if tt.byDeveloper {
+				res = stub.invoke(addr("alice"), RequestRefund, api, "", "bob")
+			} else {
+				res = stub.invoke(addr("bob"), RequestRefund, api)
+			}
+			if (res.Status == shim.OK) != tt.ok {
+				t.Fatalf("requestRefund status %d (%s), want success %v", res.Status, res.Message, tt.ok)
+			}
+			if !tt.ok {
+				return
+			}
+			var record refundRecord
+			decode(t, res.Payload, &record)
+			if record.Refund.Int64() != tt.refund {
+				t.Errorf("refund = %d, want %d", record.Refund, tt.refund)
+			}
+			paid := stub.balance(addr("bob")).Int64() - before
+			if paid != tt.paid {
+				t.Errorf("paid %d to bob, want %d", paid, tt.paid)
+			}
+			if got := dueOf(t, stub, "alice"); got != tt.refund-paid {
+				t.Errorf("developer owes %d, want %d", got, tt.refund-paid)
+			}
+		})
+	}
+}
+
+func TestRequestRefundForOthers(t *testing.T) {
+	stub := newTestMarket(t, 1000, "alice", "bob", "carol")
+	api := publish(t, stub, "alice", "api", "10")
+	stub.mustInvoke(t, addr("alice"), SetRefundPolicy, api, R_Full)
+	stub.mustInvoke(t, addr("bob"), CallService, api, "10")
+	if res := stub.invoke(addr("carol"), RequestRefund, api, "", "bob"); res.Status == shim.OK {
+		t.Fatal("a user refunded the call times of another")
+	}
+}
+
+func TestRefundsInOneSecond(t *testing.T) {
+	stub := newTestMarket(t, 1000, "alice", "bob")
+	api := publish(t, stub, "alice", "api", "10")
+	stub.mustInvoke(t, addr("alice"), SetRefundPolicy, api, R_Full)
+	stub.mustInvoke(t, addr("bob"), CallService, api, "10")
+
+	var first, second refundRecord
+	decode(t, stub.mustInvoke(t, addr("bob"), RequestRefund, api, "3"), &first)
+	stub.now--
+	decode(t, stub.mustInvoke(t, addr("bob"), RequestRefund, api, "4"), &second)
+	if first.CreateTime != second.CreateTime || first.TxID == second.TxID {
+		t.Fatalf("refunds %s at %s and %s at %s, want two transactions in one second", first.TxID, first.CreateTime, second.TxID, second.CreateTime)
+	}
+	for _, record := range []refundRecord{first, second} {
+		var saved refundRecord
+		decode(t, stub.state[RefundRecordPrefix+api+"bob"+record.TxID], &saved)
+		if saved.CallTime.Cmp(record.CallTime) != 0 {
+			t.Errorf("refund %s saved %s call times, want %s", record.TxID, saved.CallTime, record.CallTime)
+		}
+	}
+}
+
+func TestRefundPaidOutOfSales(t *testing.T) {
+	stub := newTestMarket(t, 1000, "alice", "bob", "carol")
+	api := publish(t, stub, "alice", "api", "10")
+	stub.mustInvoke(t, addr("alice"), SetRefundPolicy, api, R_Full)
+	stub.mustInvoke(t, addr("bob"), CallService, api, "10")
+	stub.mustInvoke(t, addr("bob"), RequestRefund, api)
+
+	steps := []struct {
+		name      string
+		sender    string
+		function  string
+		args      []string
+		toBob     int64 // paid to bob
+		toAlice   int64 // paid to alice
+		aliceOwes int64
+	}{
+		{"sale pays the refund first", addr("carol"), CallService, []string{api, "4"}, 40, 0, 60},
+		{"buyer offsets what is owed to them", addr("bob"), CallService, []string{api, "2"}, 0, 0, 40},
+		{"developer pays part", addr("alice"), PayRefunds, []string{"15"}, 15, -15, 25},
+		{"developer pays the rest", addr("alice"), PayRefunds, nil, 25, -25, 0},
+		{"sale pays the developer", addr("carol"), CallService, []string{api, "1"}, 0, 10, 0},
+	}
+	for _, step := range steps {
+		bob := stub.balance(addr("bob")).Int64()
+		alice := stub.balance(addr("alice")).Int64()
+		stub.mustInvoke(t, step.sender, step.function, step.args...)
+		if got := stub.balance(addr("bob")).Int64() - bob; got != step.toBob {
+			t.Errorf("%s: paid %d to bob, want %d", step.name, got, step.toBob)
+		}
+		if got := stub.balance(addr("alice")).Int64() - alice; got != step.toAlice {
+			t.Errorf("%s: paid %d to alice, want %d", step.name, got, step.toAlice)
+		}
+		if got := dueOf(t, stub, "alice"); got != step.aliceOwes {
+			t.Errorf("%s: alice owes %d, want %d", step.name, got, step.aliceOwes)
+		}
+	}
+}
+
+func TestResaleOrders(t *testing.T) {
+	tests := []struct {
+		name      string
+		ask       string // price per call asked by bob
+		maxPrice  string // highest price per call carol pays
+		bought    int64  // call times carol gets
+		paid      int64  // paid by carol
+		sellerPay int64  // paid to bob
+	}{
+		{"ask below the max price", "4", "5", 4, 16, 15},
+		{"ask at the max price", "5", "5", 4, 20, 18},
+		{"ask above the max price", "6", "5", 0, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newTestMarket(t, 1000, "alice", "bob", "carol")
+			api := publish(t, stub, "alice", "api", "10")
+			stub.mustInvoke(t, addr("alice"), SetResaleRoyalty, api, "10")
+			stub.mustInvoke(t, addr("bob"), CallService, api, "10")
+			stub.mustInvoke(t, addr("bob"), CreateSellOrder, api, "4", tt.ask)
+			carolBefore := stub.balance(addr("carol")).Int64()
+			bobBefore := stub.balance(addr("bob")).Int64()
+
+			res := stub.invoke(addr("carol"), BuyResale, api, "6", tt.maxPrice)
+			if (res.Status == shim.OK) != (tt.bought > 0) {
+				t.Fatalf("buyResale status %d (%s)", res.Status, res.Message)
+			}
+			var bought int64
+			if _, ok := stub.state[ServiceCallTimesPrefix+api+"carol"]; ok {
+				bought = getCallTimeRecord(t, stub, api, "carol").CallTimes.Int64()
+			}
+			if bought != tt.bought {
+				t.Errorf("carol bought %d call times, want %d", bought, tt.bought)
+			}
+			if got := carolBefore - stub.balance(addr("carol")).Int64(); got != tt.paid {
+				t.Errorf("carol paid %d, want %d", got, tt.paid)
+			}
+			if got := stub.balance(addr("bob")).Int64() - bobBefore; got != tt.sellerPay {
+				t.Errorf("bob is paid %d, want %d", got, tt.sellerPay)
+			}
+			if bought > 0 {
+				var page historyPage
+				decode(t, stub.mustInvoke(t, addr("carol"), QueryPurchases, "carol", api), &page)
+				if len(page.Records) != 1 {
+					t.Errorf("carol has %d purchase records, want 1", len(page.Records))
+				}
+			}
+		})
+	}
+}
+
+func TestExpireSellOrders(t *testing.T) {
+	stub := newTestMarket(t, 1000, "alice", "bob")
+	api := publish(t, stub, "alice", "api", "10")
+	stub.mustInvoke(t, addr("alice"), SetCallTimeValidity, api, "100")
+	stub.mustInvoke(t, addr("bob"), CallService, api, "10")
+	stub.mustInvoke(t, addr("bob"), CreateSellOrder, api, "4", "5")
+	stub.now += 200
+	before := stub.balance(addr("alice")).Int64()
+	var expired []expiredCallTimes
+	decode(t, stub.mustInvoke(t, addr("alice"), ExpireCallTimes, api), &expired)
+
+	var orders []sellOrder
+	decode(t, stub.mustInvoke(t, addr("bob"), QuerySellOrders, api), &orders)
+	if len(orders) != 0 {
+		t.Errorf("%d sell orders left open", len(orders))
+	}
+	if len(expired) != 2 || expired[0].CallTimes.Int64()+expired[1].CallTimes.Int64() != 10 {
+		t.Errorf("expired %v, want the 6 call times held and the 4 for sale", expired)
+	}
+	if got := stub.balance(addr("alice")).Int64() - before; got != 0 {
+		t.Errorf("expiry paid %d to the developer, the fee is paid at purchase", got)
+	}
+}
+
+func TestIndexHistory(t *testing.T) {
+	stub := newTestMarket(t, 1000, "alice", "bob")
+	api := publish(t, stub, "alice", "api", "10")
+	stub.mustInvoke(t, addr("bob"), CallService, api, "10")
+	stub.now--
+	stub.mustInvoke(t, addr("bob"), CallService, api, "2")
+	legacy, _ := json.Marshal(buyRecord{ServiceCallTimesPrefix + api + "bob", api, "bob", "", big.NewInt(5), big.NewInt(50), formatTime(1), false})
+	stub.state[BuyRecordPrefix+api+"bob"+"1"] = legacy
+
+	if res := stub.invoke(addr("alice"), IndexHistory); res.Status == shim.OK {
+		t.Fatal("a user indexed the history")
+	}
+	for i, want := range []string{"1 records indexed.", "0 records indexed."} {
+		if got := string(stub.mustInvoke(t, testAdmin, IndexHistory)); got != want {
+			t.Errorf("run %d: %q, want %q", i, got, want)
+		}
+	}
+	var page historyPage
+	decode(t, stub.mustInvoke(t, addr("bob"), QueryPurchases, "bob", api), &page)
+	if len(page.Records) != 3 {
+		t.Errorf("%d purchase records, want the legacy one and both bought in one second", len(page.Records))
+	}
+}
+
+func TestResolveDispute(t *testing.T) {
+	tests := []struct {
+		name   string
+		uphold bool
+		calls  int64 // call times of bob left
+		paid   int64 // fee paid for them
+		quota  bool  // bob can still consume 7 calls within the hourly quota of 10
+	}{
+		{"upheld", true, 10, 100, true},
+		{"rejected", false, 6, 60, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newTestMarket(t, 1000, "alice", "bob", "carol")
+			api := publish(t, stub, "alice", "api", "10")
+			stub.mustInvoke(t, testAdmin, AddArbitrator, "carol")
+			stub.mustInvoke(t, addr("alice"), SetServiceQuota, api, "10", "0")
+			stub.mustInvoke(t, addr("bob"), CallService, api, "10")
+			var reduced reduceRecord
+			decode(t, stub.mustInvoke(t, addr("alice"), ReduceCallTime, api, "bob", "4"), &reduced)
+			stub.mustInvoke(t, addr("bob"), OpenDispute, api, reduced.TxID, "not called")
+
+			if res := stub.invoke(addr("alice"), ResolveDispute, api, "bob", reduced.TxID, "false"); res.Status == shim.OK {
+				t.Fatal("a party resolved the dispute")
+			}
+			before := stub.balance(addr("alice")).Int64()
+			stub.mustInvoke(t, addr("carol"), ResolveDispute, api, "bob", reduced.TxID, strconv.FormatBool(tt.uphold))
+			record := getCallTimeRecord(t, stub, api, "bob")
+			if record.CallTimes.Int64() != tt.calls || record.Paid.Int64() != tt.paid {
+				t.Errorf("bob has %s call times paid %s, want %d paid %d", record.CallTimes, record.Paid, tt.calls, tt.paid)
+			}
+			if got := stub.balance(addr("alice")).Int64() - before; got != 0 {
+				t.Errorf("the ruling moved %d of the developer's funds", got)
+			}
+			if res := stub.invoke(addr("carol"), ResolveDispute, api, "bob", reduced.TxID, "true"); res.Status == shim.OK {
+				t.Error("a dispute was resolved twice")
+			}
+			stub.mustInvoke(t, addr("bob"), CallService, api, "1")
+			if res := stub.invoke(addr("alice"), ReduceCallTime, api, "bob", "7"); (res.Status == shim.OK) != tt.quota {
+				t.Errorf("reducing 7 calls: status %d (%s), want success %v", res.Status, res.Message, tt.quota)
+			}
+		})
+	}
+}
+
+func TestOpenDispute(t *testing.T) {
+	stub := newTestMarket(t, 1000, "alice", "bob")
+	api := publish(t, stub, "alice", "api", "10")
+	stub.mustInvoke(t, addr("bob"), CallService, api, "10")
+	var first, second reduceRecord
+	decode(t, stub.mustInvoke(t, addr("alice"), ReduceCallTime, api, "bob", "1"), &first)
+	stub.now--
+	decode(t, stub.mustInvoke(t, addr("alice"), ReduceCallTime, api, "bob", "2"), &second)
+	if first.CreateTime != second.CreateTime {
+		t.Fatalf("reductions at %s and %s, want the same second", first.CreateTime, second.CreateTime)
+	}
+
+	tests := []struct {
+		name   string
+		sender string
+		id     string
+		wait   int64
+		ok     bool
+	}{
+		{"first of the second", addr("bob"), first.TxID, 0, true},
+		{"second of the second", addr("bob"), second.TxID, 0, true},
+		{"disputed twice", addr("bob"), first.TxID, 0, false},
+		{"not the caller", addr("alice"), second.TxID, 0, false},
+		{"unknown reduction", addr("bob"), "tx0", 0, false},
+		{"after the window", addr("bob"), second.TxID, DisputeWindow, false},
+	}
+	for _, tt := range tests {
+		stub.now += tt.wait
+		if res := stub.invoke(tt.sender, OpenDispute, api, tt.id, "not called"); (res.Status == shim.OK) != tt.ok {
+			t.Errorf("%s: openDispute status %d (%s), want success %v", tt.name, res.Status, res.Message, tt.ok)
+		}
+	}
+}
+
+func TestMigrateTimesOfEveryRecord(t *testing.T) {
+	const seconds = 1500000000
+	unixDate := time.Unix(seconds, 0).UTC().Format(time.UnixDate)
+	txText := "seconds:1500000000 nanos:0 "
+	purchase := buyRecord{ServiceName: "alice/api", UserName: "bob", CreateTime: txText}
+	purchaseJson, _ := json.Marshal(purchase)
+
+	// one record of every kind, keyed by a prefix or a composite key type and its attributes
+	records := []struct {
+		kind  string
+		attrs []string // composite key attributes, nil for a prefix
+		value interface{}
+		times bool // has times to migrate
+	}{
+		{UserPrefix, nil, user{Name: "bob"}, false},
+		{ServicePrefix, nil, service{Name: "alice/api", CreatedTime: unixDate, UpdatedTime: unixDate}, true},
+		{ServiceCallTimesPrefix, nil, serviceCallTime{UserName: "bob", CreateTime: txText, UpdateTime: txText}, true},
+		{BuyRecordPrefix, nil, purchase, true},
+		{ReduceRecordPrefix, nil, reduceRecord{ServiceName: "alice/api", CreateTime: txText}, true},
+		{RefundRecordPrefix, nil, refundRecord{ServiceName: "alice/api", CreateTime: txText}, true},
+		{ResourcePrefix, nil, "cipher", false},
+		{ServiceAliasPrefix, nil, "alice/api", false},
+		{UserServicesKey, []string{"alice", "alice/api"}, service{Name: "alice/api", CreatedTime: unixDate}, true},
+		{CallTimeKey, []string{"alice/api", "bob"}, serviceCallTime{UserName: "bob", UpdateTime: txText}, true},
+		{BuyerResourceKey, []string{"alice/api", "bob"}, "cipher", false},
+		{QuotaUsageKey, []string{"alice/api", "bob"}, quotaUsage{ServiceName: "alice/api", HourCalls: 1}, false},
+		{PayoutKey, []string{"alice", "alice/api", "tx1", "bob"}, payoutRecord{Recipient: "alice", CreateTime: txText}, true},
+		{DependencyKey, []string{"alice/api", "alice/trip"}, "1", false},
+		{MashupHistoryKey, []string{"alice/trip", "1"}, compositionChange{Operation: EditAdd, UpdateTime: txText}, true},
+		{UserPurchaseKey, []string{"bob", "alice/api", "1", "tx1"}, purchase, true},
+		{ServicePurchaseKey, []string{"alice/api", "1", "bob", "tx1"}, purchase, true},
+		{UserConsumeKey, []string{"bob", "alice/api", "1", "tx2"}, reduceRecord{CreateTime: txText}, true},
+		{ServiceConsumeKey, []string{"alice/api", "1", "bob", "tx2"}, reduceRecord{CreateTime: txText}, true},
+		{RequestKey, []string{"bob", CallService, "r1"}, processedRequest{Function: CallService, Result: purchaseJson}, true},
+		{ArbitratorKey, []string{"carol"}, "carol", false},
+		{DisputeKey, []string{"alice/api", "bob", "tx2"}, dispute{Caller: "bob", CreateTime: txText, UpdateTime: txText}, true},
+		{RefundDueKey, []string{"alice", "1", "tx3"}, refundDue{Debtor: "alice", CreateTime: txText, UpdateTime: txText}, true},
+		{TransferKey, []string{"alice/api", "tx4"}, callTimeTransfer{From: "bob", CreateTime: txText}, true},
+		{TransferLogKey, []string{"bob", "alice/api", "tx4"}, callTimeTransfer{From: "bob", UpdateTime: txText}, true},
+		{SellOrderKey, []string{"alice/api", "tx5"}, sellOrder{Seller: "bob", CreateTime: txText}, true},
+		{ResaleTradeKey, []string{"alice/api", "tx6", "tx5"}, resaleTrade{Seller: "bob", CreateTime: txText}, true},
+		{UsageSettlementKey, []string{"alice/api", "bob"}, usageSettlement{UserName: "bob", UpdateTime: txText}, true},
+	}
+
+	stub := newMockStub(t, testAdmin)
+	keys := make([]string, len(records))
+	want := 0
+	for i, record := range records {
+		keys[i] = record.kind + "bob"
+		if record.attrs != nil {
+			key, err := stub.CreateCompositeKey(record.kind, record.attrs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys[i] = key
+		}
+		if text, ok := record.value.(string); ok {
+			stub.state[keys[i]] = []byte(text)
+		} else {
+			stub.state[keys[i]] = encode(t, record.value)
+		}
+		if record.times {
+			want++
+		}
+	}
+	before := make(map[string]string, len(keys))
+	for _, key := range keys {
+		before[key] = string(stub.state[key])
+	}
+
+	if got := string(stub.mustInvoke(t, testAdmin, MigrateTimes)); got != fmt.Sprintf("%d records migrated.", want) {
+		t.Errorf("first run: %q, want %d records migrated", got, want)
+	}
+	for i, record := range records {
+		value := string(stub.state[keys[i]])
+		switch {
+		case !record.times && value != before[keys[i]]:
+			t.Errorf("%s: changed to %s", record.kind, value)
+		case record.times && (strings.Contains(value, "seconds:") || strings.Contains(value, unixDate)):
+			t.Errorf("%s: legacy time left in %s", record.kind, value)
+		case record.times && !strings.Contains(value, formatTime(seconds)):
+			t.Errorf("%s: no RFC 3339 time in %s", record.kind, value)
+		}
+	}
+	if got := string(stub.mustInvoke(t, testAdmin, MigrateTimes)); got != "0 records migrated." {
+		t.Errorf("second run: %q, want nothing left to migrate", got)
+	}
+}
+
+func TestServiceResourceAccess(t *testing.T) {
+	stub := newTestMarket(t, 1000, "alice", "bob", "carol", "dave")
+	stub.mustInvoke(t, addr("alice"), SetEncryptionKey, "alice-key")
+	stub.mustInvoke(t, addr("alice"), RegisterService, "secret", "api", "encrypted", "alice", "cipher-alice", "10")
+	stub.mustInvoke(t, addr("dave"), RegisterService, "open", "api", "plain", "dave", "https://open.example", "10")
+	for _, name := range []string{"alice/secret", "dave/open"} {
+		stub.mustInvoke(t, addr(strings.Split(name, "/")[0]), PublishService, name)
+		stub.mustInvoke(t, addr("bob"), CallService, name, "1")
+	}
+	stub.mustInvoke(t, addr("alice"), SetBuyerResource, "alice/secret", "bob", "cipher-bob")
+
+	tests := []struct {
+		sender  string
+		service string
+		want    string // "" if refused
+	}{
+		{"alice", "alice/secret", "cipher-alice"},
+		{"bob", "alice/secret", "cipher-bob"},
+		{"carol", "alice/secret", ""},
+		{"dave", "dave/open", "https://open.example"},
+		{"bob", "dave/open", "https://open.example"},
+		{"carol", "dave/open", ""},
+	}
+	for _, tt := range tests {
+		res := stub.invoke(addr(tt.sender), GetServiceResource, tt.service)
+		switch {
+		case tt.want == "" && res.Status == shim.OK:
+			t.Errorf("%s got the resource of %s without call times", tt.sender, tt.service)
+		case tt.want != "" && string(res.Payload) != tt.want:
+			t.Errorf("%s got %q of %s (%s), want %q", tt.sender, res.Payload, tt.service, res.Message, tt.want)
+		}
+	}
+	for _, name := range []string{"alice/secret", "dave/open"} {
+		if res := stub.mustInvoke(t, addr("carol"), QueryService, name); strings.Contains(string(res), "example") || strings.Contains(string(res), "cipher") {
+			t.Errorf("queryService of %s shows the resource: %s", name, res)
+		}
+	}
+}
+
+func TestMigrateResources(t *testing.T) {
+	stub := newTestMarket(t, 1000, "alice", "bob")
+	api := publish(t, stub, "alice", "api", "10")
+	var legacy service
+	decode(t, stub.state[ServicePrefix+api], &legacy)
+	legacy.Resource = "https://legacy.example"
+	stub.state[ServicePrefix+api] = encode(t, legacy)
+	stub.mustInvoke(t, addr("bob"), CallService, api, "1")
+
+	if got := string(stub.mustInvoke(t, addr("bob"), GetServiceResource, api)); got != legacy.Resource {
+		t.Errorf("buyer got %q before the migration, want the legacy resource", got)
+	}
+	if res := stub.invoke(addr("alice"), MigrateResources); res.Status == shim.OK {
+		t.Fatal("a user migrated the resources")
+	}
+	for i, want := range []string{"1 resources migrated.", "0 resources migrated."} {
+		if got := string(stub.mustInvoke(t, testAdmin, MigrateResources)); got != want {
+			t.Errorf("run %d: %q, want %q", i, got, want)
+		}
+	}
+	if strings.Contains(string(stub.state[ServicePrefix+api]), "legacy.example") {
+		t.Error("the resource is left in the public record")
+	}
+	if got := string(stub.mustInvoke(t, addr("bob"), GetServiceResource, api)); got != legacy.Resource {
+		t.Errorf("buyer got %q, want the migrated resource", got)
+	}
+}
+
+func TestTransferExpiry(t *testing.T) {
+	tests := []struct {
+		name   string
+		wait   int64 // seconds after the transfer before the developer approves
+		sweep  bool  // expireCallTimes is invoked before approving
+		ok     bool
+		status string
+		calls  int64 // call times carol gets
+	}{
+		{"approved in time", 10, false, true, T_Completed, 8},
+		{"first lot expired", 60, false, true, T_Completed, 3},
+		{"all expired", 120, false, true, T_Expired, 0},
+		{"first lot swept", 60, true, true, T_Completed, 3},
+		{"all swept", 120, true, false, T_Expired, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newTestMarket(t, 1000, "alice", "bob", "carol")
+			api := publish(t, stub, "alice", "api", "10")
+			stub.mustInvoke(t, addr("alice"), SetCallTimeValidity, api, "100")
+			stub.mustInvoke(t, addr("alice"), SetTransferApproval, api, "true")
+			stub.mustInvoke(t, addr("bob"), CallService, api, "5")
+			stub.now += 50
+			stub.mustInvoke(t, addr("bob"), CallService, api, "5")
+			var transfer callTimeTransfer
+			decode(t, stub.mustInvoke(t, addr("bob"), TransferCallTimes, api, "carol", "8"), &transfer)
+
+			stub.now += tt.wait
+			if tt.sweep {
+				stub.mustInvoke(t, addr("carol"), ExpireCallTimes, api)
+			}
+			res := stub.invoke(addr("alice"), ApproveCallTimeTransfer, api, transfer.ID, "true")
+			if (res.Status == shim.OK) != tt.ok {
+				t.Fatalf("approval status %d (%s), want success %v", res.Status, res.Message, tt.ok)
+			}
+
+			var logs []callTimeTransfer
+			decode(t, stub.mustInvoke(t, addr("carol"), QueryCallTimeTransfers, "carol", api), &logs)
+			if len(logs) != 1 || logs[0].Status != tt.status || logs[0].CallTimes.Int64() != tt.calls {
+				t.Errorf("transfers %+v, want one %s with %d call times", logs, tt.status, tt.calls)
+			}
+			calls := int64(0)
+			if recordJson := stub.state[ServiceCallTimesPrefix+api+"carol"]; recordJson != nil {
+				var record serviceCallTime
+				decode(t, recordJson, &record)
+				calls = record.CallTimes.Int64()
+			}
+			if calls != tt.calls {
+				t.Errorf("carol has %d call times, want %d", calls, tt.calls)
+			}
+		})
+	}
+}
+
+func TestMigrateServiceName(t *testing.T) {
+	stub := newTestMarket(t, 1000, "alice", "bob", "carol", "dave")
+	// a service registered before services were namespaced
+	legacy := service{Name: "geo", Type: "api", Developer: "carol", Price: big.NewInt(2), License: L_Commercial,
+		Visibility: V_Public, Status: S_Available, Composition: map[string]int{}}
+	stub.state[ServicePrefix+"geo"] = encode(t, legacy)
+	userKey, err := stub.CreateCompositeKey(UserServicesKey, []string{"carol", "geo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub.state[userKey] = stub.state[ServicePrefix+"geo"]
+	tiles := publish(t, stub, "dave", "map", "3")
+
+	stub.mustInvoke(t, addr("alice"), CreateMashup, "trip", "api", "mashup", "alice", AutoPrice, L_Commercial, "geo:2", tiles)
+	stub.mustInvoke(t, addr("alice"), CreateMashup, "route", "api", "mashup", "alice", AutoPrice, L_Commercial, "geo", tiles)
+	stub.mustInvoke(t, addr("alice"), EditMashup, "alice/trip", EditAdd, "geo")
+	stub.mustInvoke(t, addr("alice"), EditMashup, "alice/route", EditRemove, "geo")
+	stub.mustInvoke(t, addr("bob"), CallService, "geo", "5")
+
+	if res := stub.invoke(addr("alice"), MigrateServiceName, "geo"); res.Status == shim.OK {
+		t.Fatal("a user migrated another developer's service")
+	}
+	if got := string(stub.mustInvoke(t, addr("carol"), MigrateServiceName, "geo")); got != "carol/geo" {
+		t.Fatalf("migrated to %q, want carol/geo", got)
+	}
+
+	if stub.state[ServicePrefix+"geo"] != nil || stub.state[ServicePrefix+"carol/geo"] == nil {
+		t.Error("the service is not moved to its new name")
+	}
+	if got := string(stub.state[ServiceAliasPrefix+"geo"]); got != "carol/geo" {
+		t.Errorf("alias of geo = %q, want carol/geo", got)
+	}
+	if got := getCallTimeRecord(t, stub, "carol/geo", "bob").CallTimes.Int64(); got != 5 {
+		t.Errorf("bob has %d call times of carol/geo, want 5", got)
+	}
+	var trip service
+	decode(t, stub.mustInvoke(t, addr("bob"), QueryService, "alice/trip"), &trip)
+	if trip.Composition["carol/geo"] != 3 || len(trip.Composition) != 2 {
+		t.Errorf("trip composes %v, want carol/geo 3 times", trip.Composition)
+	}
+	for _, mashup := range []string{"alice/trip", "alice/route"} {
+		var history []compositionChange
+		decode(t, stub.mustInvoke(t, addr("bob"), QueryMashupHistory, mashup), &history)
+		if len(history) != 1 {
+			t.Fatalf("%d changes of %s, want 1", len(history), mashup)
+		}
+		change := history[0]
+		for _, names := range [][]string{change.Added, change.Removed, keysOf(change.Old), keysOf(change.New)} {
+			if containsString(names, "geo") {
+				t.Errorf("%s history still names geo: %+v", mashup, change)
+			}
+		}
+		if _, ok := change.Old["carol/geo"]; !ok {
+			t.Errorf("%s history lost carol/geo: %+v", mashup, change)
+		}
+	}
+}
+
+func keysOf(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func TestCheckLicense(t *testing.T) {
+	tests := []struct {
+		license       string
+		mashupDev     string
+		mashupPrice   int64
+		mashupLicense string
+		ok            bool
+	}{
+		{L_Proprietary, "alice", 0, L_Commercial, false},
+		{L_Proprietary, "carol", 5, L_Proprietary, true}, // the developer's own service
+		{L_Attribution, "alice", 0, L_Commercial, true},
+		{L_Attribution, "alice", 5, L_Commercial, false},
+		{L_Attribution, "alice", 0, L_Proprietary, false},
+		{L_Royalty, "alice", 0, L_Commercial, false},
+		{L_Royalty, "alice", 5, L_Proprietary, true},
+		{L_Commercial, "alice", 5, L_Proprietary, true},
+		{"", "alice", 0, L_Proprietary, true}, // registered before licenses, commercial
+	}
+	for _, tt := range tests {
+		component := service{Name: "carol/geo", Developer: "carol", License: tt.license}
+		err := checkLicense(component, tt.mashupDev, big.NewInt(tt.mashupPrice), tt.mashupLicense)
+		if (err == nil) != tt.ok {
+			t.Errorf("%q composed by %s at %d under %s: err %v, want ok %v", tt.license, tt.mashupDev, tt.mashupPrice, tt.mashupLicense, err, tt.ok)
+		}
+	}
+}
+
+func TestCreateMashupChecksLicenses(t *testing.T) {
+	stub := newTestMarket(t, 1000, "alice", "carol")
+	geo := publish(t, stub, "carol", "geo", "2")
+	if res := stub.invoke(addr("carol"), SetServiceLicense, geo, "shareware"); res.Status == shim.OK {
+		t.Error("an unknown license was set")
+	}
+	stub.mustInvoke(t, addr("carol"), SetServiceLicense, geo, L_Royalty)
+
+	if res := stub.invoke(addr("alice"), CreateMashup, "free", "api", "mashup", "alice", "0", L_Commercial, geo); res.Status == shim.OK {
+		t.Error("a royalty-bearing service was composed into a free mashup")
+	}
+	stub.mustInvoke(t, addr("alice"), CreateMashup, "paid", "api", "mashup", "alice", "5", L_Commercial, geo)
+
+	var mashup service
+	decode(t, stub.mustInvoke(t, addr("alice"), QueryService, "alice/paid"), &mashup)
+	if mashup.License != L_Commercial || mashup.Composition[geo] != 1 {
+		t.Errorf("mashup %+v, want a commercial mashup composing %s", mashup, geo)
+	}
+}
+
+func TestServiceVisibility(t *testing.T) {
+	stub := newTestMarket(t, 1000, "alice", "bob", "dave")
+	stub.mustInvoke(t, addr("carol"), RegisterUser, "carol", "intro of carol", "acme")
+	stub.balances[addr("carol")] = big.NewInt(1000)
+	api := publish(t, stub, "alice", "api", "1")
+
+	listed := func(sender string) bool {
+		var services []service
+		decode(t, stub.mustInvoke(t, addr(sender), QueryServiceByRange, "0", "100"), &services)
+		for _, s := range services {
+			if s.Name == api {
+				return true
+			}
+		}
+		return false
+	}
+	callable := func(sender string) bool {
+		return stub.invoke(addr(sender), CallService, api, "1").Status == shim.OK
+	}
+
+	if !listed("dave") {
+		t.Fatal("a public service is not listed")
+	}
+	stub.mustInvoke(t, addr("alice"), SetServiceVisibility, api, V_Unlisted)
+	if listed("dave") || !callable("dave") {
+		t.Error("an unlisted service must not be listed but stay callable")
+	}
+
+	stub.mustInvoke(t, addr("alice"), SetServiceVisibility, api, V_AllowList)
+	stub.mustInvoke(t, addr("alice"), AddServiceAllowList, api, AllowUser, "bob")
+	stub.mustInvoke(t, addr("alice"), AddServiceAllowList, api, AllowOrganization, "acme")
+	for sender, want := range map[string]bool{"alice": true, "bob": true, "carol": true, "dave": false} {
+		if got := callable(sender); got != want {
+			t.Errorf("%s can call the allow-listed service: %v, want %v", sender, got, want)
+		}
+	}
+
+	stub.mustInvoke(t, addr("alice"), RemoveServiceAllowList, api, AllowUser, "bob")
+	if callable("bob") {
+		t.Error("bob can still call after being removed from the allow-list")
+	}
+	if res := stub.invoke(addr("bob"), SetServiceVisibility, api, V_Public); res.Status == shim.OK {
+		t.Error("a user changed the visibility of another developer's service")
+	}
+}
+
+func TestServiceQuota(t *testing.T) {
+	stub := newTestMarket(t, 1000, "alice", "bob")
+	api := publish(t, stub, "alice", "api", "1")
+	stub.mustInvoke(t, addr("bob"), CallService, api, "100")
+	if res := stub.invoke(addr("bob"), SetServiceQuota, api, "3", "5"); res.Status == shim.OK {
+		t.Fatal("a caller set the quota")
+	}
+	stub.mustInvoke(t, addr("alice"), SetServiceQuota, api, "3", "5")
+
+	steps := []struct {
+		advance int64 // seconds before the reduction
+		calls   string
+		ok      bool
+		hour    int64 // remaining after it
+		day     int64
+	}{
+		{0, "2", true, 1, 3},
+		{0, "2", false, 1, 3},
+		{QuotaHour, "2", true, 1, 1},
+		{QuotaHour, "2", false, 3, 1},
+		{0, "1", true, 2, 0},
+		{QuotaDay, "3", true, 0, 2},
+	}
+	for i, step := range steps {
+		stub.now += step.advance
+		res := stub.invoke(addr("alice"), ReduceCallTime, api, "bob", step.calls)
+		if (res.Status == shim.OK) != step.ok {
+			t.Fatalf("step %d: reduce %s status %d (%s), want success %v", i, step.calls, res.Status, res.Message, step.ok)
+		}
+		var status quotaStatus
+		decode(t, stub.mustInvoke(t, addr("bob"), GetQuota, api, "bob"), &status)
+		if status.RemainingHour != step.hour || status.RemainingDay != step.day {
+			t.Errorf("step %d: %d left this hour and %d today, want %d and %d", i, status.RemainingHour, status.RemainingDay, step.hour, step.day)
+		}
+	}
+}
+
+func TestSplitRevenue(t *testing.T) {
+	tests := []struct {
+		name  string
+		terms revenueTerms
+		want  map[string]int64
+	}{
+		{"plain service", revenueTerms{}, map[string]int64{"alice": 100}},
+		{"weighted components", revenueTerms{ComponentShare: 40, Weights: map[string]int64{"carol": 3, "dave": 1}},
+			map[string]int64{"alice": 60, "carol": 30, "dave": 10}},
+		{"rounded down to the developer", revenueTerms{ComponentShare: 10, Weights: map[string]int64{"carol": 1, "dave": 2}},
+			map[string]int64{"alice": 91, "carol": 3, "dave": 6}},
+		{"fork royalty first", revenueTerms{ForkDeveloper: "erin", ForkRoyalty: 20, ComponentShare: 50, Weights: map[string]int64{"carol": 1}},
+			map[string]int64{"alice": 40, "carol": 40, "erin": 20}},
+		{"no weights", revenueTerms{ComponentShare: 50}, map[string]int64{"alice": 100}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shares := splitRevenue("alice", tt.terms, big.NewInt(100))
+			got := make(map[string]int64, len(shares))
+			for k, v := range shares {
+				got[k] = v.Int64()
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("shares %v, want %v", got, tt.want)
+			}
+			for k, v := range tt.want {
+				if got[k] != v {
+					t.Errorf("shares %v, want %v", got, tt.want)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestMashupPayouts(t *testing.T) {
+	stub := newTestMarket(t, 1000, "alice", "bob", "carol", "dave")
+	geo := publish(t, stub, "carol", "geo", "1")
+	tiles := publish(t, stub, "dave", "map", "1")
+	stub.mustInvoke(t, addr("alice"), CreateMashup, "trip", "api", "mashup", "alice", "10", L_Commercial, geo, tiles)
+	stub.mustInvoke(t, addr("alice"), PublishService, "alice/trip")
+	if res := stub.invoke(addr("alice"), SetRevenueShare, "alice/trip", "40", "nope=1"); res.Status == shim.OK {
+		t.Error("a weight was set for a service the mashup doesn't compose")
+	}
+	stub.mustInvoke(t, addr("alice"), SetRevenueShare, "alice/trip", "40", geo+"=3", tiles+"=1")
+	stub.mustInvoke(t, addr("bob"), CallService, "alice/trip", "10")
+
+	for name, want := range map[string]int64{"alice": 60, "carol": 30, "dave": 10} {
+		var payouts []payoutRecord
+		decode(t, stub.mustInvoke(t, addr(name), GetPayouts, name, "alice/trip"), &payouts)
+		got := int64(0)
+		for _, payout := range payouts {
+			if payout.Payer != "bob" {
+				t.Errorf("payout %+v not paid by bob", payout)
+			}
+			got += payout.Amount.Int64()
+		}
+		if got != want {
+			t.Errorf("%s was paid %d, want %d", name, got, want)
+		}
+	}
+}
+
+func TestMashupMultiplicity(t *testing.T) {
+	tests := []struct {
+		components []string
+		geoCalls   int // calls of geo per mashup call, 0 if the mashup can't be created
+		price      int64
+	}{
+		{[]string{"carol/geo"}, 1, 2},
+		{[]string{"carol/geo:2", "dave/map"}, 2, 7},
+		{[]string{"carol/geo:2", "carol/geo"}, 3, 6},
+		{[]string{"carol/geo:0"}, 0, 0},
+		{[]string{":2"}, 0, 0},
+	}
+	for _, tt := range tests {
+		name := strings.Join(tt.components, ",")
+		t.Run(name, func(t *testing.T) {
+			stub := newTestMarket(t, 1000, "alice", "carol", "dave")
+			publish(t, stub, "carol", "geo", "2")
+			publish(t, stub, "dave", "map", "3")
+			args := append([]string{"trip", "api", "mashup", "alice", AutoPrice, L_Commercial}, tt.components...)
+			res := stub.invoke(addr("alice"), CreateMashup, args...)
+			if (res.Status == shim.OK) != (tt.geoCalls > 0) {
+				t.Fatalf("createMashup status %d (%s), want success %v", res.Status, res.Message, tt.geoCalls > 0)
+			}
+			if tt.geoCalls == 0 {
+				return
+			}
+			var mashup service
+			decode(t, stub.mustInvoke(t, addr("alice"), QueryService, "alice/trip"), &mashup)
+			if mashup.Composition["carol/geo"] != tt.geoCalls || mashup.Price.Int64() != tt.price {
+				t.Errorf("composition %v priced %s, want carol/geo %d times priced %d", mashup.Composition, mashup.Price, tt.geoCalls, tt.price)
+			}
+			var dependents []dependency
+			decode(t, stub.mustInvoke(t, addr("alice"), QueryDependents, "carol/geo"), &dependents)
+			if len(dependents) != 1 || dependents[0].Multiplicity != tt.geoCalls {
+				t.Errorf("dependents %+v, want alice/trip calling %d times", dependents, tt.geoCalls)
+			}
+		})
+	}
+}
+
+func TestNestedMashups(t *testing.T) {
+	stub := newTestMarket(t, 1000, "alice", "carol")
+	geo := publish(t, stub, "carol", "geo", "1")
+
+	// chain m1 -> geo, m2 -> m1:2, ... each level doubles the calls of geo
+	component := geo
+	for level := 1; level <= MaxMashupDepth; level++ {
+		calls := "1"
+		if level > 1 {
+			calls = "2"
+		}
+		name := fmt.Sprintf("m%d", level)
+		stub.mustInvoke(t, addr("alice"), CreateMashup, name, "api", "mashup", "alice", AutoPrice, L_Commercial, component+":"+calls)
+		component = qualifiedServiceName("alice", name)
+		stub.mustInvoke(t, addr("alice"), PublishService, component)
+	}
+
+	var tree mashupTree
+	decode(t, stub.mustInvoke(t, addr("alice"), QueryMashupTree, component), &tree)
+	if tree.Depth != MaxMashupDepth {
+		t.Errorf("depth %d, want %d", tree.Depth, MaxMashupDepth)
+	}
+	if want := 1 << (MaxMashupDepth - 1); tree.Services[geo] != want {
+		t.Errorf("%s called %d times per call of %s, want %d", geo, tree.Services[geo], component, want)
+	}
+
+	res := stub.invoke(addr("alice"), CreateMashup, "deep", "api", "mashup", "alice", AutoPrice, L_Commercial, component)
+	if res.Status == shim.OK || !strings.Contains(res.Message, "nested deeper") {
+		t.Errorf("mashup nested %d levels deep: %d %s", MaxMashupDepth+1, res.Status, res.Message)
+	}
+
+	// m1 can't compose any mashup built on top of it
+	res = stub.invoke(addr("alice"), EditMashup, "alice/m1", EditAdd, "alice/m3")
+	if res.Status == shim.OK || !strings.Contains(res.Message, "cycle") {
+		t.Errorf("cycle through alice/m3 accepted: %d %s", res.Status, res.Message)
+	}
+	res = stub.invoke(addr("alice"), EditMashup, "alice/m1", EditAdd, "alice/m1")
+	if res.Status == shim.OK {
+		t.Error("alice/m1 composes itself")
+	}
+}
+
+func TestStatusPropagation(t *testing.T) {
+	stub := newTestMarket(t, 1000, "alice", "bob", "carol", "dave")
+	geo := publish(t, stub, "carol", "geo", "1")
+	tiles := publish(t, stub, "dave", "tiles", "1")
+	stub.mustInvoke(t, addr("alice"), CreateMashup, "trip", "api", "mashup", "alice", AutoPrice, L_Commercial, geo, tiles)
+	stub.mustInvoke(t, addr("alice"), PublishService, "alice/trip")
+	stub.mustInvoke(t, addr("alice"), CreateMashup, "tour", "api", "mashup", "alice", AutoPrice, L_Commercial, "alice/trip")
+	stub.mustInvoke(t, addr("alice"), PublishService, "alice/tour")
+	stub.mustInvoke(t, addr("alice"), CreateMashup, "map", "api", "mashup", "alice", AutoPrice, L_Commercial, tiles)
+	stub.mustInvoke(t, addr("alice"), PublishService, "alice/map")
+
+	statusOf := func(name string) string {
+		var s service
+		decode(t, stub.state[ServicePrefix+name], &s)
+		return s.Status
+	}
+	lastEvent := func() statusEvent {
+		var event statusEvent
+		if stub.eventName != ServiceStatusEvent {
+			t.Fatalf("event %q, want %q", stub.eventName, ServiceStatusEvent)
+		}
+		decode(t, stub.event, &event)
+		return event
+	}
+
+	stub.mustInvoke(t, addr("carol"), InvalidateService, geo)
+	event := lastEvent()
+	if event.ServiceName != geo || event.Status != S_Invalid ||
+		strings.Join(event.Degraded, ",") != "alice/trip,alice/tour" || len(event.Restored) != 0 {
+		t.Errorf("invalidating %s notified %+v", geo, event)
+	}
+	for name, want := range map[string]string{"alice/trip": S_Degraded, "alice/tour": S_Degraded, "alice/map": S_Available} {
+		if got := statusOf(name); got != want {
+			t.Errorf("%s is %s after invalidating %s, want %s", name, got, geo, want)
+		}
+	}
+	if res := stub.invoke(addr("bob"), CallService, "alice/tour", "1"); res.Status == shim.OK {
+		t.Error("a degraded mashup was called")
+	}
+	stub.mustInvoke(t, addr("bob"), CallService, "alice/map", "1")
+
+	stub.mustInvoke(t, addr("carol"), PublishService, geo)
+	if event := lastEvent(); strings.Join(event.Restored, ",") != "alice/trip,alice/tour" || len(event.Degraded) != 0 {
+		t.Errorf("publishing %s again notified %+v", geo, event)
+	}
+	if statusOf("alice/tour") != S_Available {
+		t.Errorf("alice/tour is %s once %s is available again", statusOf("alice/tour"), geo)
+	}
+	stub.mustInvoke(t, addr("bob"), CallService, "alice/tour", "1")
+
+	// a change that doesn't affect any mashup isn't notified
+	stub.mustInvoke(t, addr("alice"), InvalidateService, "alice/map")
+	if stub.eventName != "" {
+		t.Errorf("invalidating an unused mashup set event %q", stub.eventName)
+	}
+}
+
+func TestEditMashup(t *testing.T) {
+	stub := newTestMarket(t, 1000, "alice", "bob", "carol")
+	geo := publish(t, stub, "carol", "geo", "2")
+	tiles := publish(t, stub, "carol", "tiles", "3")
+	stub.mustInvoke(t, addr("alice"), CreateMashup, "trip", "api", "mashup", "alice", "20", L_Commercial, geo)
+
+	steps := []struct {
+		sender    string
+		operation string
+		services  []string
+		ok        bool
+		want      string // composition after the step
+	}{
+		{"alice", EditAdd, []string{tiles, geo + ":2"}, true, "carol/geo=3 carol/tiles=1"},
+		{"bob", EditAdd, []string{tiles}, false, "carol/geo=3 carol/tiles=1"},
+		{"alice", "merge", []string{tiles}, false, "carol/geo=3 carol/tiles=1"},
+		{"alice", EditRemove, []string{"carol/none"}, false, "carol/geo=3 carol/tiles=1"},
+		{"alice", EditRemove, []string{geo}, true, "carol/tiles=1"},
+		{"alice", EditRemove, []string{tiles}, false, "carol/tiles=1"},
+		{"alice", EditReplace, []string{geo + ":4"}, true, "carol/geo=4"},
+	}
+	for i, step := range steps {
+		args := append([]string{"alice/trip", step.operation}, step.services...)
+		res := stub.invoke(addr(step.sender), EditMashup, args...)
+		if (res.Status == shim.OK) != step.ok {
+			t.Fatalf("step %d: %s %v by %s returned %d (%s)", i, step.operation, step.services, step.sender, res.Status, res.Message)
+		}
+		var mashup service
+		decode(t, stub.state[ServicePrefix+"alice/trip"], &mashup)
+		services := keysOf(mashup.Composition)
+		sort.Strings(services)
+		parts := make([]string, 0)
+		for _, k := range services {
+			parts = append(parts, fmt.Sprintf("%s=%d", k, mashup.Composition[k]))
+		}
+		if got := strings.Join(parts, " "); got != step.want {
+			t.Errorf("step %d: composition %s, want %s", i, got, step.want)
+		}
+	}
+
+	var history []compositionChange
+	decode(t, stub.mustInvoke(t, addr("bob"), QueryMashupHistory, "alice/trip"), &history)
+	if len(history) != 3 {
+		t.Fatalf("%d changes recorded, want 3", len(history))
+	}
+	last := history[2]
+	if last.Operation != EditReplace || last.Old[tiles] != 1 || last.New[geo] != 4 ||
+		strings.Join(last.Added, ",") != geo || strings.Join(last.Removed, ",") != tiles {
+		t.Errorf("last change %+v", last)
+	}
+	if history[1].Operation != EditRemove || len(history[1].Added) != 0 {
+		t.Errorf("second change %+v", history[1])
+	}
+
+	var dependents []dependency
+	decode(t, stub.mustInvoke(t, addr("bob"), QueryDependents, tiles), &dependents)
+	if len(dependents) != 0 {
+		t.Errorf("%s still has dependents %+v", tiles, dependents)
+	}
+}
+
+func TestCompositionFees(t *testing.T) {
+	stub := newTestMarket(t, 1000, "alice", "carol", "dave", "erin")
+	geo := publish(t, stub, "carol", "geo", "2")
+	roads := publish(t, stub, "carol", "roads", "1")
+	tiles := publish(t, stub, "dave", "tiles", "3")
+	free := publish(t, stub, "erin", "free", "1")
+	stub.mustInvoke(t, addr("carol"), SetCompositionFee, geo, "5")
+	stub.mustInvoke(t, addr("erin"), SetCompositionFee, free, "0", "INK")
+	for _, args := range [][]string{{geo, "-1"}, {geo, "x"}, {geo, "1", " "}} {
+		if res := stub.invoke(addr("carol"), SetCompositionFee, args...); res.Status == shim.OK {
+			t.Errorf("composition fee %q accepted", args[1:])
+		}
+	}
+	if res := stub.invoke(addr("dave"), SetCompositionFee, geo, "0"); res.Status == shim.OK {
+		t.Error("the composition fee was set by another developer")
+	}
+
+	components := []string{geo + ":2", tiles, free}
+	var quote mashupQuote
+	decode(t, stub.mustInvoke(t, addr("alice"), QuoteMashup, components...), &quote)
+	if quote.Total[FeeBalanceType].Int64() != 20 || quote.Total["INK"].Sign() != 0 || quote.ComponentCost.Int64() != 8 {
+		t.Errorf("quote totals %v, component cost %s", quote.Total, quote.ComponentCost)
+	}
+	quoted := make(map[string]int64)
+	for _, fee := range quote.Fees {
+		quoted[fee.Developer] += fee.Amount.Int64()
+	}
+
+	before := stub.balances
+	stub.balances = make(map[string]*big.Int)
+	for k, v := range before {
+		stub.balances[k] = new(big.Int).Set(v)
+	}
+	args := append([]string{"trip", "api", "mashup", "alice", AutoPrice, L_Commercial}, components...)
+	stub.mustInvoke(t, addr("alice"), CreateMashup, args...)
+	var paid int64
+	for _, developer := range []string{"carol", "dave", "erin"} {
+		got := stub.balance(addr(developer)).Int64() - before[addr(developer)].Int64()
+		if got != quoted[developer] {
+			t.Errorf("%s was paid %d, quoted %d", developer, got, quoted[developer])
+		}
+		paid += got
+	}
+	if spent := before[addr("alice")].Int64() - stub.balance(addr("alice")).Int64(); spent != paid {
+		t.Errorf("alice spent %d, developers got %d", spent, paid)
+	}
+
+	// carol is already paid by this mashup, composing another of her services is free
+	carol := stub.balance(addr("carol")).Int64()
+	stub.mustInvoke(t, addr("alice"), EditMashup, "alice/trip", EditAdd, roads)
+	if got := stub.balance(addr("carol")).Int64(); got != carol {
+		t.Errorf("carol was paid %d again", got-carol)
+	}
+}
+
+func TestDeveloperBundle(t *testing.T) {
+	stub := newTestMarket(t, 1000, "alice", "bob", "carol", "dave")
+	geo := publish(t, stub, "carol", "geo", "2")
+	tiles := publish(t, stub, "dave", "tiles", "3")
+	stub.mustInvoke(t, addr("alice"), CreateMashup, "trip", "api", "mashup", "alice", "10", L_Commercial, geo+":2", tiles)
+	stub.mustInvoke(t, addr("alice"), PublishService, "alice/trip")
+
+	for _, args := range [][]string{{geo, "5", BundleBuyer}, {"alice/trip", "5", "everyone"}} {
+		if res := stub.invoke(addr("bob"), CallService, args...); res.Status == shim.OK {
+			t.Errorf("bundle %v accepted", args)
+		}
+	}
+
+	start := make(map[string]int64)
+	for _, name := range []string{"alice", "bob", "carol", "dave"} {
+		start[name] = stub.balance(addr(name)).Int64()
+	}
+	stub.mustInvoke(t, addr("bob"), CallService, "alice/trip", "5", BundleDeveloper)
+	// the mashup keeps its margin of 10 - (2*2 + 3) per call, the components are paid their price
+	for name, want := range map[string]int64{"alice": 15, "bob": -50, "carol": 20, "dave": 15} {
+		if got := stub.balance(addr(name)).Int64() - start[name]; got != want {
+			t.Errorf("balance of %s changed by %d, want %d", name, got, want)
+		}
+	}
+	if got := getCallTimeRecord(t, stub, "alice/trip", "bob").CallTimes.Int64(); got != 5 {
+		t.Errorf("bob has %d call times of alice/trip, want 5", got)
+	}
+	if got := getCallTimeRecord(t, stub, geo, "alice").CallTimes.Int64(); got != 10 {
+		t.Errorf("alice has %d call times of %s, want 10", got, geo)
+	}
+	if _, ok := stub.state[ServiceCallTimesPrefix+geo+"bob"]; ok {
+		t.Errorf("bob got call times of %s bundled for the developer", geo)
+	}
+
+	// a component the beneficiary can't access fails the whole purchase
+	stub.mustInvoke(t, addr("dave"), SetServiceVisibility, tiles, V_AllowList)
+	if res := stub.invoke(addr("bob"), CallService, "alice/trip", "1", BundleBuyer); res.Status == shim.OK {
+		t.Errorf("%s bundled for bob, who isn't allowed to call it", tiles)
+	}
+	if got := getCallTimeRecord(t, stub, "alice/trip", "bob").CallTimes.Int64(); got != 5 {
+		t.Errorf("a failed bundle left bob with %d call times of alice/trip", got)
+	}
+}
+
+func TestForkMashup(t *testing.T) {
+	stub := newTestMarket(t, 1000, "alice", "bob", "carol", "erin")
+	geo := publish(t, stub, "carol", "geo", "2")
+	stub.mustInvoke(t, addr("alice"), CreateMashup, "trip", "api", "mashup", "alice", "10", L_Commercial, geo+":3")
+
+	for _, percent := range []string{"-1", "101", "ten"} {
+		if res := stub.invoke(addr("alice"), SetForkRoyalty, "alice/trip", percent); res.Status == shim.OK {
+			t.Errorf("fork royalty %s accepted", percent)
+		}
+	}
+	if res := stub.invoke(addr("erin"), SetForkRoyalty, "alice/trip", "90"); res.Status == shim.OK {
+		t.Error("the fork royalty was set by another developer")
+	}
+	if res := stub.invoke(addr("alice"), SetForkRoyalty, geo, "20"); res.Status == shim.OK {
+		t.Error("a fork royalty was set on a plain service")
+	}
+	stub.mustInvoke(t, addr("alice"), SetForkRoyalty, "alice/trip", "20")
+
+	if res := stub.invoke(addr("erin"), ForkMashup, geo, "mygeo", "api", "fork", "erin", "50", L_Commercial); res.Status == shim.OK {
+		t.Error("a plain service was forked")
+	}
+	stub.mustInvoke(t, addr("erin"), ForkMashup, "alice/trip", "mytrip", "api", "fork", "erin", "50", L_Commercial)
+	stub.mustInvoke(t, addr("erin"), PublishService, "erin/mytrip")
+	// the royalty of the fork is the one set when it was forked
+	stub.mustInvoke(t, addr("alice"), SetForkRoyalty, "alice/trip", "50")
+
+	var fork service
+	decode(t, stub.mustInvoke(t, addr("bob"), QueryService, "erin/mytrip"), &fork)
+	if fork.ForkedFrom != "alice/trip" || fork.ForkRoyalty != 20 || fork.Composition[geo] != 3 || fork.Developer != "erin" {
+		t.Fatalf("fork %+v", fork)
+	}
+
+	alice, erin := stub.balance(addr("alice")).Int64(), stub.balance(addr("erin")).Int64()
+	stub.mustInvoke(t, addr("bob"), CallService, "erin/mytrip", "2")
+	if got := stub.balance(addr("alice")).Int64() - alice; got != 20 {
+		t.Errorf("alice got a royalty of %d, want 20", got)
+	}
+	if got := stub.balance(addr("erin")).Int64() - erin; got != 80 {
+		t.Errorf("erin got %d, want 80", got)
+	}
+
+	stub.mustInvoke(t, addr("alice"), InvalidateService, "alice/trip")
+	if res := stub.invoke(addr("erin"), ForkMashup, "alice/trip", "again", "api", "fork", "erin", "50", L_Commercial); res.Status == shim.OK {
+		t.Error("an invalid mashup was forked")
+	}
+}
+
+func TestCallTimeValidity(t *testing.T) {
+	stub := newTestMarket(t, 1000, "bob", "carol", "dave")
+	geo := publish(t, stub, "carol", "geo", "2")
+	for _, validity := range []string{"-1", "a day"} {
+		if res := stub.invoke(addr("carol"), SetCallTimeValidity, geo, validity); res.Status == shim.OK {
+			t.Errorf("validity %q accepted", validity)
+		}
+	}
+	stub.mustInvoke(t, addr("carol"), SetCallTimeValidity, geo, "100")
+
+	reduce := func(count int) pb.Response {
+		return stub.invoke(addr("carol"), ReduceCallTimes, fmt.Sprintf(`[{"service":%q,"caller":"bob","count":%d}]`, geo, count))
+	}
+	stub.mustInvoke(t, addr("bob"), CallService, geo, "5")
+	stub.now += 60
+	stub.mustInvoke(t, addr("bob"), CallService, geo, "3")
+	// the lot expiring first is used first
+	if res := reduce(2); res.Status != shim.OK {
+		t.Fatalf("reduce failed: %s", res.Message)
+	}
+
+	stub.now += 45
+	if res := reduce(4); res.Status == shim.OK {
+		t.Error("expired call times were reduced")
+	}
+	carol := stub.balance(addr("carol")).Int64()
+	var expired []expiredCallTimes
+	decode(t, stub.mustInvoke(t, addr("dave"), ExpireCallTimes, geo), &expired)
+	if len(expired) != 1 || expired[0].UserName != "bob" || expired[0].CallTimes.Int64() != 3 || expired[0].Paid.Int64() != 6 {
+		t.Errorf("expired %+v, want 3 call times of bob paid 6", expired)
+	}
+	if got := stub.balance(addr("carol")).Int64(); got != carol {
+		t.Errorf("carol's balance changed by %d when call times expired", got-carol)
+	}
+	if got := getCallTimeRecord(t, stub, geo, "bob").CallTimes.Int64(); got != 3 {
+		t.Errorf("bob has %d call times left, want 3", got)
+	}
+	if res := reduce(3); res.Status != shim.OK {
+		t.Errorf("reducing the valid call times failed: %s", res.Message)
+	}
+
+	// call times bought without validity never expire
+	stub.mustInvoke(t, addr("carol"), SetCallTimeValidity, geo, "0")
+	stub.mustInvoke(t, addr("bob"), CallService, geo, "1")
+	stub.now += 1 << 30
+	decode(t, stub.mustInvoke(t, addr("dave"), ExpireCallTimes, geo, "bob"), &expired)
+	if len(expired) != 0 {
+		t.Errorf("expired %+v without validity", expired)
+	}
+}
+
+// usageSigner signs usage receipts like a caller's client would
+type usageSigner struct {
+	key *ecdsa.PrivateKey
+}
+
+func newUsageSigner(t *testing.T) usageSigner {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return usageSigner{key}
+}
+
+func (s usageSigner) publicKey() string {
+	return hex.EncodeToString(elliptic.Marshal(elliptic.P256(), s.key.X, s.key.Y))
+}
+
+func (s usageSigner) sign(t *testing.T, receipt string) string {
+	digest := sha256.Sum256([]byte(receipt))
+	r, sig, err := ecdsa.Sign(rand.Reader, s.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := asn1.Marshal(ecdsaSignature{r, sig})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hex.EncodeToString(der)
+}
+
+func TestVerifyUsageReceipt(t *testing.T) {
+	bob, eve := newUsageSigner(t), newUsageSigner(t)
+	receipt := usageReceipt("carol/geo", "bob", big.NewInt(7), 1)
+	signature := bob.sign(t, receipt)
+	if err := verifyUsageReceipt(bob.publicKey(), receipt, signature); err != nil {
+		t.Fatalf("valid receipt rejected: %v", err)
+	}
+	for name, err := range map[string]error{
+		"other receipt":   verifyUsageReceipt(bob.publicKey(), usageReceipt("carol/geo", "bob", big.NewInt(70), 1), signature),
+		"other signer":    verifyUsageReceipt(bob.publicKey(), receipt, eve.sign(t, receipt)),
+		"not hex":         verifyUsageReceipt(bob.publicKey(), receipt, "zz"),
+		"not a signature": verifyUsageReceipt(bob.publicKey(), receipt, "3003020101"),
+		"bad key":         verifyUsageReceipt("04ab", receipt, signature),
+	} {
+		if err == nil {
+			t.Errorf("%s: receipt verified", name)
+		}
+	}
+}
+
+func TestSettleUsage(t *testing.T) {
+	stub := newTestMarket(t, 1000, "bob", "carol", "dave")
+	geo := publish(t, stub, "carol", "geo", "2")
+	stub.mustInvoke(t, addr("bob"), CallService, geo, "10")
+	bob := newUsageSigner(t)
+	settle := func(cumulative int64, nonce uint64, signer usageSigner) pb.Response {
+		receipt := usageReceipt(geo, "bob", big.NewInt(cumulative), nonce)
+		return stub.invoke(addr("carol"), SettleUsage, geo, "bob", strconv.FormatInt(cumulative, 10),
+			strconv.FormatUint(nonce, 10), signer.sign(t, receipt))
+	}
+
+	if res := settle(3, 1, bob); res.Status == shim.OK {
+		t.Fatal("settled before bob set a usage key")
+	}
+	if res := stub.invoke(addr("bob"), SetUsageKey, "04"+strings.Repeat("00", 64)); res.Status == shim.OK {
+		t.Error("a point off the curve was set as usage key")
+	}
+	stub.mustInvoke(t, addr("bob"), SetUsageKey, bob.publicKey())
+
+	if res := settle(3, 1, newUsageSigner(t)); res.Status == shim.OK {
+		t.Error("settled a receipt signed by another key")
+	}
+	if res := settle(3, 1, bob); res.Status != shim.OK {
+		t.Fatalf("settle failed: %s", res.Message)
+	}
+	if res := settle(3, 1, bob); res.Status == shim.OK {
+		t.Error("a receipt was settled twice")
+	}
+	if res := settle(2, 2, bob); res.Status == shim.OK {
+		t.Error("a receipt counting less calls was settled")
+	}
+	if res := settle(8, 5, bob); res.Status != shim.OK {
+		t.Fatalf("settle failed: %s", res.Message)
+	}
+	if got := getCallTimeRecord(t, stub, geo, "bob").CallTimes.Int64(); got != 2 {
+		t.Errorf("bob has %d call times left, want 2", got)
+	}
+	if res := settle(11, 6, bob); res.Status == shim.OK {
+		t.Error("more calls were settled than bob bought")
+	}
+	if res := stub.invoke(addr("dave"), SettleUsage, geo, "bob", "9", "7", bob.sign(t, usageReceipt(geo, "bob", big.NewInt(9), 7))); res.Status == shim.OK {
+		t.Error("usage was settled by another developer")
+	}
+
+	var settlement usageSettlement
+	decode(t, stub.mustInvoke(t, addr("dave"), GetUsageSettlement, geo, "bob"), &settlement)
+	if settlement.Cumulative.Int64() != 8 || settlement.Nonce != 5 {
+		t.Errorf("settlement %+v, want 8 calls at nonce 5", settlement)
+	}
+}
+
+func TestReduceCallTimesBatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		batch   string
+		ok      bool
+		records int              // reduce records returned
+		left    map[string]int64 // call times left of "service/caller"
+	}{
+		{
+			name:    "callers of two services",
+			batch:   `[{"service":"carol/geo","caller":"bob","count":2},{"service":"carol/tiles","caller":"erin","count":3},{"service":"carol/geo","caller":"erin","count":1}]`,
+			ok:      true,
+			records: 3,
+			left:    map[string]int64{"carol/geo/bob": 3, "carol/geo/erin": 4, "carol/tiles/erin": 2},
+		},
+		{
+			name:    "same caller added up",
+			batch:   `[{"service":"carol/geo","caller":"bob","count":3},{"service":"carol/geo","caller":" bob ","count":2}]`,
+			ok:      true,
+			records: 1,
+			left:    map[string]int64{"carol/geo/bob": 0, "carol/geo/erin": 5},
+		},
+		{
+			name:  "added up beyond the call times",
+			batch: `[{"service":"carol/geo","caller":"bob","count":3},{"service":"carol/geo","caller":"bob","count":3}]`,
+		},
+		{
+			name:  "one failing entry fails the batch",
+			batch: `[{"service":"carol/geo","caller":"bob","count":1},{"service":"carol/geo","caller":"nobody","count":1}]`,
+		},
+		{
+			name:  "service of another developer",
+			batch: `[{"service":"carol/geo","caller":"bob","count":1},{"service":"dave/map","caller":"bob","count":1}]`,
+		},
+		{name: "zero count", batch: `[{"service":"carol/geo","caller":"bob","count":0}]`},
+		{name: "no caller", batch: `[{"service":"carol/geo","caller":"","count":1}]`},
+		{name: "empty", batch: `[]`},
+		{name: "not a list", batch: `{"service":"carol/geo","caller":"bob","count":1}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newTestMarket(t, 1000, "bob", "carol", "dave", "erin")
+			publish(t, stub, "carol", "geo", "2")
+			publish(t, stub, "carol", "tiles", "1")
+			publish(t, stub, "dave", "map", "1")
+			for _, caller := range []string{"bob", "erin"} {
+				stub.mustInvoke(t, addr(caller), CallService, "carol/geo", "5")
+				stub.mustInvoke(t, addr(caller), CallService, "carol/tiles", "5")
+			}
+			stub.mustInvoke(t, addr("bob"), CallService, "dave/map", "5")
+
+			res := stub.invoke(addr("carol"), ReduceCallTimes, tt.batch)
+			if (res.Status == shim.OK) != tt.ok {
+				t.Fatalf("status %d (%s), want success %v", res.Status, res.Message, tt.ok)
+			}
+			if !tt.ok {
+				for _, caller := range []string{"bob", "erin"} {
+					if got := getCallTimeRecord(t, stub, "carol/geo", caller).CallTimes.Int64(); got != 5 {
+						t.Errorf("%s has %d call times of carol/geo after a failed batch", caller, got)
+					}
+				}
+				return
+			}
+			var records []reduceRecord
+			decode(t, res.Payload, &records)
+			for key, want := range tt.left {
+				i := strings.LastIndex(key, "/")
+				if got := getCallTimeRecord(t, stub, key[:i], key[i+1:]).CallTimes.Int64(); got != want {
+					t.Errorf("%s has %d call times left, want %d", key, got, want)
+				}
+			}
+			if len(records) != tt.records {
+				t.Errorf("%d reduce records returned, want %d", len(records), tt.records)
+			}
+		})
+	}
+}
+
+func TestRequestIDs(t *testing.T) {
+	stub := newTestMarket(t, 1000, "bob", "carol", "erin")
+	geo := publish(t, stub, "carol", "geo", "2")
+
+	// retry sends the request twice, the retry must return the first result without any write
+	retry := func(sender string, function string, args ...string) []byte {
+		t.Helper()
+		first := stub.mustInvoke(t, addr(sender), function, args...)
+		res := stub.invoke(addr(sender), function, args...)
+		if res.Status != shim.OK || string(res.Payload) != string(first) {
+			t.Fatalf("retry of %s%v returned %d %q, want %q", function, args, res.Status, res.Payload, first)
+		}
+		if len(stub.writes) != 0 || len(stub.transfers) != 0 {
+			t.Errorf("retry of %s%v wrote %v and transferred %v", function, args, keysOfBytes(stub.writes), stub.transfers)
+		}
+		return first
+	}
+
+	var purchase buyRecord
+	decode(t, retry("bob", CallService, geo, "5", "", "req-1"), &purchase)
+	if got := getCallTimeRecord(t, stub, geo, "bob").CallTimes.Int64(); got != 5 || purchase.UserName != "bob" {
+		t.Errorf("bob bought %d call times in %+v, want 5", got, purchase)
+	}
+	if res := stub.invoke(addr("bob"), CallService, geo, "6", "", "req-1"); res.Status == shim.OK {
+		t.Error("a request id was reused by another purchase")
+	}
+	// request ids are scoped by sender and by function
+	stub.mustInvoke(t, addr("erin"), CallService, geo, "5", "", "req-1")
+	retry("carol", ReduceCallTime, geo, "bob", "1", "req-1")
+	retry("carol", ReduceCallTimes, fmt.Sprintf(`[{"service":%q,"caller":"erin","count":2}]`, geo), "req-1")
+	if res := stub.invoke(addr("carol"), ReduceCallTimes, fmt.Sprintf(`[{"service":%q,"caller":"bob","count":2}]`, geo), "req-1"); res.Status == shim.OK {
+		t.Error("a request id was reused by another batch")
+	}
+
+	for caller, want := range map[string]int64{"bob": 4, "erin": 3} {
+		if got := getCallTimeRecord(t, stub, geo, caller).CallTimes.Int64(); got != want {
+			t.Errorf("%s has %d call times, want %d", caller, got, want)
+		}
+	}
+	// without a request id every request is processed
+	stub.mustInvoke(t, addr("bob"), CallService, geo, "1", "", "")
+	stub.mustInvoke(t, addr("bob"), CallService, geo, "1", "", "")
+	if got := getCallTimeRecord(t, stub, geo, "bob").CallTimes.Int64(); got != 6 {
+		t.Errorf("bob has %d call times, want 6", got)
+	}
+}
+
+func keysOfBytes(m map[string][]byte) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}